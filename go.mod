@@ -1,7 +1,6 @@
 module github.com/coreweave/aws-s3-reverse-proxy
 
 require (
-	github.com/VictoriaMetrics/fastcache v1.12.0 // indirect
 	github.com/aws/aws-sdk-go v1.44.67
 	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/ceph/go-ceph v0.17.0
@@ -13,6 +12,7 @@ require (
 	go.uber.org/multierr v1.8.0 // indirect
 	go.uber.org/zap v1.22.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 go 1.16
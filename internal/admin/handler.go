@@ -0,0 +1,332 @@
+package admin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/upstream"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdminCredentialSource tags credentials pushed through the admin endpoint
+const AdminCredentialSource = "admin"
+
+const (
+	keysPath    = "/admin/keys/"
+	refreshPath = "/admin/keys/refresh"
+	syncPath    = "/admin/sync"
+	webhookPath = "/admin/webhook"
+	circuitPath = "/admin/circuits"
+
+	signatureHeader = "X-Webhook-Signature"
+	signaturePrefix = "sha256="
+	timestampHeader = "X-Webhook-Timestamp"
+
+	// maxWebhookAge is how far the signed timestamp of a webhook may be from the local clock
+	maxWebhookAge = 5 * time.Minute
+
+	// maxBodyBytes bounds admin request bodies, they only ever carry a handful of keys
+	maxBodyBytes = 1 << 20
+)
+
+// Webhook event types understood by the webhook receiver
+const (
+	EventKeyCreated = "key.created"
+	EventKeyRotated = "key.rotated"
+	EventKeyRevoked = "key.revoked"
+	EventKeyDeleted = "key.deleted"
+	EventCacheSync  = "cache.sync"
+)
+
+var (
+	errMissingToken   = errors.New("admin token is required")
+	errNoAccessKeys   = errors.New("no access keys given")
+	errMissingSecret  = errors.New("secret_key is required")
+	errUnknownEvent   = errors.New("unknown webhook event type")
+	errBadSignature   = errors.New("invalid webhook signature")
+	errStaleWebhook   = errors.New("webhook timestamp is outside the accepted window or was already used")
+	errMethodNotAllow = errors.New("method not allowed")
+)
+
+// RefreshRequest is the body of a refresh call
+type RefreshRequest struct {
+	AccessKeys []string `json:"access_keys"`
+}
+
+// PutKeyRequest is the body of a key upsert
+type PutKeyRequest struct {
+	SecretKey string `json:"secret_key"`
+	User      string `json:"user,omitempty"`
+}
+
+// WebhookEvent is the body accepted by the webhook receiver
+type WebhookEvent struct {
+	Type       string   `json:"type"`
+	AccessKeys []string `json:"access_keys"`
+}
+
+type response struct {
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Handler serves the credential invalidation api. Every route except the webhook requires the bearer token,
+// the webhook is only enabled with a shared secret and authenticates by an HMAC-SHA256 signature of a timestamp and
+// the body.
+type Handler struct {
+	log           *zap.Logger
+	cache         internal.AuthCache
+	token         string
+	webhookSecret string
+	mux           *http.ServeMux
+	now           func() time.Time
+
+	// seen holds the signatures of accepted webhooks until their timestamp leaves the accepted window
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewHandler(log *zap.Logger, cache internal.AuthCache, token, webhookSecret string) (*Handler, error) {
+	if token == "" {
+		return nil, errMissingToken
+	}
+	h := &Handler{
+		log:           log,
+		cache:         cache,
+		token:         token,
+		webhookSecret: webhookSecret,
+		mux:           http.NewServeMux(),
+		now:           time.Now,
+		seen:          make(map[string]time.Time),
+	}
+	h.mux.Handle(syncPath, h.authenticated(h.handleSync))
+	h.mux.Handle(refreshPath, h.authenticated(h.handleRefresh))
+	h.mux.Handle(keysPath, h.authenticated(h.handleKey))
+	if webhookSecret != "" {
+		h.mux.HandleFunc(webhookPath, h.handleWebhook)
+	}
+	return h, nil
+}
+
+// HandleCircuits serves the state of the upstream circuit breakers returned by status
+func (h *Handler) HandleCircuits(status func() []upstream.BreakerStatus) {
+	h.mux.Handle(circuitPath, h.authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errMethodNotAllow)
+			return
+		}
+		circuits := status()
+		if circuits == nil {
+			circuits = []upstream.BreakerStatus{}
+		}
+		writeJSON(w, http.StatusOK, circuits)
+	}))
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authenticated(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			h.log.Sugar().Warnw("rejected unauthenticated admin request", "path", r.URL.Path, "remote", r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized, response{Error: "unauthorized"})
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (h *Handler) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllow)
+		return
+	}
+	h.sync(w)
+}
+
+func (h *Handler) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllow)
+		return
+	}
+	var req RefreshRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	h.refresh(w, req.AccessKeys)
+}
+
+func (h *Handler) handleKey(w http.ResponseWriter, r *http.Request) {
+	accessKey := strings.TrimPrefix(r.URL.Path, keysPath)
+	if accessKey == "" || strings.Contains(accessKey, "/") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("invalid access key path %s", r.URL.Path))
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var req PutKeyRequest
+		if err := decodeBody(w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.SecretKey == "" {
+			writeError(w, http.StatusBadRequest, errMissingSecret)
+			return
+		}
+		if err := h.cache.Put(accessKey, internal.Credential{SecretKey: req.SecretKey, Source: AdminCredentialSource, User: req.User}); err != nil {
+			writeError(w, http.StatusInsufficientStorage, err)
+			return
+		}
+		h.log.Sugar().Infof("added access key %s through admin api", accessKey)
+		writeJSON(w, http.StatusOK, response{Status: "added"})
+	case http.MethodDelete:
+		h.evict(w, []string{accessKey})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllow)
+	}
+}
+
+func (h *Handler) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errMethodNotAllow)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	timestamp, signature := r.Header.Get(timestampHeader), r.Header.Get(signatureHeader)
+	if !validSignature(h.webhookSecret, timestamp, body, signature) {
+		h.log.Sugar().Warnw("rejected webhook with invalid signature", "remote", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, errBadSignature)
+		return
+	}
+	if !h.fresh(timestamp, signature) {
+		h.log.Sugar().Warnw("rejected stale or replayed webhook", "remote", r.RemoteAddr, "timestamp", timestamp)
+		writeError(w, http.StatusUnauthorized, errStaleWebhook)
+		return
+	}
+	var event WebhookEvent
+	if err = json.Unmarshal(body, &event); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch event.Type {
+	case EventKeyCreated, EventKeyRotated:
+		h.refresh(w, event.AccessKeys)
+	case EventKeyRevoked, EventKeyDeleted:
+		h.evict(w, event.AccessKeys)
+	case EventCacheSync:
+		h.sync(w)
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %s", errUnknownEvent, event.Type))
+	}
+}
+
+func (h *Handler) sync(w http.ResponseWriter) {
+	if err := h.cache.Load(); err != nil {
+		h.log.Sugar().Errorf("admin triggered sync failed: %s", err.Error())
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	h.log.Info("admin triggered sync finished")
+	writeJSON(w, http.StatusOK, response{Status: "synced"})
+}
+
+func (h *Handler) refresh(w http.ResponseWriter, accessKeys []string) {
+	if len(accessKeys) == 0 {
+		writeError(w, http.StatusBadRequest, errNoAccessKeys)
+		return
+	}
+	if err := h.cache.Refresh(accessKeys...); err != nil {
+		h.log.Sugar().Errorf("admin triggered refresh failed: %s", err.Error())
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	h.log.Sugar().Infof("refreshed access keys %v through admin api", accessKeys)
+	writeJSON(w, http.StatusOK, response{Status: "refreshed"})
+}
+
+func (h *Handler) evict(w http.ResponseWriter, accessKeys []string) {
+	if len(accessKeys) == 0 {
+		writeError(w, http.StatusBadRequest, errNoAccessKeys)
+		return
+	}
+	for _, k := range accessKeys {
+		h.cache.Evict(k)
+	}
+	h.log.Sugar().Infof("evicted access keys %v through admin api", accessKeys)
+	writeJSON(w, http.StatusOK, response{Status: "evicted"})
+}
+
+// fresh reports whether a webhook signed at timestamp, in unix seconds, is recent and its signature wasn't accepted
+// before, so a captured webhook can't be sent again
+func (h *Handler) fresh(timestamp, signature string) bool {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	signed, now := time.Unix(seconds, 0), h.now()
+	if now.Sub(signed) > maxWebhookAge || signed.Sub(now) > maxWebhookAge {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s, expires := range h.seen {
+		if now.After(expires) {
+			delete(h.seen, s)
+		}
+	}
+	if _, ok := h.seen[signature]; ok {
+		return false
+	}
+	h.seen[signature] = signed.Add(maxWebhookAge)
+	return true
+}
+
+// Sign returns the signature header value the webhook receiver expects for body sent with the timestamp header,
+// the HMAC covers the timestamp, a dot and the body
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(timestamp + "."))
+	_, _ = mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func validSignature(secret, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, response{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
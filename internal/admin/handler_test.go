@@ -0,0 +1,145 @@
+package admin
+
+import (
+	"errors"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/mocks"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/upstream"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mCache := mocks.NewMockAuthCache(ctrl)
+
+	_, err := NewHandler(log, mCache, "", "")
+	assert.ErrorIs(t, err, errMissingToken)
+
+	h, _ := NewHandler(log, mCache, "secret", "")
+	assert.Equal(t, http.StatusUnauthorized, serve(h, http.MethodPost, syncPath, "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(h, http.MethodPost, syncPath, "wrong", "").Code)
+	// The token alone, without the bearer scheme, is refused
+	req := httptest.NewRequest(http.MethodPost, syncPath, nil)
+	req.Header.Set("Authorization", "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	// Webhook is not served without a secret
+	assert.Equal(t, http.StatusNotFound, serve(h, http.MethodPost, webhookPath, "", "{}").Code)
+}
+
+func TestAdminKeyOperations(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mCache := mocks.NewMockAuthCache(ctrl)
+	mCache.EXPECT().Load().Return(nil)
+	mCache.EXPECT().Refresh("abc", "def").Return(nil)
+	mCache.EXPECT().Put("abc", internal.Credential{SecretKey: "xyz", Source: AdminCredentialSource}).Return(nil)
+	mCache.EXPECT().Put("def", internal.Credential{SecretKey: "uvw", Source: AdminCredentialSource, User: "alice"}).Return(nil)
+	mCache.EXPECT().Evict("abc")
+	h, _ := NewHandler(log, mCache, "secret", "")
+
+	assert.Equal(t, http.StatusOK, serve(h, http.MethodPost, syncPath, "secret", "").Code)
+	assert.Equal(t, http.StatusOK, serve(h, http.MethodPost, refreshPath, "secret", `{"access_keys":["abc","def"]}`).Code)
+	assert.Equal(t, http.StatusOK, serve(h, http.MethodPut, keysPath+"abc", "secret", `{"secret_key":"xyz"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(h, http.MethodPut, keysPath+"def", "secret", `{"secret_key":"uvw","user":"alice"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(h, http.MethodDelete, keysPath+"abc", "secret", "").Code)
+
+	assert.Equal(t, http.StatusBadRequest, serve(h, http.MethodPut, keysPath+"abc", "secret", `{}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(h, http.MethodPost, refreshPath, "secret", `{"access_keys":[]}`).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(h, http.MethodGet, syncPath, "secret", "").Code)
+}
+
+func TestAdminSyncFailure(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mCache := mocks.NewMockAuthCache(ctrl)
+	mCache.EXPECT().Load().Return(errors.New("rgw down"))
+	h, _ := NewHandler(log, mCache, "secret", "")
+
+	rec := serve(h, http.MethodPost, syncPath, "secret", "")
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Contains(t, rec.Body.String(), "rgw down")
+}
+
+func TestAdminCircuits(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mCache := mocks.NewMockAuthCache(ctrl)
+	h, _ := NewHandler(log, mCache, "secret", "")
+	assert.Equal(t, http.StatusNotFound, serve(h, http.MethodGet, circuitPath, "secret", "").Code)
+
+	since := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	h.HandleCircuits(func() []upstream.BreakerStatus {
+		return []upstream.BreakerStatus{{Upstream: "lga1", State: upstream.BreakerOpen, Since: since, Requests: 40, Failures: 30}}
+	})
+	assert.Equal(t, http.StatusUnauthorized, serve(h, http.MethodGet, circuitPath, "", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(h, http.MethodPost, circuitPath, "secret", "").Code)
+	rec := serve(h, http.MethodGet, circuitPath, "secret", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"upstream":"lga1","state":"open","since":"2021-03-01T12:00:00Z","requests":40,"failures":30}]`, rec.Body.String())
+}
+
+func TestAdminWebhook(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mCache := mocks.NewMockAuthCache(ctrl)
+	mCache.EXPECT().Evict("leaked").Times(2)
+	mCache.EXPECT().Refresh("rotated").Return(nil)
+	h, _ := NewHandler(log, mCache, "secret", "hook")
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+
+	post := func(body, timestamp, signature string) int {
+		req := httptest.NewRequest(http.MethodPost, webhookPath, strings.NewReader(body))
+		req.Header.Set(timestampHeader, timestamp)
+		req.Header.Set(signatureHeader, signature)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	at := func(offset time.Duration) string {
+		return strconv.FormatInt(now.Add(offset).Unix(), 10)
+	}
+
+	revoked := `{"type":"key.revoked","access_keys":["leaked"]}`
+	assert.Equal(t, http.StatusOK, post(revoked, at(0), Sign("hook", at(0), []byte(revoked))))
+	rotated := `{"type":"key.rotated","access_keys":["rotated"]}`
+	assert.Equal(t, http.StatusOK, post(rotated, at(-time.Minute), Sign("hook", at(-time.Minute), []byte(rotated))))
+
+	assert.Equal(t, http.StatusUnauthorized, post(revoked, at(time.Second), Sign("other", at(time.Second), []byte(revoked))))
+	unknown := `{"type":"key.unknown"}`
+	assert.Equal(t, http.StatusBadRequest, post(unknown, at(0), Sign("hook", at(0), []byte(unknown))))
+
+	// The timestamp is signed, a captured webhook can't be sent again nor moved to another time
+	assert.Equal(t, http.StatusUnauthorized, post(revoked, at(0), Sign("hook", at(0), []byte(revoked))))
+	assert.Equal(t, http.StatusUnauthorized, post(revoked, at(time.Second), Sign("hook", at(0), []byte(revoked))))
+	assert.Equal(t, http.StatusUnauthorized, post(revoked, "", Sign("hook", "", []byte(revoked))))
+	assert.Equal(t, http.StatusUnauthorized, post(revoked, at(-10*time.Minute), Sign("hook", at(-10*time.Minute), []byte(revoked))))
+	assert.Equal(t, http.StatusUnauthorized, post(revoked, at(10*time.Minute), Sign("hook", at(10*time.Minute), []byte(revoked))))
+
+	// Signatures are forgotten once their timestamp is too old to be accepted anyway
+	now = now.Add(maxWebhookAge + time.Second)
+	assert.Equal(t, http.StatusUnauthorized, post(revoked, at(-maxWebhookAge-time.Second), Sign("hook", at(-maxWebhookAge-time.Second), []byte(revoked))))
+	assert.Equal(t, http.StatusOK, post(revoked, at(0), Sign("hook", at(0), []byte(revoked))))
+	assert.Len(t, h.seen, 1)
+}
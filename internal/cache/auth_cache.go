@@ -4,39 +4,76 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/VictoriaMetrics/fastcache"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/coreweave/aws-s3-reverse-proxy/internal"
+	gocache "github.com/patrickmn/go-cache"
 	"go.uber.org/zap"
+	"sync"
 	"time"
 )
 
 var (
 	errNoAccessKeyInCache = errors.New("no accessKeyId found in cache")
+	errInvalidCacheConfig = errors.New("invalid auth cache configuration")
+	errCacheFull          = errors.New("auth cache is full")
+	errNoClusterForKey    = errors.New("accessKeyId is not owned by a known cluster")
+	errNoUserForKey       = errors.New("accessKeyId has no known owning user")
 )
 
+// Config controls the sizing and expiry of the AuthCache key store
+type Config struct {
+	// Expire is how long a key stays valid after it was last seen in a load, zero disables expiry
+	Expire time.Duration
+
+	// Evict is how often expired keys are purged from memory, zero disables purging
+	Evict time.Duration
+
+	// MaxKeys bounds the number of keys held in the store, zero means unbounded
+	MaxKeys int
+}
+
+func (c Config) validate() error {
+	if c.Expire < 0 || c.Evict < 0 || c.MaxKeys < 0 {
+		return fmt.Errorf("%w: expire, evict and max keys must not be negative", errInvalidCacheConfig)
+	}
+	return nil
+}
+
 type AuthCache struct {
 	rgwAdmin  internal.AdminClient
-	userCache *fastcache.Cache
+	userCache *gocache.Cache
+	maxKeys   int
 	log       *zap.Logger
+
+	// mu makes the capacity check and the write of a key one step, so concurrent writes can't overfill the store
+	mu sync.Mutex
 }
 
-func NewAuthCache(rgwAdmin internal.AdminClient, log *zap.Logger) *AuthCache {
-	fc := fastcache.New(4000000000) //4GB
+func NewAuthCache(rgwAdmin internal.AdminClient, log *zap.Logger, config Config) (*AuthCache, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	expire, evict := config.Expire, config.Evict
+	if expire == 0 {
+		// nothing ever expires so there is nothing for the janitor to purge
+		expire, evict = gocache.NoExpiration, 0
+	}
 	return &AuthCache{
 		rgwAdmin:  rgwAdmin,
-		userCache: fc,
+		userCache: gocache.New(expire, evict),
+		maxKeys:   config.MaxKeys,
 		log:       log,
-	}
+	}, nil
 }
 
 func (a *AuthCache) RunSync(interval time.Duration, ctx context.Context) {
 	go func(a *AuthCache, ctx context.Context) {
-		t := time.Tick(interval)
+		t := time.NewTicker(interval)
+		defer t.Stop()
 		for {
 			select {
-			case <-t:
+			case <-t.C:
 				a.log.Sugar().Infof("Starting rgw cache sync at %d", time.Now().UnixMilli())
 				if err := a.Load(); err != nil {
 					a.log.Error("unable to load user creds")
@@ -50,23 +87,120 @@ func (a *AuthCache) RunSync(interval time.Duration, ctx context.Context) {
 }
 
 func (a *AuthCache) GetRequestSigner(accessKeyId string) (*v4.Signer, error) {
-	if secretKey := a.userCache.Get(nil, []byte(accessKeyId)); secretKey != nil {
-		return v4.NewSigner(credentials.NewStaticCredentialsFromCreds(credentials.Value{
-			AccessKeyID:     accessKeyId,
-			SecretAccessKey: string(secretKey),
-		})), nil
+	cred, err := a.GetCredential(accessKeyId)
+	if err != nil {
+		return nil, err
+	}
+	return v4.NewSigner(credentials.NewStaticCredentialsFromCreds(credentials.Value{
+		AccessKeyID:     accessKeyId,
+		SecretAccessKey: cred.SecretKey,
+	})), nil
+}
+
+// GetCredential returns the cached credential for an access key, including the source it was loaded from
+func (a *AuthCache) GetCredential(accessKeyId string) (internal.Credential, error) {
+	if cred, ok := a.userCache.Get(accessKeyId); ok {
+		return cred.(internal.Credential), nil
+	}
+	return internal.Credential{}, errNoAccessKeyInCache
+}
+
+// GetCluster returns the rgw cluster owning an access key
+func (a *AuthCache) GetCluster(accessKeyId string) (string, error) {
+	cred, err := a.GetCredential(accessKeyId)
+	if err != nil {
+		return "", err
+	}
+	if cred.Cluster == "" {
+		return "", errNoClusterForKey
+	}
+	return cred.Cluster, nil
+}
+
+// GetUser returns the identity owning an access key
+func (a *AuthCache) GetUser(accessKeyId string) (string, error) {
+	cred, err := a.GetCredential(accessKeyId)
+	if err != nil {
+		return "", err
 	}
-	return nil, errNoAccessKeyInCache
+	if cred.User == "" {
+		return "", errNoUserForKey
+	}
+	return cred.User, nil
+}
+
+// Len returns the number of keys currently held, including expired keys not yet evicted
+func (a *AuthCache) Len() int {
+	return a.userCache.ItemCount()
 }
 
 func (a *AuthCache) Load() (err error) {
-	var vals map[string]string
+	var vals map[string]internal.Credential
 	if vals, err = a.rgwAdmin.LoadUserCredentials(); err == nil {
-		a.log.Debug(fmt.Sprintf("loading %d keys from rgw..", len(vals)))
+		a.log.Debug(fmt.Sprintf("loading %d keys from credential sources..", len(vals)))
+		dropped := 0
 		for k, v := range vals {
-			a.userCache.Set([]byte(k), []byte(v))
+			if !a.set(k, v, gocache.DefaultExpiration) {
+				dropped++
+			}
+		}
+		if dropped > 0 {
+			a.log.Sugar().Warnf("auth cache is full at %d keys, dropped %d new keys", a.maxKeys, dropped)
 		}
 		return nil
 	}
 	return err
 }
+
+// Put adds or replaces a single key. It is kept until it is evicted, no source has to hold it, unless a later load
+// finds it in a source, which then refreshes it like any other key.
+func (a *AuthCache) Put(accessKeyId string, cred internal.Credential) error {
+	if !a.set(accessKeyId, cred, gocache.NoExpiration) {
+		return errCacheFull
+	}
+	return nil
+}
+
+// Evict removes a key immediately, it returns on the next sync if its source still holds it
+func (a *AuthCache) Evict(accessKeyId string) {
+	a.userCache.Delete(accessKeyId)
+}
+
+// Refresh reloads the given keys from the admin client, keys no longer known to it are evicted. Sources can only be
+// read as a whole, so a refresh costs as much as a full load: batch keys into one call rather than refreshing them
+// one by one.
+func (a *AuthCache) Refresh(accessKeyIds ...string) error {
+	vals, err := a.rgwAdmin.LoadUserCredentials()
+	if err != nil {
+		return err
+	}
+	for _, k := range accessKeyIds {
+		cred, ok := vals[k]
+		if !ok {
+			a.log.Sugar().Infof("evicting access key %s no longer held by any credential source", k)
+			a.Evict(k)
+			continue
+		}
+		if !a.set(k, cred, gocache.DefaultExpiration) {
+			return errCacheFull
+		}
+	}
+	return nil
+}
+
+// set stores or refreshes a key to expire after expiration, new keys are refused once the store holds maxKeys
+func (a *AuthCache) set(accessKeyId string, cred internal.Credential, expiration time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxKeys > 0 && a.userCache.ItemCount() >= a.maxKeys {
+		if _, ok := a.userCache.Get(accessKeyId); !ok {
+			// Expired keys are counted until the janitor purges them, they must not keep out a new key
+			a.userCache.DeleteExpired()
+			if a.userCache.ItemCount() >= a.maxKeys {
+				return false
+			}
+		}
+	}
+	a.userCache.Set(accessKeyId, cred, expiration)
+	return true
+}
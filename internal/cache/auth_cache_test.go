@@ -4,25 +4,29 @@ import (
 	"errors"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal"
 	"github.com/coreweave/aws-s3-reverse-proxy/internal/mocks"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestAuthCacheLoad(t *testing.T) {
 	// Test Values
-	rgwValues := map[string]string{
-		"xyz": "abc",
-		"abc": "xyz",
+	rgwValues := map[string]internal.Credential{
+		"xyz": {SecretKey: "abc", Source: "rgw"},
+		"abc": {SecretKey: "xyz", Source: "rgw"},
 	}
 	log, _ := zap.NewDevelopment()
 	ctrl := gomock.NewController(t)
 	mClient := mocks.NewMockAdminClient(ctrl)
 	mClient.EXPECT().LoadUserCredentials().Times(1).Return(rgwValues, nil)
 
-	ch := NewAuthCache(mClient, log)
+	ch, _ := NewAuthCache(mClient, log, Config{})
 
 	err := ch.Load()
 	assert.NoError(t, err)
@@ -35,7 +39,7 @@ func TestAuthCacheLoadError(t *testing.T) {
 	mClient := mocks.NewMockAdminClient(ctrl)
 	mClient.EXPECT().LoadUserCredentials().Times(1).Return(nil, expectedError)
 
-	ch := NewAuthCache(mClient, log)
+	ch, _ := NewAuthCache(mClient, log, Config{})
 
 	err := ch.Load()
 	assert.EqualError(t, expectedError, err.Error())
@@ -43,9 +47,9 @@ func TestAuthCacheLoadError(t *testing.T) {
 
 func TestAuthCacheGetCredential(t *testing.T) {
 	// Setup Values
-	rgwValues := map[string]string{
-		"xyz": "abc",
-		"abc": "xyz",
+	rgwValues := map[string]internal.Credential{
+		"xyz": {SecretKey: "abc", Source: "rgw"},
+		"abc": {SecretKey: "xyz", Source: "rgw"},
 	}
 	expectedSigners := map[string]*v4.Signer{
 		"abc": v4.NewSigner(credentials.NewStaticCredentialsFromCreds(credentials.Value{
@@ -57,7 +61,7 @@ func TestAuthCacheGetCredential(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mClient := mocks.NewMockAdminClient(ctrl)
 	mClient.EXPECT().LoadUserCredentials().Times(1).Return(rgwValues, nil)
-	ch := NewAuthCache(mClient, log)
+	ch, _ := NewAuthCache(mClient, log, Config{})
 	_ = ch.Load()
 
 	// Test
@@ -66,6 +70,9 @@ func TestAuthCacheGetCredential(t *testing.T) {
 	// Assert
 	assert.NoError(t, err)
 	assert.Equal(t, expectedSigners["abc"], output)
+	cred, err := ch.GetCredential("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "rgw", cred.Source)
 
 	// Test Invalid
 	badOutput, realError := ch.GetRequestSigner("bad")
@@ -74,3 +81,177 @@ func TestAuthCacheGetCredential(t *testing.T) {
 	assert.EqualError(t, errNoAccessKeyInCache, realError.Error())
 	assert.Empty(t, badOutput)
 }
+
+func TestAuthCacheExpire(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mClient := mocks.NewMockAdminClient(ctrl)
+	mClient.EXPECT().LoadUserCredentials().Times(1).Return(map[string]internal.Credential{"abc": {SecretKey: "xyz"}}, nil)
+	ch, err := NewAuthCache(mClient, log, Config{Expire: 50 * time.Millisecond, Evict: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	_ = ch.Load()
+
+	_, err = ch.GetRequestSigner("abc")
+	assert.NoError(t, err)
+
+	// Key was not refreshed by another load so it expires and is purged
+	time.Sleep(100 * time.Millisecond)
+	_, err = ch.GetRequestSigner("abc")
+	assert.EqualError(t, err, errNoAccessKeyInCache.Error())
+	assert.Equal(t, 0, ch.Len())
+}
+
+func TestAuthCacheMaxKeys(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mClient := mocks.NewMockAdminClient(ctrl)
+	gomock.InOrder(
+		mClient.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{"abc": {SecretKey: "xyz"}, "def": {SecretKey: "uvw"}}, nil),
+		mClient.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{"abc": {SecretKey: "new"}, "def": {SecretKey: "uvw"}, "ghi": {SecretKey: "rst"}}, nil),
+	)
+	ch, _ := NewAuthCache(mClient, log, Config{MaxKeys: 2})
+
+	assert.NoError(t, ch.Load())
+	assert.NoError(t, ch.Load())
+	assert.Equal(t, 2, ch.Len())
+
+	// Existing keys are refreshed once full, new keys are refused
+	signer, err := ch.GetRequestSigner("abc")
+	assert.NoError(t, err)
+	creds, _ := signer.Credentials.Get()
+	assert.Equal(t, "new", creds.SecretAccessKey)
+	_, err = ch.GetRequestSigner("ghi")
+	assert.Error(t, err)
+}
+
+func TestAuthCacheMaxKeysDropsExpired(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mClient := mocks.NewMockAdminClient(ctrl)
+	mClient.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{"abc": {SecretKey: "xyz"}}, nil)
+	// Without an evict interval expired keys stay in memory until something purges them
+	ch, _ := NewAuthCache(mClient, log, Config{Expire: 20 * time.Millisecond, MaxKeys: 1})
+	assert.NoError(t, ch.Load())
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, ch.Put("def", internal.Credential{SecretKey: "uvw"}))
+	assert.Equal(t, 1, ch.Len())
+}
+
+func TestAuthCacheMaxKeysConcurrentWrites(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	ch, _ := NewAuthCache(mocks.NewMockAdminClient(ctrl), log, Config{MaxKeys: 10})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = ch.Put(strconv.Itoa(i), internal.Credential{SecretKey: "xyz"})
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 10, ch.Len())
+}
+
+func TestAuthCacheInvalidConfig(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mClient := mocks.NewMockAdminClient(ctrl)
+
+	_, err := NewAuthCache(mClient, log, Config{Expire: -time.Minute})
+	assert.ErrorIs(t, err, errInvalidCacheConfig)
+}
+
+func TestAuthCachePushUpdates(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mClient := mocks.NewMockAdminClient(ctrl)
+	gomock.InOrder(
+		mClient.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{"abc": {SecretKey: "xyz"}, "def": {SecretKey: "uvw"}}, nil),
+		mClient.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{"abc": {SecretKey: "rotated"}}, nil),
+	)
+	ch, _ := NewAuthCache(mClient, log, Config{MaxKeys: 3})
+	_ = ch.Load()
+
+	// Refresh picks up the rotated secret and evicts the deleted key
+	assert.NoError(t, ch.Refresh("abc", "def"))
+	cred, _ := ch.GetCredential("abc")
+	assert.Equal(t, "rotated", cred.SecretKey)
+	_, err := ch.GetCredential("def")
+	assert.Error(t, err)
+
+	assert.NoError(t, ch.Put("ghi", internal.Credential{SecretKey: "rst", Source: "admin"}))
+	assert.NoError(t, ch.Put("jkl", internal.Credential{SecretKey: "opq", Source: "admin"}))
+	assert.ErrorIs(t, ch.Put("mno", internal.Credential{SecretKey: "lmn"}), errCacheFull)
+
+	ch.Evict("ghi")
+	_, err = ch.GetRequestSigner("ghi")
+	assert.Error(t, err)
+}
+
+func TestAuthCacheGetCluster(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mClient := mocks.NewMockAdminClient(ctrl)
+	mClient.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{
+		"abc": {SecretKey: "xyz", Source: "rgw", Cluster: "lga1"},
+		"def": {SecretKey: "uvw", Source: "static"},
+	}, nil)
+	ch, _ := NewAuthCache(mClient, log, Config{})
+	_ = ch.Load()
+
+	cluster, err := ch.GetCluster("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "lga1", cluster)
+
+	_, err = ch.GetCluster("def")
+	assert.ErrorIs(t, err, errNoClusterForKey)
+	_, err = ch.GetCluster("missing")
+	assert.ErrorIs(t, err, errNoAccessKeyInCache)
+}
+
+func TestAuthCacheGetUser(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mClient := mocks.NewMockAdminClient(ctrl)
+	mClient.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{
+		"abc": {SecretKey: "xyz", Source: "rgw", User: "alice"},
+		"def": {SecretKey: "uvw", Source: "static"},
+	}, nil)
+	ch, _ := NewAuthCache(mClient, log, Config{})
+	_ = ch.Load()
+
+	user, err := ch.GetUser("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", user)
+
+	_, err = ch.GetUser("def")
+	assert.ErrorIs(t, err, errNoUserForKey)
+	_, err = ch.GetUser("missing")
+	assert.ErrorIs(t, err, errNoAccessKeyInCache)
+}
+
+func TestAuthCachePutOutlivesExpiry(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mClient := mocks.NewMockAdminClient(ctrl)
+	mClient.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{"abc": {SecretKey: "xyz"}}, nil)
+	ch, err := NewAuthCache(mClient, log, Config{Expire: 50 * time.Millisecond, Evict: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	assert.NoError(t, ch.Put("def", internal.Credential{SecretKey: "uvw", Source: "admin"}))
+	_ = ch.Load()
+
+	// Loaded keys expire once no load sees them, a pushed key stays until it is evicted
+	time.Sleep(100 * time.Millisecond)
+	_, err = ch.GetCredential("abc")
+	assert.Error(t, err)
+	cred, err := ch.GetCredential("def")
+	assert.NoError(t, err)
+	assert.Equal(t, "uvw", cred.SecretKey)
+
+	ch.Evict("def")
+	_, err = ch.GetCredential("def")
+	assert.Error(t, err)
+}
@@ -1,11 +1,17 @@
 package cfg
 
-import "gopkg.in/alecthomas/kingpin.v2"
+import (
+	"gopkg.in/alecthomas/kingpin.v2"
+	"time"
+)
 
 var (
 	RgwAdminEndpointEnvVar = "RGW_ENDPOINT"
 	RgwAdminSecretEnvVar   = "RGW_SECRET_KEY"
 	RgwAdminAccessEnvVar   = "RGW_ACCESS_KEY"
+	VaultTokenEnvVar       = "VAULT_TOKEN"
+	AdminTokenEnvVar       = "ADMIN_TOKEN"
+	AdminWebhookEnvVar     = "ADMIN_WEBHOOK_SECRET"
 )
 
 // Options for aws-s3-reverse-proxy command line arguments
@@ -18,34 +24,131 @@ type Options struct {
 	AwsCredentials      []string
 	Region              string
 	UpstreamInsecure    bool
+	UpstreamScheme      string
+	UpstreamCAFile      string
+	UpstreamCertFile    string
+	UpstreamKeyFile     string
+
+	UpstreamDialTimeout         time.Duration
+	UpstreamTLSHandshakeTimeout time.Duration
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamIdleConnTimeout     time.Duration
+	UpstreamDisableHTTP2        bool
+	ProxyIdleTimeout            time.Duration
+	MirrorTimeout               time.Duration
+	MirrorMaxInFlight           int
+	ReplicationQueueDir         string
+	ReplicationTimeout          time.Duration
+	ReplicationMaxBackoff       time.Duration
+	MigrationMaxCopies          int
+	RoutingConfigPollInterval   time.Duration
+	ProxyProtocolTrustedSenders []string
+	ProxyProtocolRequired       bool
+	TrustedProxies              []string
+	TrustedProxyHeader          string
+
 	UpstreamEndpoint    string
 	UpstreamMatchers    []string
+	ClusterUpstreams    []string
+	RoutingConfig       string
 	CertFile            string
 	KeyFile             string
 	DisableSSL          bool
 	ExpireCacheMinutes  int
 	EvictCacheMinutes   int
+	SyncCacheMinutes    int
+	CacheMaxKeys        int
 	RgwAdminEndpoints   string
 	RgwAdminAccessKeys  string
 	RgwAdminSecretKeys  string
+	RgwAdminClusters    string
+	RgwAdminCAFile      string
+	RgwAdminCertFile    string
+	RgwAdminKeyFile     string
+	RgwAdminInsecure    bool
+	RgwAdminTimeout     time.Duration
+	RgwAdminProxy       string
+	VaultAddr           string
+	VaultToken          string
+	VaultPath           string
+	CredentialOrder     []string
+	AdminListenAddr     string
+	AdminToken          string
+	AdminWebhookSecret  string
+	AdminCertFile       string
+	AdminKeyFile        string
+	RetryAttempts       int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	RetryMaxBufferBytes int64
+	RetryBudgetRatio    float64
+	RetryBudgetBurst    int
 }
 
 // NewOptions defines and parses the raw command line arguments
 func NewOptions() Options {
 	var opts Options
 	kingpin.Flag("debug", "enable debug logging").Default("false").Envar("DEBUG").BoolVar(&opts.Debug)
-	kingpin.Flag("insecure", "enable insecure upstream").Default("false").Envar("INSECURE").BoolVar(&opts.UpstreamInsecure)
+	kingpin.Flag("insecure", "skip certificate verification of every upstream").Default("false").Envar("INSECURE").BoolVar(&opts.UpstreamInsecure)
 	kingpin.Flag("enable-pprof", "enable pprof profiling").Default("false").BoolVar(&opts.EnablePprof)
-	kingpin.Flag("allowed-source-subnet", "allowed source IP addresses with netmask (env - ALLOWED_SOURCE_SUBNET)").Default("127.0.0.1/32").Envar("ALLOWED_SOURCE_SUBNET").StringsVar(&opts.AllowedSourceSubnet)
+	kingpin.Flag("allowed-source-subnet", "allowed source IP addresses with netmask, every source is allowed when unset (env - ALLOWED_SOURCE_SUBNET)").Envar("ALLOWED_SOURCE_SUBNET").StringsVar(&opts.AllowedSourceSubnet)
 	kingpin.Flag("upstream-endpoint", "use this S3 endpoint for upstream connections, instead of public AWS S3 (env - UPSTREAM_ENDPOINT)").Envar("UPSTREAM_ENDPOINT").StringVar(&opts.UpstreamEndpoint)
-	kingpin.Flag("upstream-matchers", "matcher values").Default("object").StringsVar(&opts.UpstreamMatchers)
+	kingpin.Flag("upstream-scheme", "scheme used to reach the upstream independent of the listener, http or https, unset follows the listener (env - UPSTREAM_SCHEME)").Envar("UPSTREAM_SCHEME").StringVar(&opts.UpstreamScheme)
+	kingpin.Flag("upstream-ca-file", "path to a PEM ca bundle trusted for the upstream").Default("").Envar("UPSTREAM_CA_FILE").StringVar(&opts.UpstreamCAFile)
+	kingpin.Flag("upstream-cert-file", "path to a PEM client certificate for the upstream").Default("").Envar("UPSTREAM_CERT_FILE").StringVar(&opts.UpstreamCertFile)
+	kingpin.Flag("upstream-key-file", "path to the PEM key of the upstream client certificate").Default("").Envar("UPSTREAM_KEY_FILE").StringVar(&opts.UpstreamKeyFile)
+	kingpin.Flag("upstream-dial-timeout", "timeout for connecting to an upstream").Default("10s").DurationVar(&opts.UpstreamDialTimeout)
+	kingpin.Flag("upstream-tls-handshake-timeout", "timeout for the tls handshake with an upstream").Default("10s").DurationVar(&opts.UpstreamTLSHandshakeTimeout)
+	kingpin.Flag("upstream-max-idle-conns-per-host", "idle connections kept open to each upstream gateway").Default("100").IntVar(&opts.UpstreamMaxIdleConnsPerHost)
+	kingpin.Flag("upstream-idle-conn-timeout", "time an idle upstream connection is kept open").Default("90s").DurationVar(&opts.UpstreamIdleConnTimeout)
+	kingpin.Flag("upstream-disable-http2", "talk HTTP/1.1 to upstreams even when they offer HTTP/2").Default("false").BoolVar(&opts.UpstreamDisableHTTP2)
+	kingpin.Flag("proxy-idle-timeout", "time after which the reverse proxy of an unused upstream host is dropped, 0 keeps them forever").Default("10m").DurationVar(&opts.ProxyIdleTimeout)
+	kingpin.Flag("mirror-timeout", "time after which a mirrored request to a shadow upstream is cancelled").Default("30s").DurationVar(&opts.MirrorTimeout)
+	kingpin.Flag("mirror-max-in-flight", "mirrored requests in flight at once, further matching requests are not mirrored").Default("100").IntVar(&opts.MirrorMaxInFlight)
+	kingpin.Flag("replication-queue-dir", "directory holding the durable queue of async replicas (env - REPLICATION_QUEUE_DIR)").Envar("REPLICATION_QUEUE_DIR").Default("").StringVar(&opts.ReplicationQueueDir)
+	kingpin.Flag("replication-timeout", "time after which copying a single object to a replica is cancelled").Default("15m").DurationVar(&opts.ReplicationTimeout)
+	kingpin.Flag("replication-max-backoff", "maximum backoff between attempts of a queued replica").Default("1m").DurationVar(&opts.ReplicationMaxBackoff)
+	kingpin.Flag("migration-max-copies", "objects copied forward from migration upstreams at once, further reads are not copied").Default("16").IntVar(&opts.MigrationMaxCopies)
+	kingpin.Flag("upstream-matchers", "host matchers formatted as MATCH_PATTERN:REPLACE_PATTERN:REPLACE_WITH:LEVELS_DEEP or as a template such as '{bucket}.object.{region}.example.com -> {bucket}.s3.{region}.internal'").StringsVar(&opts.UpstreamMatchers)
+	kingpin.Flag("routing-config", "path to a yaml routing config, replaces upstream-endpoint, upstream-matchers and cluster-upstream (env - ROUTING_CONFIG)").Envar("ROUTING_CONFIG").Default("").StringVar(&opts.RoutingConfig)
+	kingpin.Flag("routing-config-poll-interval", "time between checks of the routing config file for changes, 0 only reloads on SIGHUP").Default("10s").DurationVar(&opts.RoutingConfigPollInterval)
+	kingpin.Flag("proxy-protocol-trusted-sender", "subnet of load balancers sending a PROXY protocol v1 or v2 header, enables the PROXY protocol on the http and https listeners (env - PROXY_PROTOCOL_TRUSTED_SENDERS)").Envar("PROXY_PROTOCOL_TRUSTED_SENDERS").StringsVar(&opts.ProxyProtocolTrustedSenders)
+	kingpin.Flag("proxy-protocol-required", "close connections from trusted senders that don't start with a PROXY protocol header (env - PROXY_PROTOCOL_REQUIRED)").Default("false").Envar("PROXY_PROTOCOL_REQUIRED").BoolVar(&opts.ProxyProtocolRequired)
+	kingpin.Flag("trusted-proxy", "subnet of http proxies whose forwarding header names the client address (env - TRUSTED_PROXIES)").Envar("TRUSTED_PROXIES").StringsVar(&opts.TrustedProxies)
+	kingpin.Flag("trusted-proxy-header", "forwarding header the trusted proxies maintain, x-forwarded-for or forwarded, the other one is never read (env - TRUSTED_PROXY_HEADER)").Default("x-forwarded-for").Envar("TRUSTED_PROXY_HEADER").EnumVar(&opts.TrustedProxyHeader, "x-forwarded-for", "forwarded")
+	kingpin.Flag("cluster-upstream", "upstream host for keys owned by an rgw cluster, formatted as CLUSTER=HOST").StringsVar(&opts.ClusterUpstreams)
 	kingpin.Flag("cert-file", "path to the certificate file (env - CERT_FILE)").Envar("CERT_FILE").Default("").StringVar(&opts.CertFile)
 	kingpin.Flag("key-file", "path to the private key file (env - KEY_FILE)").Envar("KEY_FILE").Default("").StringVar(&opts.KeyFile)
-	kingpin.Flag("cache-expire", "time in minutes to expire the cache").Default("5").IntVar(&opts.ExpireCacheMinutes)
-	kingpin.Flag("cache-evict", "time in minutes to evict the cache").Default("10").IntVar(&opts.EvictCacheMinutes)
+	kingpin.Flag("cache-expire", "time in minutes a key stays valid after it was last synced, 0 disables expiry").Default("15").IntVar(&opts.ExpireCacheMinutes)
+	kingpin.Flag("cache-evict", "time in minutes between purges of expired keys from the cache").Default("10").IntVar(&opts.EvictCacheMinutes)
+	kingpin.Flag("cache-sync", "time in minutes between syncs of the cache with rgw").Default("5").IntVar(&opts.SyncCacheMinutes)
+	kingpin.Flag("cache-max-keys", "maximum number of keys held in the cache, 0 for unbounded").Default("1000000").IntVar(&opts.CacheMaxKeys)
 	kingpin.Flag("rgw-admin-endpoints", "the rgw admin endpoint to hit").Default("").Default("https://s3.lga1.coreweave.com").Envar(RgwAdminEndpointEnvVar).StringVar(&opts.RgwAdminEndpoints)
+	kingpin.Flag("rgw-admin-clusters", "cluster names for each rgw admin endpoint, defaults to the endpoint hosts").Default("").Envar("RGW_CLUSTERS").StringVar(&opts.RgwAdminClusters)
 	kingpin.Flag("rgw-admin-secrets", "the rgw admin secret key").Default("").Envar(RgwAdminSecretEnvVar).StringVar(&opts.RgwAdminSecretKeys)
 	kingpin.Flag("rgw-admin-access", "the rgw admin access key").Default("").Envar(RgwAdminAccessEnvVar).StringVar(&opts.RgwAdminAccessKeys)
+	kingpin.Flag("rgw-admin-ca-file", "path to a PEM ca bundle trusted for the rgw admin endpoints").Default("").Envar("RGW_CA_FILE").StringVar(&opts.RgwAdminCAFile)
+	kingpin.Flag("rgw-admin-cert-file", "path to a PEM client certificate for the rgw admin endpoints").Default("").Envar("RGW_CERT_FILE").StringVar(&opts.RgwAdminCertFile)
+	kingpin.Flag("rgw-admin-key-file", "path to the PEM key of the rgw admin client certificate").Default("").Envar("RGW_KEY_FILE").StringVar(&opts.RgwAdminKeyFile)
+	kingpin.Flag("rgw-admin-insecure", "skip certificate verification of the rgw admin endpoints").Default("false").BoolVar(&opts.RgwAdminInsecure)
+	kingpin.Flag("rgw-admin-timeout", "timeout of a single rgw admin api request").Default("30s").DurationVar(&opts.RgwAdminTimeout)
+	kingpin.Flag("rgw-admin-proxy", "http proxy url for the rgw admin endpoints, defaults to the proxy environment variables").Default("").StringVar(&opts.RgwAdminProxy)
+	kingpin.Flag("aws-credentials", "static service credentials formatted as ACCESS_KEY,SECRET_KEY[,USER] (env - AWS_CREDENTIALS)").Envar("AWS_CREDENTIALS").StringsVar(&opts.AwsCredentials)
+	kingpin.Flag("vault-addr", "vault address to read access keys from (env - VAULT_ADDR)").Envar("VAULT_ADDR").Default("").StringVar(&opts.VaultAddr)
+	kingpin.Flag("vault-token", "vault token used to read access keys").Envar(VaultTokenEnvVar).Default("").StringVar(&opts.VaultToken)
+	kingpin.Flag("vault-path", "vault kv path holding access keys, e.g. secret/data/s3proxy").Envar("VAULT_PATH").Default("").StringVar(&opts.VaultPath)
+	kingpin.Flag("credential-precedence", "credential sources in order of precedence when an access key is found in more than one").Default("static", "vault", "rgw").StringsVar(&opts.CredentialOrder)
+	kingpin.Flag("admin-listen-addr", "listen address of the credential admin api").Default(":8889").StringVar(&opts.AdminListenAddr)
+	kingpin.Flag("admin-token", "bearer token for the credential admin api, the api is disabled when unset").Envar(AdminTokenEnvVar).Default("").StringVar(&opts.AdminToken)
+	kingpin.Flag("admin-webhook-secret", "shared secret enabling the signed webhook receiver on the admin api").Envar(AdminWebhookEnvVar).Default("").StringVar(&opts.AdminWebhookSecret)
+	kingpin.Flag("admin-cert-file", "path to the certificate file serving the admin api over https").Envar("ADMIN_CERT_FILE").Default("").StringVar(&opts.AdminCertFile)
+	kingpin.Flag("admin-key-file", "path to the private key file of the admin api certificate").Envar("ADMIN_KEY_FILE").Default("").StringVar(&opts.AdminKeyFile)
+	kingpin.Flag("retry-attempts", "attempts of GET, HEAD and replayable PUT requests failing with a connection error or 5xx, 1 disables retries").Default("3").IntVar(&opts.RetryAttempts)
+	kingpin.Flag("retry-initial-backoff", "backoff before the first retry, doubling up to retry-max-backoff").Default("100ms").DurationVar(&opts.RetryInitialBackoff)
+	kingpin.Flag("retry-max-backoff", "maximum backoff between retries").Default("2s").DurationVar(&opts.RetryMaxBackoff)
+	kingpin.Flag("retry-max-buffer-bytes", "largest unsigned PUT body buffered in memory so it can be retried").Default("8388608").Int64Var(&opts.RetryMaxBufferBytes)
+	kingpin.Flag("retry-budget-ratio", "retries earned per request and upstream, bounds retries to this fraction of traffic").Default("0.1").Float64Var(&opts.RetryBudgetRatio)
+	kingpin.Flag("retry-budget-burst", "most retries an upstream can save up").Default("10").IntVar(&opts.RetryBudgetBurst)
 
 	kingpin.Parse()
 	return opts
@@ -0,0 +1,190 @@
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errNoSources         = errors.New("no credential sources configured")
+	errAllSourcesFailed  = errors.New("all credential sources failed to load")
+	errDuplicateSource   = errors.New("duplicate credential source name")
+	errUnknownPrecedence = errors.New("precedence names a source that is not configured")
+
+	sourceUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s3proxy_credential_source_up",
+		Help: "Whether the last load from a credential source succeeded.",
+	}, []string{"source"})
+	sourceKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s3proxy_credential_source_keys",
+		Help: "Number of keys held from a credential source.",
+	}, []string{"source"})
+	sourceConflicts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "s3proxy_credential_conflicts",
+		Help: "Number of access keys with different secrets across credential sources in the last load.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(sourceUp, sourceKeys, sourceConflicts)
+}
+
+// Source is a named credential backend
+type Source struct {
+	Name   string
+	Client internal.AdminClient
+}
+
+// SourceHealth is the result of the most recent load from a Source
+type SourceHealth struct {
+	Healthy     bool
+	Keys        int
+	LastSuccess time.Time
+	LastError   string
+}
+
+// Conflict is an access key with different secrets across sources, Sources is ordered by precedence
+// and the first entry is the one that was kept
+type Conflict struct {
+	AccessKey string
+	Sources   []string
+}
+
+// CompositeAdminClient merges credentials from several sources, earlier sources win when the same access key
+// is found in more than one. A failing source keeps serving the keys from its last successful load.
+type CompositeAdminClient struct {
+	log     *zap.Logger
+	sources []Source
+
+	mu        sync.RWMutex
+	snapshots map[string]map[string]internal.Credential
+	health    map[string]SourceHealth
+	conflicts []Conflict
+}
+
+// NewCompositeAdminClient orders sources by precedence, a list of source names with the highest precedence first.
+// Sources missing from precedence follow in the order they were given.
+func NewCompositeAdminClient(log *zap.Logger, precedence []string, sources ...Source) (*CompositeAdminClient, error) {
+	if len(sources) == 0 {
+		return nil, errNoSources
+	}
+	byName := make(map[string]Source, len(sources))
+	for _, s := range sources {
+		if _, ok := byName[s.Name]; ok {
+			return nil, fmt.Errorf("%w: %s", errDuplicateSource, s.Name)
+		}
+		byName[s.Name] = s
+	}
+	ordered := make([]Source, 0, len(sources))
+	for _, name := range precedence {
+		s, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errUnknownPrecedence, name)
+		}
+		ordered = append(ordered, s)
+		delete(byName, name)
+	}
+	for _, s := range sources {
+		if _, ok := byName[s.Name]; ok {
+			ordered = append(ordered, s)
+		}
+	}
+	return &CompositeAdminClient{
+		log:       log,
+		sources:   ordered,
+		snapshots: make(map[string]map[string]internal.Credential),
+		health:    make(map[string]SourceHealth),
+	}, nil
+}
+
+func (c *CompositeAdminClient) LoadUserCredentials() (map[string]internal.Credential, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	failed := 0
+	for _, s := range c.sources {
+		h := c.health[s.Name]
+		creds, err := s.Client.LoadUserCredentials()
+		if err != nil {
+			failed++
+			h.Healthy = false
+			h.LastError = err.Error()
+			c.log.Sugar().Errorw("unable to load credentials from source, keeping last known keys",
+				"source", s.Name, "error", err.Error(), "keys", len(c.snapshots[s.Name]))
+		} else {
+			tagged := make(map[string]internal.Credential, len(creds))
+			for k, v := range creds {
+				v.Source = s.Name
+				tagged[k] = v
+			}
+			c.snapshots[s.Name] = tagged
+			h.Healthy = true
+			h.LastError = ""
+			h.LastSuccess = time.Now()
+		}
+		h.Keys = len(c.snapshots[s.Name])
+		c.health[s.Name] = h
+		sourceKeys.WithLabelValues(s.Name).Set(float64(h.Keys))
+		if h.Healthy {
+			sourceUp.WithLabelValues(s.Name).Set(1)
+		} else {
+			sourceUp.WithLabelValues(s.Name).Set(0)
+		}
+	}
+	if failed == len(c.sources) {
+		return nil, errAllSourcesFailed
+	}
+
+	results := make(map[string]internal.Credential)
+	conflicts := make(map[string]*Conflict)
+	for _, s := range c.sources {
+		for k, v := range c.snapshots[s.Name] {
+			kept, ok := results[k]
+			if !ok {
+				results[k] = v
+				continue
+			}
+			if kept.SecretKey == v.SecretKey {
+				continue
+			}
+			if conflict, ok := conflicts[k]; ok {
+				conflict.Sources = append(conflict.Sources, s.Name)
+			} else {
+				conflicts[k] = &Conflict{AccessKey: k, Sources: []string{kept.Source, s.Name}}
+			}
+		}
+	}
+	c.conflicts = make([]Conflict, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		c.log.Sugar().Warnw("access key has different secrets across credential sources",
+			"accessKey", conflict.AccessKey, "sources", conflict.Sources, "kept", conflict.Sources[0])
+		c.conflicts = append(c.conflicts, *conflict)
+	}
+	sort.Slice(c.conflicts, func(i, j int) bool { return c.conflicts[i].AccessKey < c.conflicts[j].AccessKey })
+	sourceConflicts.Set(float64(len(c.conflicts)))
+	return results, nil
+}
+
+// Health returns the state of every source as of the last load
+func (c *CompositeAdminClient) Health() map[string]SourceHealth {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make(map[string]SourceHealth, len(c.sources))
+	for _, s := range c.sources {
+		result[s.Name] = c.health[s.Name]
+	}
+	return result
+}
+
+// Conflicts returns the access keys found with different secrets in the last load
+func (c *CompositeAdminClient) Conflicts() []Conflict {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]Conflict(nil), c.conflicts...)
+}
@@ -0,0 +1,103 @@
+package credentials
+
+import (
+	"errors"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestCompositePrecedenceAndConflicts(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	rgw := mocks.NewMockAdminClient(ctrl)
+	rgw.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{
+		"shared": {SecretKey: "rgw-secret"},
+		"same":   {SecretKey: "same-secret"},
+		"user":   {SecretKey: "user-secret"},
+	}, nil)
+	static, _ := NewStaticAdminClient([]string{"shared,static-secret", "same,same-secret"})
+
+	composite, err := NewCompositeAdminClient(log, []string{StaticCredentialSource},
+		Source{Name: "rgw", Client: rgw}, Source{Name: StaticCredentialSource, Client: static})
+	assert.NoError(t, err)
+
+	creds, err := composite.LoadUserCredentials()
+	assert.NoError(t, err)
+	assert.Len(t, creds, 3)
+	assert.Equal(t, internal.Credential{SecretKey: "static-secret", Source: StaticCredentialSource}, creds["shared"])
+	assert.Equal(t, StaticCredentialSource, creds["same"].Source)
+	assert.Equal(t, internal.Credential{SecretKey: "user-secret", Source: "rgw"}, creds["user"])
+
+	// Only the differing secret is a conflict, the winning source is listed first
+	assert.Equal(t, []Conflict{{AccessKey: "shared", Sources: []string{StaticCredentialSource, "rgw"}}}, composite.Conflicts())
+}
+
+func TestCompositeFailedSourceKeepsKeys(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	rgw := mocks.NewMockAdminClient(ctrl)
+	vault := mocks.NewMockAdminClient(ctrl)
+	gomock.InOrder(
+		vault.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{"vault-key": {SecretKey: "v"}}, nil),
+		vault.EXPECT().LoadUserCredentials().Return(nil, errors.New("vault sealed")),
+	)
+	gomock.InOrder(
+		rgw.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{"rgw-key": {SecretKey: "r"}}, nil),
+		rgw.EXPECT().LoadUserCredentials().Return(map[string]internal.Credential{}, nil),
+	)
+	composite, _ := NewCompositeAdminClient(log, nil, Source{Name: "vault", Client: vault}, Source{Name: "rgw", Client: rgw})
+
+	_, err := composite.LoadUserCredentials()
+	assert.NoError(t, err)
+	creds, err := composite.LoadUserCredentials()
+	assert.NoError(t, err)
+
+	// The broken source still contributes its last known keys, the healthy one reflects its deletion
+	assert.Equal(t, map[string]internal.Credential{"vault-key": {SecretKey: "v", Source: "vault"}}, creds)
+	health := composite.Health()
+	assert.False(t, health["vault"].Healthy)
+	assert.Equal(t, "vault sealed", health["vault"].LastError)
+	assert.Equal(t, 1, health["vault"].Keys)
+	assert.True(t, health["rgw"].Healthy)
+	assert.Equal(t, 0, health["rgw"].Keys)
+}
+
+func TestCompositeAllSourcesFailed(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	rgw := mocks.NewMockAdminClient(ctrl)
+	rgw.EXPECT().LoadUserCredentials().Return(nil, errors.New("rgw down"))
+	composite, _ := NewCompositeAdminClient(log, nil, Source{Name: "rgw", Client: rgw})
+
+	_, err := composite.LoadUserCredentials()
+	assert.ErrorIs(t, err, errAllSourcesFailed)
+}
+
+func TestCompositeInvalidSources(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	static, _ := NewStaticAdminClient(nil)
+
+	_, err := NewCompositeAdminClient(log, nil)
+	assert.ErrorIs(t, err, errNoSources)
+	_, err = NewCompositeAdminClient(log, nil, Source{Name: "a", Client: static}, Source{Name: "a", Client: static})
+	assert.ErrorIs(t, err, errDuplicateSource)
+	_, err = NewCompositeAdminClient(log, []string{"vault"}, Source{Name: "a", Client: static})
+	assert.ErrorIs(t, err, errUnknownPrecedence)
+}
+
+func TestStaticInvalidPair(t *testing.T) {
+	_, err := NewStaticAdminClient([]string{"missing-secret"})
+	assert.ErrorIs(t, err, errInvalidStaticCredential)
+}
+
+func TestStaticUser(t *testing.T) {
+	static, err := NewStaticAdminClient([]string{"abc,xyz,alice", "def,uvw"})
+	assert.NoError(t, err)
+	creds, _ := static.LoadUserCredentials()
+	assert.Equal(t, "alice", creds["abc"].User)
+	assert.Equal(t, "", creds["def"].User)
+}
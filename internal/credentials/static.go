@@ -0,0 +1,46 @@
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal"
+	"strings"
+)
+
+// StaticCredentialSource tags credentials given on the command line
+const StaticCredentialSource = "static"
+
+var errInvalidStaticCredential = errors.New("static credentials must be formatted as ACCESS_KEY,SECRET_KEY[,USER]")
+
+// StaticAdminClient serves a fixed set of service keys
+type StaticAdminClient struct {
+	creds map[string]internal.Credential
+}
+
+// NewStaticAdminClient parses pairs formatted as ACCESS_KEY,SECRET_KEY with an optional ,USER owning the key
+func NewStaticAdminClient(pairs []string) (*StaticAdminClient, error) {
+	creds := make(map[string]internal.Credential, len(pairs))
+	for _, pair := range pairs {
+		keys := strings.Split(pair, ",")
+		if len(keys) < 2 || len(keys) > 3 || keys[0] == "" || keys[1] == "" {
+			return nil, errInvalidStaticCredential
+		}
+		if _, ok := creds[keys[0]]; ok {
+			return nil, fmt.Errorf("duplicate static access key %s", keys[0])
+		}
+		cred := internal.Credential{SecretKey: keys[1], Source: StaticCredentialSource}
+		if len(keys) == 3 {
+			cred.User = keys[2]
+		}
+		creds[keys[0]] = cred
+	}
+	return &StaticAdminClient{creds: creds}, nil
+}
+
+func (s *StaticAdminClient) LoadUserCredentials() (map[string]internal.Credential, error) {
+	results := make(map[string]internal.Credential, len(s.creds))
+	for k, v := range s.creds {
+		results[k] = v
+	}
+	return results, nil
+}
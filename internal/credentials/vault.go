@@ -0,0 +1,90 @@
+package credentials
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultCredentialSource tags credentials read from vault
+const VaultCredentialSource = "vault"
+
+var errMissingVaultParameters = errors.New("vault address, token and path are all required")
+
+// VaultAdminClient reads access keys from a vault kv secret where every field name is an access key and its value
+// is the secret key, or an object with secret_key and user fields. Both kv v1 and v2 mounts are supported, for v2 the path includes the data segment.
+type VaultAdminClient struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+type vaultSecret struct {
+	Data map[string]json.RawMessage `json:"data"`
+}
+
+type vaultKeyEntry struct {
+	SecretKey string `json:"secret_key"`
+	User      string `json:"user"`
+}
+
+func NewVaultAdminClient(address, token, path string, timeout time.Duration) (*VaultAdminClient, error) {
+	if address == "" || token == "" || path == "" {
+		return nil, errMissingVaultParameters
+	}
+	return &VaultAdminClient{
+		client: &http.Client{Timeout: timeout},
+		url:    strings.TrimSuffix(address, "/") + "/v1/" + strings.TrimPrefix(path, "/"),
+		token:  token,
+	}, nil
+}
+
+func (v *VaultAdminClient) LoadUserCredentials() (map[string]internal.Credential, error) {
+	req, err := http.NewRequest(http.MethodGet, v.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from vault: %s", resp.Status)
+	}
+
+	var secret vaultSecret
+	if err = json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("unable to decode vault secret: %w", err)
+	}
+	fields := secret.Data
+	// kv v2 nests the fields one level deeper, alongside the version metadata
+	if nested, ok := secret.Data["data"]; ok {
+		if _, hasMetadata := secret.Data["metadata"]; hasMetadata {
+			fields = nil
+			if err = json.Unmarshal(nested, &fields); err != nil {
+				return nil, fmt.Errorf("unable to decode vault kv v2 data: %w", err)
+			}
+		}
+	}
+
+	results := make(map[string]internal.Credential, len(fields))
+	for accessKey, raw := range fields {
+		var secretKey string
+		if err = json.Unmarshal(raw, &secretKey); err == nil {
+			results[accessKey] = internal.Credential{SecretKey: secretKey, Source: VaultCredentialSource}
+			continue
+		}
+		var entry vaultKeyEntry
+		if err = json.Unmarshal(raw, &entry); err != nil || entry.SecretKey == "" {
+			return nil, fmt.Errorf("vault field %s is neither a secret key nor an object with secret_key", accessKey)
+		}
+		results[accessKey] = internal.Credential{SecretKey: entry.SecretKey, Source: VaultCredentialSource, User: entry.User}
+	}
+	return results, nil
+}
@@ -0,0 +1,46 @@
+package credentials
+
+import (
+	"github.com/coreweave/aws-s3-reverse-proxy/internal"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVaultLoadKvV2(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/secret/data/s3proxy", r.URL.Path)
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"data":{"abc":"xyz"},"metadata":{"version":3}}}`))
+	}))
+	defer srv.Close()
+
+	client, err := NewVaultAdminClient(srv.URL, "token", "secret/data/s3proxy", time.Second)
+	assert.NoError(t, err)
+	creds, err := client.LoadUserCredentials()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]internal.Credential{"abc": {SecretKey: "xyz", Source: VaultCredentialSource}}, creds)
+
+	client, _ = NewVaultAdminClient(srv.URL, "bad", "secret/data/s3proxy", time.Second)
+	_, err = client.LoadUserCredentials()
+	assert.Error(t, err)
+}
+
+func TestVaultLoadKvV1(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"abc":"xyz","def":{"secret_key":"uvw","user":"alice"}}}`))
+	}))
+	defer srv.Close()
+
+	client, _ := NewVaultAdminClient(srv.URL, "token", "kv/s3proxy", time.Second)
+	creds, err := client.LoadUserCredentials()
+	assert.NoError(t, err)
+	assert.Len(t, creds, 2)
+	assert.Equal(t, "uvw", creds["def"].SecretKey)
+	assert.Equal(t, "alice", creds["def"].User)
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"net"
+	"net/url"
+	"regexp"
+)
+
+// dnsBucketRegexp matches bucket names that can be used as a host label
+var dnsBucketRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// applyAddressing points proxyURL at the upstream, moving the bucket between the host and the path when the
+// upstream requires a different addressing style than the client used
+func applyAddressing(proxyURL *url.URL, upstream *routing.Upstream, loc routing.Location) {
+	proxyURL.Host = upstream.Host
+	// Upstreams of the upstream helper have no addressing, their host was rendered for the request
+	if loc.Bucket == "" || upstream.Addressing == "" {
+		return
+	}
+
+	virtual := loc.VirtualHost
+	switch upstream.Addressing {
+	case routing.AddressingPath:
+		virtual = false
+	case routing.AddressingVirtual:
+		virtual = canAddressVirtually(loc.Bucket, upstream.Host)
+	}
+
+	switch {
+	case virtual && !loc.VirtualHost:
+		proxyURL.Host = loc.Bucket + "." + upstream.Host
+		proxyURL.Path = "/" + loc.Key
+	case virtual:
+		proxyURL.Host = loc.Bucket + "." + upstream.Host
+	case loc.VirtualHost:
+		proxyURL.Path = "/" + loc.Bucket
+		if loc.Key != "" {
+			proxyURL.Path += "/" + loc.Key
+		}
+	}
+}
+
+// canAddressVirtually rejects buckets that are not a single dns label, dotted buckets would break wildcard
+// certificates, and upstreams addressed by ip
+func canAddressVirtually(bucket, upstreamHost string) bool {
+	host := upstreamHost
+	if h, _, err := net.SplitHostPort(upstreamHost); err == nil {
+		host = h
+	}
+	return dnsBucketRegexp.MatchString(bucket) && net.ParseIP(host) == nil
+}
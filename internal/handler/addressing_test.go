@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+func TestApplyAddressing(t *testing.T) {
+	tests := []struct {
+		name       string
+		addressing routing.Addressing
+		upstream   string
+		path       string
+		loc        routing.Location
+		wantHost   string
+		wantPath   string
+	}{
+		{"virtual to path", routing.AddressingPath, "s3.lga1.example.com", "/key/name",
+			routing.Location{Bucket: "bucket", Key: "key/name", VirtualHost: true}, "s3.lga1.example.com", "/bucket/key/name"},
+		{"virtual bucket request to path", routing.AddressingPath, "s3.lga1.example.com", "/",
+			routing.Location{Bucket: "bucket", VirtualHost: true}, "s3.lga1.example.com", "/bucket"},
+		{"path to virtual", routing.AddressingVirtual, "s3.lga1.example.com", "/bucket/key/name",
+			routing.Location{Bucket: "bucket", Key: "key/name"}, "bucket.s3.lga1.example.com", "/key/name"},
+		{"path bucket request to virtual", routing.AddressingVirtual, "s3.lga1.example.com", "/bucket",
+			routing.Location{Bucket: "bucket"}, "bucket.s3.lga1.example.com", "/"},
+		{"dotted bucket stays path", routing.AddressingVirtual, "s3.lga1.example.com", "/my.bucket/key",
+			routing.Location{Bucket: "my.bucket", Key: "key"}, "s3.lga1.example.com", "/my.bucket/key"},
+		{"ip upstream stays path", routing.AddressingVirtual, "10.0.0.1:7480", "/bucket/key",
+			routing.Location{Bucket: "bucket", Key: "key"}, "10.0.0.1:7480", "/bucket/key"},
+		{"preserve virtual", routing.AddressingPreserve, "s3.lga1.example.com", "/key",
+			routing.Location{Bucket: "bucket", Key: "key", VirtualHost: true}, "bucket.s3.lga1.example.com", "/key"},
+		{"preserve path", routing.AddressingPreserve, "s3.lga1.example.com", "/bucket/key",
+			routing.Location{Bucket: "bucket", Key: "key"}, "s3.lga1.example.com", "/bucket/key"},
+		{"service request", routing.AddressingVirtual, "s3.lga1.example.com", "/",
+			routing.Location{}, "s3.lga1.example.com", "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &url.URL{Host: "proxy.example.com", Path: tt.path}
+			applyAddressing(u, &routing.Upstream{Host: tt.upstream, Addressing: tt.addressing}, tt.loc)
+			assert.Equal(t, tt.wantHost, u.Host)
+			assert.Equal(t, tt.wantPath, u.Path)
+		})
+	}
+}
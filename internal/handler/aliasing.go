@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	copySourceHeader = "X-Amz-Copy-Source"
+
+	// maxRewriteBytes bounds the xml bodies buffered to rename buckets, larger bodies are passed through untouched
+	maxRewriteBytes = 16 << 20
+)
+
+var (
+	// bucketElementRegexp matches the elements naming a bucket in ListBuckets, ListObjects, multipart and error bodies
+	bucketElementRegexp = regexp.MustCompile(`<(Bucket|BucketName|Name)>([^<]*)</(Bucket|BucketName|Name)>`)
+
+	// referenceElementRegexp matches the elements holding a url or path that may name a bucket
+	referenceElementRegexp = regexp.MustCompile(`<(Location|Resource)>([^<]*)</(Location|Resource)>`)
+)
+
+// aliasLocation renames the bucket of loc to its upstream name, the path of path-style requests is rewritten here
+// while applyAddressing builds virtual hosts from the renamed location
+func aliasLocation(proxyURL *url.URL, loc routing.Location, aliases *routing.Aliases) routing.Location {
+	upstream := aliases.Upstream(loc.Bucket)
+	if upstream == loc.Bucket {
+		return loc
+	}
+	if !loc.VirtualHost {
+		proxyURL.Path = "/" + upstream + strings.TrimPrefix(strings.TrimPrefix(proxyURL.Path, "/"), loc.Bucket)
+	}
+	loc.Bucket = upstream
+	return loc
+}
+
+// denyAliasTarget denies requests naming the upstream bucket of an alias, clients only reach it by its alias so
+// rules and namespaces matching the client name can't be sidestepped
+func denyAliasTarget(aliases *routing.Aliases, bucket string) error {
+	if bucket != "" && aliases.Client(bucket) != bucket {
+		return fmt.Errorf("%w: bucket %s is only reachable by its alias", errAccessDenied, bucket)
+	}
+	return nil
+}
+
+// aliasCopySource renames the source bucket of an x-amz-copy-source value formatted as [/]bucket/key[?versionId=]
+func aliasCopySource(value string, aliases *routing.Aliases) string {
+	slash := strings.HasPrefix(value, "/")
+	parts := strings.SplitN(strings.TrimPrefix(value, "/"), "/", 2)
+	if len(parts) != 2 {
+		return value
+	}
+	upstream := aliases.Upstream(parts[0])
+	if upstream == parts[0] {
+		return value
+	}
+	if slash {
+		return "/" + upstream + "/" + parts[1]
+	}
+	return upstream + "/" + parts[1]
+}
+
+// rewriteResponse renames upstream buckets in xml response bodies back to the names clients know them by and strips
+// the namespace prefix from keys. Object bodies are never touched, only bucket and service level responses,
+// multipart requests and errors.
+func rewriteResponse(resp *http.Response) error {
+	r := routeFromContext(resp.Request.Context())
+	if r == nil || (r.aliases.Len() == 0 && r.prefix == "") || (r.objectRequest && resp.StatusCode < http.StatusMultipleChoices) {
+		return nil
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "xml") || resp.ContentLength > maxRewriteBytes {
+		return nil
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRewriteBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxRewriteBytes {
+		resp.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return nil
+	}
+	_ = resp.Body.Close()
+
+	if r.aliases.Len() > 0 {
+		body = aliasBody(body, r.aliases)
+	}
+	if r.prefix != "" {
+		body = stripNamespace(body, r.prefix)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// aliasBody renames the buckets of an xml body to their client names
+func aliasBody(body []byte, aliases *routing.Aliases) []byte {
+	body = bucketElementRegexp.ReplaceAllFunc(body, func(element []byte) []byte {
+		m := bucketElementRegexp.FindSubmatch(element)
+		return []byte("<" + string(m[1]) + ">" + aliases.Client(string(m[2])) + "</" + string(m[3]) + ">")
+	})
+	return referenceElementRegexp.ReplaceAllFunc(body, func(element []byte) []byte {
+		m := referenceElementRegexp.FindSubmatch(element)
+		return []byte("<" + string(m[1]) + ">" + aliasReference(string(m[2]), aliases) + "</" + string(m[3]) + ">")
+	})
+}
+
+// aliasReference renames the bucket in a url or path, either the leading host label or the first path segment
+func aliasReference(value string, aliases *routing.Aliases) string {
+	prefix, rest := "", value
+	if i := strings.Index(value, "://"); i >= 0 {
+		host := value[i+3:]
+		path := ""
+		if j := strings.Index(host, "/"); j >= 0 {
+			host, path = host[:j], host[j:]
+		}
+		if labels := strings.SplitN(host, ".", 2); len(labels) == 2 {
+			if client := aliases.Client(labels[0]); client != labels[0] {
+				return value[:i+3] + client + "." + labels[1] + path
+			}
+		}
+		prefix, rest = value[:i+3]+host, path
+	}
+	slash := ""
+	if strings.HasPrefix(rest, "/") {
+		slash = "/"
+	}
+	segments := strings.SplitN(strings.TrimPrefix(rest, "/"), "/", 2)
+	client := aliases.Client(segments[0])
+	if client == segments[0] {
+		return value
+	}
+	segments[0] = client
+	return prefix + slash + strings.Join(segments, "/")
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
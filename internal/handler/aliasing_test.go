@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAliasCopySource(t *testing.T) {
+	aliases := routing.NewAliases(map[string]string{"legacy-bucket": "tenant-a-legacy-bucket"})
+	assert.Equal(t, "/tenant-a-legacy-bucket/some/key", aliasCopySource("/legacy-bucket/some/key", aliases))
+	assert.Equal(t, "tenant-a-legacy-bucket/key?versionId=1", aliasCopySource("legacy-bucket/key?versionId=1", aliases))
+	assert.Equal(t, "/other-bucket/key", aliasCopySource("/other-bucket/key", aliases))
+	assert.Equal(t, "legacy-bucket", aliasCopySource("legacy-bucket", aliases))
+}
+
+func TestAliasReference(t *testing.T) {
+	aliases := routing.NewAliases(map[string]string{"legacy-bucket": "tenant-a-legacy-bucket"})
+	assert.Equal(t, "http://s3.example.com/legacy-bucket/key", aliasReference("http://s3.example.com/tenant-a-legacy-bucket/key", aliases))
+	assert.Equal(t, "https://legacy-bucket.s3.example.com/key", aliasReference("https://tenant-a-legacy-bucket.s3.example.com/key", aliases))
+	assert.Equal(t, "/legacy-bucket/key", aliasReference("/tenant-a-legacy-bucket/key", aliases))
+	assert.Equal(t, "/other/key", aliasReference("/other/key", aliases))
+}
+
+func TestHandlerBucketAliases(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.Header().Set("Content-Type", "application/xml")
+		switch {
+		case r.URL.Path == "/":
+			_, _ = w.Write([]byte(`<ListAllMyBucketsResult><Buckets><Bucket><Name>tenant-a-legacy-bucket</Name></Bucket>` +
+				`<Bucket><Name>other</Name></Bucket></Buckets></ListAllMyBucketsResult>`))
+		case strings.HasSuffix(r.URL.Path, "/missing"):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code><BucketName>tenant-a-legacy-bucket</BucketName>` +
+				`<Resource>/tenant-a-legacy-bucket/missing</Resource></Error>`))
+		case r.Method == http.MethodPost:
+			_, _ = w.Write([]byte(`<CompleteMultipartUploadResult><Location>http://s3.example.com/tenant-a-legacy-bucket/key</Location>` +
+				`<Bucket>tenant-a-legacy-bucket</Bucket><Key>key</Key></CompleteMultipartUploadResult>`))
+		default:
+			_, _ = w.Write([]byte(`<Name>tenant-a-legacy-bucket</Name>`))
+		}
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, `
+domains: [object.lga1.example.com]
+upstreams:
+  - name: test
+    endpoint: `+strings.TrimPrefix(upstream.URL, "http://")+`
+    scheme: http
+    addressing: path
+default: test
+aliases:
+  legacy-bucket: tenant-a-legacy-bucket
+`)
+
+	rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/legacy-bucket/some/key", "")
+	assert.Equal(t, "/tenant-a-legacy-bucket/some/key", received.URL.Path)
+	// Object bodies are passed through untouched
+	assert.Equal(t, `<Name>tenant-a-legacy-bucket</Name>`, rec.Body.String())
+
+	serveTestRequest(h, http.MethodGet, "http://legacy-bucket.object.lga1.example.com/some/key", "")
+	assert.Equal(t, "/tenant-a-legacy-bucket/some/key", received.URL.Path)
+
+	req := httptest.NewRequest(http.MethodPut, "http://proxy.example.com/other/copy", nil)
+	req.Header.Set("Authorization", testAuthHeader)
+	req.Header.Set(copySourceHeader, "/legacy-bucket/some/key")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "/tenant-a-legacy-bucket/some/key", received.Header.Get(copySourceHeader))
+	assert.Contains(t, received.Header.Get("Authorization"), "x-amz-copy-source")
+
+	rec = serveTestRequest(h, http.MethodGet, "http://proxy.example.com/", "")
+	assert.Equal(t, `<ListAllMyBucketsResult><Buckets><Bucket><Name>legacy-bucket</Name></Bucket>`+
+		`<Bucket><Name>other</Name></Bucket></Buckets></ListAllMyBucketsResult>`, rec.Body.String())
+	assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get("Content-Length"))
+
+	rec = serveTestRequest(h, http.MethodPost, "http://proxy.example.com/legacy-bucket/key?uploadId=1", "")
+	assert.Equal(t, `<CompleteMultipartUploadResult><Location>http://s3.example.com/legacy-bucket/key</Location>`+
+		`<Bucket>legacy-bucket</Bucket><Key>key</Key></CompleteMultipartUploadResult>`, rec.Body.String())
+
+	rec = serveTestRequest(h, http.MethodGet, "http://proxy.example.com/legacy-bucket/missing", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, `<Error><Code>NoSuchKey</Code><BucketName>legacy-bucket</BucketName>`+
+		`<Resource>/legacy-bucket/missing</Resource></Error>`, rec.Body.String())
+
+	// The upstream bucket is only reachable by its alias, also as a copy source
+	received = nil
+	rec = serveTestRequest(h, http.MethodGet, "http://proxy.example.com/tenant-a-legacy-bucket/some/key", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	req = httptest.NewRequest(http.MethodPut, "http://proxy.example.com/other/copy", nil)
+	req.Header.Set("Authorization", testAuthHeader)
+	req.Header.Set(copySourceHeader, "/tenant-a-%6Cegacy-bucket/some/key")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Nil(t, received)
+}
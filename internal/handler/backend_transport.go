@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/upstream"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// backendTransport sends a request to a healthy backend of the upstream it was routed to, picked by the balancing
+// strategy of its pool. When a backend can't be connected to the request fails over to its siblings, as long as the
+// body can be replayed.
+type backendTransport struct {
+	log *zap.Logger
+
+	// base sends the requests, it must read the tls settings of the upstream from the request context
+	base http.RoundTripper
+}
+
+func (t *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := routeFromContext(req.Context())
+	if r == nil || r.upstream.Pool == nil {
+		return t.transport().RoundTrip(req)
+	}
+	tried := &triedBackends{backends: make(map[*upstream.Backend]bool)}
+	if r.upstream.Hedge != nil && (req.Method == http.MethodGet || req.Method == http.MethodHead) && canReplayBody(req) {
+		return t.hedge(req, r, tried)
+	}
+	return t.send(req, r.upstream, r.hashKey, tried)
+}
+
+func (t *backendTransport) transport() http.RoundTripper {
+	if t.base == nil {
+		return http.DefaultTransport
+	}
+	return t.base
+}
+
+// send sends req to a backend of target that is not in tried, failing over to the next one when a backend can't be
+// connected to
+func (t *backendTransport) send(req *http.Request, target *routing.Upstream, hashKey string, tried *triedBackends) (*http.Response, error) {
+	var lastErr error
+	for first := true; ; first = false {
+		backend, err := tried.next(target.Pool, hashKey)
+		if err != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+		attempt := req.Clone(req.Context())
+		attempt.URL.Host = backend.Address
+		if !first && req.GetBody != nil {
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		release := target.Pool.Acquire(backend)
+		resp, err := t.transport().RoundTrip(attempt)
+		if err == nil {
+			if isBackendFailureStatus(resp.StatusCode) && !isSlowDown(resp) {
+				target.Pool.ReportFailure(backend)
+			} else {
+				target.Pool.ReportSuccess(backend)
+			}
+			// The request stays in flight until the response body has been streamed to the client
+			resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+			return resp, nil
+		}
+		release()
+		// Cancelled requests, such as the losing attempt of a hedged request, say nothing about the backend
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		target.Pool.ReportFailure(backend)
+		if !isDialError(err) || !canReplayBody(req) {
+			return nil, err
+		}
+		t.log.Sugar().Infow("unable to connect to backend, failing over", "upstream", target.Name,
+			"backend", backend.Address, "error", err.Error())
+		lastErr = err
+	}
+}
+
+// triedBackends are the backends a request was sent to, hedged attempts of a request share them so they never pick
+// the same backend
+type triedBackends struct {
+	mu       sync.Mutex
+	backends map[*upstream.Backend]bool
+}
+
+// next picks a backend of pool that was not tried yet and marks it as tried
+func (t *triedBackends) next(pool *upstream.Pool, hashKey string) (*upstream.Backend, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	backend, err := pool.Next(t.backends, hashKey)
+	if err == nil {
+		t.backends[backend] = true
+	}
+	return backend, err
+}
+
+// available reports whether pool has a healthy backend that was not tried yet
+func (t *triedBackends) available(pool *upstream.Pool, hashKey string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, err := pool.Next(t.backends, hashKey)
+	return err == nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
+
+// isBackendFailureStatus matches responses a gateway sends when it can't serve requests
+func isBackendFailureStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// slowDownPeekLimit bounds how much of a 503 response body is read to find its S3 error code
+const slowDownPeekLimit = 4096
+
+// isSlowDown reports whether resp is a 503 SlowDown. A gateway throttling the client is healthy, its answer says
+// nothing about whether it can serve requests. The start of the body is read to find the error code and put back.
+func isSlowDown(resp *http.Response) bool {
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Body == nil || resp.Body == http.NoBody {
+		return false
+	}
+	peeked, _ := ioutil.ReadAll(io.LimitReader(resp.Body, slowDownPeekLimit))
+	resp.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(peeked), resp.Body), Closer: resp.Body}
+	return bytes.Contains(peeked, []byte("<Code>SlowDown</Code>"))
+}
+
+// peekedBody is a response body whose start was read and put back in front of the rest
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// isDialError reports whether the request failed before anything was sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func canReplayBody(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
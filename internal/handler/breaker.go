@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"errors"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/upstream"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit breaker of the upstream is open")
+
+// admitUpstream returns the upstream a request routed to u is sent to. While the circuit breaker of u is open that is
+// its fallback, or errCircuitOpen when there is none or the fallback is open as well.
+func (h *Handler) admitUpstream(u *routing.Upstream) (*routing.Upstream, error) {
+	if u.Breaker == nil || u.Breaker.Allow() {
+		return u, nil
+	}
+	if f := u.Fallback; f != nil && (f.Breaker == nil || f.Breaker.Allow()) {
+		h.log.Sugar().Debugf("circuit of upstream %s is open, routing to fallback %s", u.Name, f.Name)
+		return f, nil
+	}
+	return nil, errCircuitOpen
+}
+
+// releaseUnreported gives back the probe slot r took from the circuit breaker of its upstream when the outcome of
+// the request was never recorded
+func releaseUnreported(r *route) {
+	if r != nil && !r.reported && r.upstream.Breaker != nil {
+		r.upstream.Breaker.Release()
+	}
+}
+
+// CircuitStatus returns the state of the circuit breaker of every upstream that has one, ordered by upstream name
+func (h *Handler) CircuitStatus() []upstream.BreakerStatus {
+	routes := h.Routes()
+	if routes == nil {
+		return nil
+	}
+	var result []upstream.BreakerStatus
+	for _, u := range routes.Upstreams() {
+		if u.Breaker != nil {
+			result = append(result, u.Breaker.Status())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Upstream < result[j].Upstream })
+	return result
+}
+
+// breakerTransport reports the outcome of every request to the circuit breaker of the upstream it was sent to.
+// Errors and the statuses that are retried count as failed, except for 503 SlowDown which only throttles the
+// client. Requests the client gave up on are not counted and release their probe slot instead, see
+// releaseUnreported.
+type breakerTransport struct {
+	base http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := routeFromContext(req.Context())
+	if r == nil || r.upstream.Breaker == nil {
+		return t.base.RoundTrip(req)
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if req.Context().Err() == nil {
+		r.upstream.Breaker.Record(retryReason(resp, err) != "" && !isSlowDown(resp), time.Since(start))
+		r.reported = true
+	}
+	return resp, err
+}
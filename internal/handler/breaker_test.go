@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"context"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/upstream"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandlerCircuitBreaker(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	standby := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("standby"))
+	}))
+	defer standby.Close()
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: primary
+    endpoint: `+strings.TrimPrefix(failing.URL, "http://")+`
+    scheme: http
+    circuit_breaker:
+      min_requests: 2
+    fallback: standby
+  - name: standby
+    endpoint: `+strings.TrimPrefix(standby.URL, "http://")+`
+    scheme: http
+  - name: lonely
+    endpoint: `+strings.TrimPrefix(failing.URL, "http://")+`
+    scheme: http
+    circuit_breaker:
+      min_requests: 2
+rules:
+  - match:
+      bucket: lonely
+    upstream: lonely
+default: primary
+`)
+	h.Proxies = NewProxyRegistry(&breakerTransport{base: &backendTransport{log: h.log, base: transport.NewUpstreamTransport(transport.UpstreamConfig{})}}, 0)
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusInternalServerError, serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "").Code)
+		assert.Equal(t, http.StatusInternalServerError, serveTestRequest(h, http.MethodGet, "http://proxy.example.com/lonely/key", "").Code)
+	}
+
+	// The open primary hands its requests to the fallback
+	rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "standby", rec.Body.String())
+
+	// Without a fallback the request fails fast
+	rec = serveTestRequest(h, http.MethodGet, "http://proxy.example.com/lonely/key", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<Code>ServiceUnavailable</Code>")
+	assert.Contains(t, rec.Body.String(), "<Resource>/lonely/key</Resource>")
+
+	status := h.CircuitStatus()
+	assert.Len(t, status, 2)
+	assert.Equal(t, "lonely", status[0].Upstream)
+	assert.Equal(t, upstream.BreakerOpen, status[0].State)
+	assert.Equal(t, "primary", status[1].Upstream)
+	assert.Equal(t, upstream.BreakerOpen, status[1].State)
+}
+
+func TestHandlerCircuitBreakerProbes(t *testing.T) {
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	config := `
+upstreams:
+  - name: probed
+    endpoint: ` + strings.TrimPrefix(server.URL, "http://") + `
+    scheme: http
+    circuit_breaker:
+      min_requests: 1
+      open_for: 50ms
+      half_open_requests: 1
+default: probed
+aliases:
+  legacy-bucket: tenant-a-legacy-bucket
+`
+	path := filepath.Join(t.TempDir(), "routing.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+	h := newTestHandler(t, config)
+	rt := transport.NewUpstreamTransport(transport.UpstreamConfig{})
+	h.Proxies = NewProxyRegistry(&breakerTransport{base: &backendTransport{log: h.log, base: rt}}, 0)
+	h.reloader = &routingReloader{path: path, transport: rt}
+
+	assert.Equal(t, http.StatusInternalServerError, serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "").Code)
+	assert.Equal(t, upstream.BreakerOpen, h.CircuitStatus()[0].State)
+
+	// Reloading the routing config keeps the breaker open
+	assert.NoError(t, h.ReloadRoutes(context.Background()))
+	assert.Equal(t, upstream.BreakerOpen, h.CircuitStatus()[0].State)
+	assert.Equal(t, http.StatusServiceUnavailable, serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "").Code)
+
+	// A request denied after it was admitted as the only probe doesn't keep the probe slot
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, http.StatusForbidden, serveTestRequest(h, http.MethodGet, "http://proxy.example.com/tenant-a-legacy-bucket/key", "").Code)
+	atomic.StoreInt32(&healthy, 1)
+	assert.Equal(t, http.StatusOK, serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "").Code)
+	assert.Equal(t, upstream.BreakerClosed, h.CircuitStatus()[0].State)
+}
+
+func TestHandlerSlowDownIsNoFailure(t *testing.T) {
+	slowDown := `<?xml version="1.0" encoding="UTF-8"?><Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(slowDown))
+	}))
+	defer server.Close()
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: throttling
+    endpoint: s3.lga1.example.com
+    scheme: http
+    backends: [`+strings.TrimPrefix(server.URL, "http://")+`]
+    max_fails: 1
+    circuit_breaker:
+      min_requests: 1
+default: throttling
+`)
+	h.Proxies = NewProxyRegistry(&breakerTransport{base: &backendTransport{log: h.log, base: transport.NewUpstreamTransport(transport.UpstreamConfig{})}}, 0)
+
+	for i := 0; i < 3; i++ {
+		rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "")
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		// The body read to find the error code still reaches the client
+		assert.Equal(t, slowDown, rec.Body.String())
+	}
+	assert.Equal(t, upstream.BreakerClosed, h.CircuitStatus()[0].State)
+	assert.True(t, h.Routes().Upstream("throttling").Pool.Backends()[0].Healthy())
+}
@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"time"
+)
+
+var (
+	canaryRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_canary_requests_total",
+		Help: "Requests of canary rules by rule, variant and status code.",
+	}, []string{"route", "variant", "code"})
+	canaryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "s3proxy_canary_request_duration_seconds",
+		Help:    "Time to serve requests of canary rules by rule and variant.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "variant"})
+)
+
+func init() {
+	prometheus.MustRegister(canaryRequests, canaryDuration)
+}
+
+// observeVariant records the outcome of a request sent to a variant of a canary rule
+func observeVariant(variant routing.Variant, status int, duration time.Duration) {
+	if variant.Name == "" {
+		return
+	}
+	canaryRequests.WithLabelValues(variant.Route, variant.Name, strconv.Itoa(status)).Inc()
+	canaryDuration.WithLabelValues(variant.Route, variant.Name).Observe(duration.Seconds())
+}
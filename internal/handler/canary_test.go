@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerCanaryVariantMetrics(t *testing.T) {
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("stable"))
+	}))
+	defer stable.Close()
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer canary.Close()
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: stable
+    endpoint: `+strings.TrimPrefix(stable.URL, "http://")+`
+    scheme: http
+  - name: next
+    endpoint: `+strings.TrimPrefix(canary.URL, "http://")+`
+    scheme: http
+rules:
+  - name: all-in
+    match:
+      bucket: canaried
+    upstream: stable
+    canary:
+      upstream: next
+      weight: 100
+  - name: all-out
+    match:
+      bucket: stable
+    upstream: stable
+    canary:
+      upstream: next
+      weight: 0
+`)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusServiceUnavailable, serveTestRequest(h, http.MethodGet, "http://proxy.example.com/canaried/key", "").Code)
+		assert.Equal(t, "stable", serveTestRequest(h, http.MethodGet, "http://proxy.example.com/stable/key", "").Body.String())
+	}
+	assert.Equal(t, float64(3), testutil.ToFloat64(canaryRequests.WithLabelValues("all-in", "canary", "503")))
+	assert.Equal(t, float64(3), testutil.ToFloat64(canaryRequests.WithLabelValues("all-out", "stable", "200")))
+}
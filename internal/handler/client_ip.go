@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	forwardedHeader    = "Forwarded"
+	forwardedForHeader = "X-Forwarded-For"
+)
+
+// ClientIPResolver finds the address of the client a request came from. Forwarding headers are only believed when
+// the direct peer is a trusted proxy, and then only up to the first hop that isn't one, so a client can't pose as
+// another address by sending the headers itself. Only the header the trusted proxies maintain is read, the other one
+// passes through them as the client sent it. A nil resolver trusts no proxy.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+	header  string
+}
+
+// NewClientIPResolver builds a resolver trusting the hops the proxies in the given CIDR subnets add to header, which
+// is X-Forwarded-For or Forwarded in any case
+func NewClientIPResolver(trustedProxies []string, header string) (*ClientIPResolver, error) {
+	r := &ClientIPResolver{}
+	switch {
+	case strings.EqualFold(header, forwardedForHeader):
+		r.header = forwardedForHeader
+	case strings.EqualFold(header, forwardedHeader):
+		r.header = forwardedHeader
+	default:
+		return nil, fmt.Errorf("Invalid trusted proxy header: %v", header)
+	}
+	for _, proxy := range trustedProxies {
+		_, subnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy: %v", proxy)
+		}
+		r.trusted = append(r.trusted, subnet)
+	}
+	return r, nil
+}
+
+// ClientIP returns the address of the client of req, nil when not even the peer address can be parsed
+func (r *ClientIPResolver) ClientIP(req *http.Request) net.IP {
+	client := peerIP(req)
+	if !r.isTrusted(client) {
+		return client
+	}
+	hops := r.hops(req.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			// Obfuscated and unknown hops end the chain, the proxy that reported them is the best known address
+			break
+		}
+		client = hop
+		if !r.isTrusted(hop) {
+			break
+		}
+	}
+	return client
+}
+
+// setForwardedFor sets X-Forwarded-For of the upstream request proxyReq built from req. The peer of req is appended
+// as the hop of this proxy; the forwarding headers of untrusted peers are replaced, they could be made up.
+func (r *ClientIPResolver) setForwardedFor(proxyReq, req *http.Request) {
+	peer := peerIP(req)
+	if peer == nil {
+		return
+	}
+	var hops []string
+	if r.isTrusted(peer) {
+		hops = r.hops(req.Header)
+	} else {
+		proxyReq.Header.Del(forwardedHeader)
+	}
+	proxyReq.Header.Set(forwardedForHeader, strings.Join(append(hops, peer.String()), ", "))
+}
+
+// hops returns the hops of the header the trusted proxies maintain
+func (r *ClientIPResolver) hops(h http.Header) []string {
+	if r.header == forwardedHeader {
+		return forwardedFor(h)
+	}
+	return xForwardedFor(h)
+}
+
+func (r *ClientIPResolver) isTrusted(ip net.IP) bool {
+	if r == nil || ip == nil {
+		return false
+	}
+	for _, subnet := range r.trusted {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func peerIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// xForwardedFor returns the hops of every X-Forwarded-For header of h in order
+func xForwardedFor(h http.Header) []string {
+	var hops []string
+	for _, value := range h.Values(forwardedForHeader) {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedFor returns the for parameters of every Forwarded header of h in order, see RFC 7239
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, value := range h.Values(forwardedHeader) {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, strings.Trim(kv[1], `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address with an optional port, IPv6 addresses with a port are bracketed
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(hop)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	xff, err := NewClientIPResolver([]string{"10.0.0.0/8", "fd00::/8"}, "x-forwarded-for")
+	assert.NoError(t, err)
+	forwarded, err := NewClientIPResolver([]string{"10.0.0.0/8", "fd00::/8"}, "forwarded")
+	assert.NoError(t, err)
+	_, err = NewClientIPResolver([]string{"10.0.0.0"}, "x-forwarded-for")
+	assert.Error(t, err)
+	_, err = NewClientIPResolver([]string{"10.0.0.0/8"}, "x-real-ip")
+	assert.Error(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		resolver *ClientIPResolver
+		peer     string
+		headers  map[string][]string
+		expected string
+	}{
+		{name: "direct client", peer: "198.51.100.4:40000", expected: "198.51.100.4"},
+		{name: "untrusted peer can't claim an address", peer: "198.51.100.4:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7"}}, expected: "198.51.100.4"},
+		{name: "trusted ingress", peer: "10.0.0.2:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7"}}, expected: "203.0.113.7"},
+		{name: "spoofed hops left of the client are ignored", peer: "10.0.0.2:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"192.0.2.1, 203.0.113.7", "10.1.0.1"}}, expected: "203.0.113.7"},
+		{name: "only trusted hops", peer: "10.0.0.2:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"10.2.0.1, 10.1.0.1"}}, expected: "10.2.0.1"},
+		{name: "trusted peer without headers", peer: "10.0.0.2:40000", expected: "10.0.0.2"},
+		{name: "unknown hop", peer: "10.0.0.2:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7, unknown, 10.1.0.1"}}, expected: "10.1.0.1"},
+		{name: "forged forwarded behind an x-forwarded-for proxy", peer: "10.0.0.2:40000",
+			headers: map[string][]string{
+				"Forwarded":       {"for=192.0.2.1"},
+				"X-Forwarded-For": {"203.0.113.7"},
+			}, expected: "203.0.113.7"},
+		{name: "forwarded", resolver: forwarded, peer: "[fd00::2]:40000",
+			headers: map[string][]string{
+				"Forwarded": {`for=192.0.2.60;proto=https, For="[2001:db8:cafe::17]:4711"`},
+			}, expected: "2001:db8:cafe::17"},
+		{name: "forged x-forwarded-for behind a forwarded proxy", resolver: forwarded, peer: "10.0.0.2:40000",
+			headers: map[string][]string{
+				"Forwarded":       {"for=203.0.113.7"},
+				"X-Forwarded-For": {"192.0.2.1"},
+			}, expected: "203.0.113.7"},
+		{name: "forwarded with port", resolver: forwarded, peer: "10.0.0.2:40000",
+			headers: map[string][]string{"Forwarded": {`for="203.0.113.7:4711";by=10.0.0.2`}}, expected: "203.0.113.7"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/bucket/key", nil)
+			req.RemoteAddr = tc.peer
+			for k, v := range tc.headers {
+				req.Header[k] = v
+			}
+			resolver := tc.resolver
+			if resolver == nil {
+				resolver = xff
+			}
+			assert.Equal(t, tc.expected, resolver.ClientIP(req).String())
+		})
+	}
+
+	// Without a resolver no proxy is trusted
+	var none *ClientIPResolver
+	req := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/", nil)
+	req.RemoteAddr = "10.0.0.2:40000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	assert.Equal(t, "10.0.0.2", none.ClientIP(req).String())
+}
+
+func TestHandlerForwardsClientIP(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: default
+    endpoint: `+strings.TrimPrefix(upstream.URL, "http://")+`
+    scheme: http
+default: default
+`)
+	h.ClientIPs, _ = NewClientIPResolver([]string{"10.0.0.0/8"}, "x-forwarded-for")
+
+	serve := func(peer string, headers map[string]string) {
+		req := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/bucket/key", nil)
+		req.Header.Set("Authorization", testAuthHeader)
+		req.RemoteAddr = peer
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The ingress hop is appended to the chain it sent
+	serve("10.0.0.2:40000", map[string]string{"X-Forwarded-For": "203.0.113.7"})
+	assert.Equal(t, "203.0.113.7, 10.0.0.2", received.Get("X-Forwarded-For"))
+	serve("10.0.0.2:40000", map[string]string{"X-Forwarded-For": "203.0.113.7", "Forwarded": "for=192.0.2.1"})
+	assert.Equal(t, "203.0.113.7, 10.0.0.2", received.Get("X-Forwarded-For"))
+
+	// Headers of untrusted peers are replaced
+	serve("198.51.100.4:40000", map[string]string{"X-Forwarded-For": "203.0.113.7", "Forwarded": "for=203.0.113.7"})
+	assert.Equal(t, "198.51.100.4", received.Get("X-Forwarded-For"))
+	assert.Empty(t, received.Get("Forwarded"))
+}
+
+func TestHandlerEnforcesAllowedSourceSubnet(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, routingConfigFor(upstream))
+	h.ClientIPs, _ = NewClientIPResolver([]string{"10.0.0.0/8"}, "x-forwarded-for")
+	serve := func(peer, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/bucket/key", nil)
+		req.Header.Set("Authorization", testAuthHeader)
+		req.RemoteAddr = peer
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Every source is allowed without allowed subnets
+	assert.Equal(t, http.StatusOK, serve("198.51.100.4:40000", ""))
+
+	_, allowed, _ := net.ParseCIDR("203.0.113.0/24")
+	h.AllowedSourceSubnet = []*net.IPNet{allowed}
+	assert.Equal(t, http.StatusOK, serve("203.0.113.7:40000", ""))
+	assert.Equal(t, http.StatusOK, serve("10.0.0.2:40000", "203.0.113.7"))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+
+	// Clients outside the subnets are denied before the upstream is asked, a header of an untrusted peer doesn't help
+	assert.Equal(t, http.StatusForbidden, serve("198.51.100.4:40000", ""))
+	assert.Equal(t, http.StatusForbidden, serve("198.51.100.4:40000", "203.0.113.7"))
+	assert.Equal(t, http.StatusForbidden, serve("10.0.0.2:40000", "198.51.100.4"))
+	assert.Equal(t, http.StatusForbidden, serve("10.0.0.2:40000", ""))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"context"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"time"
+)
+
+const (
+	hedgeWinnerPrimary = "primary"
+	hedgeWinnerHedge   = "hedge"
+)
+
+var (
+	hedgeEligible = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_hedge_eligible_requests_total",
+		Help: "GET and HEAD requests to upstreams with hedging enabled.",
+	}, []string{"upstream"})
+	hedgeRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_hedged_requests_total",
+		Help: "Requests a second request was sent to another backend for.",
+	}, []string{"upstream"})
+	hedgeWins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_hedge_wins_total",
+		Help: "Hedged requests by whether the primary or the hedged request answered first.",
+	}, []string{"upstream", "winner"})
+)
+
+func init() {
+	prometheus.MustRegister(hedgeEligible, hedgeRequests, hedgeWins)
+}
+
+// hedgeResult is the outcome of one of the attempts of a hedged request
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	hedged bool
+
+	// cancel cancels the context of the attempt, the body of its response can't be read afterwards
+	cancel context.CancelFunc
+}
+
+// hedge sends req to a backend and, when no response headers arrived within the hedging delay of the upstream, a
+// re-signed copy to another backend. The first response wins and the other attempt is cancelled. An attempt that
+// fails waits for the other one.
+func (t *backendTransport) hedge(req *http.Request, r *route, tried *triedBackends) (*http.Response, error) {
+	target := r.upstream
+	hedgeEligible.WithLabelValues(target.Name).Inc()
+
+	results := make(chan hedgeResult, 2)
+	cancels := make(map[bool]context.CancelFunc, 2)
+	start := func(attempt *http.Request, hedged bool) {
+		ctx, cancel := context.WithCancel(attempt.Context())
+		cancels[hedged] = cancel
+		go func() {
+			sent := time.Now()
+			resp, err := t.send(attempt.WithContext(ctx), target, r.hashKey, tried)
+			switch {
+			case err == nil:
+				target.Hedge.Observe(time.Since(sent))
+			case ctx.Err() != nil:
+				// The attempt lost or the client gave up, its latency is at least the time it ran
+				target.Hedge.ObserveCensored(time.Since(sent))
+			}
+			results <- hedgeResult{resp: resp, err: err, hedged: hedged, cancel: cancel}
+		}()
+	}
+	start(req, false)
+	pending := 1
+
+	timer := time.NewTimer(target.Hedge.Delay())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if !tried.available(target.Pool, r.hashKey) {
+				continue
+			}
+			attempt, err := hedgeRequest(req, r)
+			if err != nil {
+				t.log.Sugar().Infow("unable to hedge request", "upstream", target.Name, "error", err.Error())
+				continue
+			}
+			hedgeRequests.WithLabelValues(target.Name).Inc()
+			start(attempt, true)
+			pending++
+		case res := <-results:
+			pending--
+			if res.err != nil && pending > 0 {
+				res.cancel()
+				continue
+			}
+			if pending > 0 {
+				// The other attempt lost, its response is discarded once it arrives
+				cancels[!res.hedged]()
+				go func() {
+					if lost := <-results; lost.resp != nil {
+						_ = lost.resp.Body.Close()
+					}
+				}()
+			}
+			if len(cancels) > 1 {
+				winner := hedgeWinnerPrimary
+				if res.hedged {
+					winner = hedgeWinnerHedge
+				}
+				hedgeWins.WithLabelValues(target.Name, winner).Inc()
+			}
+			if res.err != nil {
+				res.cancel()
+				return nil, res.err
+			}
+			// The attempt stays alive until the response body has been streamed to the client
+			res.resp.Body = &releaseOnClose{ReadCloser: res.resp.Body, release: res.cancel}
+			return res.resp, nil
+		}
+	}
+}
+
+// hedgeRequest copies req for another backend, signed again over the same headers so the signature date is fresh
+func hedgeRequest(req *http.Request, r *route) (*http.Request, error) {
+	attempt := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		attempt.Body = body
+	}
+	if r.signer == nil {
+		return attempt, nil
+	}
+	if err := proxy.ResignRequest(r.signer, attempt, r.upstream.Region); err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
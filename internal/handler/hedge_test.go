@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandlerHedgesSlowReads(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		_, _ = w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	var mu sync.Mutex
+	var fastAuth []string
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fastAuth = append(fastAuth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		_, _ = w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: hedged
+    endpoint: s3.example.com
+    scheme: http
+    backends:
+      - `+strings.TrimPrefix(slow.URL, "http://")+`
+      - `+strings.TrimPrefix(fast.URL, "http://")+`
+    hedge:
+      percentile: 95
+      min_delay: 1ms
+      max_delay: 20ms
+default: hedged
+`)
+	hedged := testutil.ToFloat64(hedgeRequests.WithLabelValues("hedged"))
+	wins := testutil.ToFloat64(hedgeWins.WithLabelValues("hedged", hedgeWinnerHedge))
+
+	// Round robin sends every other request to the slow backend first
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "fast", rec.Body.String())
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	}
+	assert.Equal(t, hedged+2, testutil.ToFloat64(hedgeRequests.WithLabelValues("hedged")))
+	assert.Equal(t, wins+2, testutil.ToFloat64(hedgeWins.WithLabelValues("hedged", hedgeWinnerHedge)))
+	mu.Lock()
+	for _, auth := range fastAuth {
+		assert.Contains(t, auth, "Credential=AKID/")
+	}
+	mu.Unlock()
+
+	// Writes are never hedged
+	for i := 0; i < 2; i++ {
+		rec := serveTestRequest(h, http.MethodPut, "http://proxy.example.com/bucket/key", "data")
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	assert.Equal(t, hedged+2, testutil.ToFloat64(hedgeRequests.WithLabelValues("hedged")))
+}
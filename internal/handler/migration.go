@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/proxy"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// maxErrorBytes bounds the error bodies read to find their code
+const maxErrorBytes = 64 << 10
+
+var (
+	migrationFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_migration_fallbacks_total",
+		Help: "Reads of keys missing from the routed upstream retried against the upstream of a migration, by result.",
+	}, []string{"migration", "result"})
+	migrationCopies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_migration_copies_total",
+		Help: "Objects found on the upstream of a migration copied forward to the routed upstream, by result.",
+	}, []string{"migration", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(migrationFallbacks, migrationCopies)
+}
+
+// migrationTransport retries GET and HEAD requests for keys the routed upstream answers NoSuchKey for against
+// the upstream the bucket is migrated from. Objects found there are copied forward in the background when the
+// migration asks for it.
+type migrationTransport struct {
+	log        *zap.Logger
+	base       http.RoundTripper
+	replicator *Replicator
+
+	// copies bounds the copies in flight, reads beyond it are served without copying
+	copies chan struct{}
+
+	mu      sync.Mutex
+	copying map[string]bool
+}
+
+func newMigrationTransport(log *zap.Logger, base http.RoundTripper, replicator *Replicator, maxCopies int) *migrationTransport {
+	return &migrationTransport{
+		log:        log,
+		base:       base,
+		replicator: replicator,
+		copies:     make(chan struct{}, maxCopies),
+		copying:    make(map[string]bool),
+	}
+}
+
+func (t *migrationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := routeFromContext(req.Context())
+	if r == nil || r.migration == nil || r.migration.From == r.upstream || r.location.Key == "" ||
+		(req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return t.base.RoundTrip(req)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		return resp, err
+	}
+	if req.Method == http.MethodGet {
+		// HEAD responses have no body, a 404 there is taken to be a missing key
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBytes))
+		if err != nil {
+			_ = resp.Body.Close()
+			return nil, err
+		}
+		resp.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		if !bytes.Contains(body, []byte("<Code>NoSuchKey</Code>")) {
+			return resp, nil
+		}
+	}
+
+	fallback, err := fallbackRequest(req, r)
+	if err != nil {
+		return resp, nil
+	}
+	migrated, err := t.base.RoundTrip(fallback)
+	if err != nil {
+		migrationFallbacks.WithLabelValues(r.migration.Bucket, "error").Inc()
+		t.log.Sugar().Infow("unable to read missing key from migration upstream", "upstream", r.migration.From.Name,
+			"bucket", r.location.Bucket, "key", r.location.Key, "error", err.Error())
+		return resp, nil
+	}
+	if migrated.StatusCode == http.StatusNotFound {
+		migrationFallbacks.WithLabelValues(r.migration.Bucket, "missing").Inc()
+	} else {
+		migrationFallbacks.WithLabelValues(r.migration.Bucket, "found").Inc()
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if _, version := req.URL.Query()["versionId"]; r.migration.Copy && !version &&
+		(migrated.StatusCode == http.StatusOK || migrated.StatusCode == http.StatusPartialContent) {
+		t.copyForward(r)
+	}
+	return migrated, nil
+}
+
+// fallbackRequest clones req for the upstream the bucket is migrated from, addressed and signed for it
+func fallbackRequest(req *http.Request, r *route) (*http.Request, error) {
+	from := r.migration.From
+	loc := routing.Location{Bucket: r.location.Bucket, Key: r.location.Key}
+	u := *req.URL
+	u.Path = "/" + loc.Bucket + "/" + loc.Key
+	applyAddressing(&u, from, loc)
+	u.Scheme = from.Scheme
+	u.RawPath = u.Path
+
+	fallbackRoute := *r
+	fallbackRoute.upstream = from
+	fallbackRoute.hashKey = loc.HashKey(from.HashOn)
+	fallbackRoute.migration = nil
+	ctx := transport.WithTLSConfig(withRoute(req.Context(), &fallbackRoute), from.TLS)
+	fallback := req.Clone(ctx)
+	fallback.URL = &u
+	fallback.Host = u.Host
+	fallback.Body = http.NoBody
+	if r.signer != nil {
+		if err := proxy.SignRequest(r.signer, fallback, from.Region); err != nil {
+			return nil, err
+		}
+	}
+	return fallback, nil
+}
+
+// copyForward copies the object of r from the migration upstream to the routed upstream in the background, unless
+// the routed upstream got the object meanwhile. The copy is written conditionally, a client write racing it wins.
+func (t *migrationTransport) copyForward(r *route) {
+	id := r.upstream.Name + "/" + r.location.Bucket + "/" + r.location.Key
+	t.mu.Lock()
+	if t.copying[id] {
+		t.mu.Unlock()
+		return
+	}
+	select {
+	case t.copies <- struct{}{}:
+	default:
+		t.mu.Unlock()
+		migrationCopies.WithLabelValues(r.migration.Bucket, "skipped").Inc()
+		return
+	}
+	t.copying[id] = true
+	t.mu.Unlock()
+
+	entry := replicationEntry{
+		Op:        replicatePut,
+		Source:    r.migration.From.Name,
+		Target:    r.upstream.Name,
+		Bucket:    r.location.Bucket,
+		Key:       r.location.Key,
+		AccessKey: r.accessKey,
+	}
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			delete(t.copying, id)
+			t.mu.Unlock()
+			<-t.copies
+		}()
+		exists, err := t.replicator.Exists(context.Background(), entry)
+		if err == nil && exists {
+			migrationCopies.WithLabelValues(r.migration.Bucket, "skipped").Inc()
+			return
+		}
+		copied := false
+		if err == nil {
+			copied, err = t.replicator.CopyIfAbsent(context.Background(), entry)
+		}
+		if err == nil && !copied {
+			migrationCopies.WithLabelValues(r.migration.Bucket, "skipped").Inc()
+			return
+		}
+		if err != nil {
+			migrationCopies.WithLabelValues(r.migration.Bucket, "failed").Inc()
+			t.log.Sugar().Warnw("unable to copy migrated object forward", "upstream", entry.Target,
+				"bucket", entry.Bucket, "key", entry.Key, "error", err.Error())
+			return
+		}
+		migrationCopies.WithLabelValues(r.migration.Bucket, "copied").Inc()
+	}()
+}
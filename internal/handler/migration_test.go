@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerMigrationFallback(t *testing.T) {
+	newStore, next := newObjectStore()
+	defer next.Close()
+	legacyStore, legacy := newObjectStore()
+	defer legacy.Close()
+	legacyStore.objects["/moving/old"] = "legacy data"
+	legacyStore.objects["/other/old"] = "legacy data"
+	legacyStore.headers["/moving/old"] = http.Header{"Content-Type": {"text/plain"}}
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: next
+    endpoint: `+strings.TrimPrefix(next.URL, "http://")+`
+    scheme: http
+  - name: legacy
+    endpoint: `+strings.TrimPrefix(legacy.URL, "http://")+`
+    scheme: http
+default: next
+migrations:
+  - bucket: moving
+    from: legacy
+    copy: true
+`)
+	log, _ := zap.NewDevelopment()
+	base := &backendTransport{log: log, base: transport.NewUpstreamTransport(transport.UpstreamConfig{})}
+	replicator, _ := NewReplicator(log, h.Routes(), h.AuthCache, base, "", time.Second, time.Second)
+	h.Proxies = NewProxyRegistry(newMigrationTransport(log, base, replicator, 4), 0)
+	found := testutil.ToFloat64(migrationFallbacks.WithLabelValues("moving", "found"))
+
+	rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/moving/old", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "legacy data", rec.Body.String())
+	assert.Equal(t, found+1, testutil.ToFloat64(migrationFallbacks.WithLabelValues("moving", "found")))
+	assert.Eventually(t, func() bool {
+		body, _ := newStore.get("/moving/old")
+		return body == "legacy data"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "text/plain", newStore.headers["/moving/old"].Get("Content-Type"))
+
+	// Keys missing from both upstreams keep the answer of the routed upstream
+	rec = serveTestRequest(h, http.MethodHead, "http://proxy.example.com/moving/missing", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = serveTestRequest(h, http.MethodGet, "http://proxy.example.com/moving/missing", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), "NoSuchKey")
+
+	// Buckets without a migration never fall back
+	rec = serveTestRequest(h, http.MethodGet, "http://proxy.example.com/other/old", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestMigrationCopyLosesToRacingWrite(t *testing.T) {
+	newStore, next := newObjectStore()
+	defer next.Close()
+	legacyStore, legacy := newObjectStore()
+	defer legacy.Close()
+	legacyStore.objects["/moving/raced"] = "legacy data"
+	reads := 0
+	legacyStore.beforeRead = func(r *http.Request) {
+		// A client writes the object to the new upstream after the copy checked for it and before it is written
+		if reads++; reads == 2 {
+			newStore.mu.Lock()
+			newStore.objects["/moving/raced"] = "client data"
+			newStore.mu.Unlock()
+		}
+	}
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: next
+    endpoint: `+strings.TrimPrefix(next.URL, "http://")+`
+    scheme: http
+  - name: legacy
+    endpoint: `+strings.TrimPrefix(legacy.URL, "http://")+`
+    scheme: http
+default: next
+migrations:
+  - bucket: moving
+    from: legacy
+    copy: true
+`)
+	log, _ := zap.NewDevelopment()
+	base := &backendTransport{log: log, base: transport.NewUpstreamTransport(transport.UpstreamConfig{})}
+	replicator, _ := NewReplicator(log, h.Routes(), h.AuthCache, base, "", time.Second, time.Second)
+	h.Proxies = NewProxyRegistry(newMigrationTransport(log, base, replicator, 4), 0)
+	skipped := testutil.ToFloat64(migrationCopies.WithLabelValues("moving", "skipped"))
+
+	rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/moving/raced", "")
+	assert.Equal(t, "legacy data", rec.Body.String())
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(migrationCopies.WithLabelValues("moving", "skipped")) == skipped+1
+	}, time.Second, 10*time.Millisecond)
+	body, _ := newStore.get("/moving/raced")
+	assert.Equal(t, "client data", body)
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	mirrorRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_mirror_requests_total",
+		Help: "Mirrored requests by shadow upstream and whether the shadow status matched the primary, failed, was dropped or its primary aborted.",
+	}, []string{"upstream", "result"})
+	mirrorStatus = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_mirror_status_total",
+		Help: "Mirrored requests by the status code of the primary and the shadow upstream.",
+	}, []string{"upstream", "primary", "shadow"})
+	mirrorLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "s3proxy_mirror_latency_seconds",
+		Help:    "Time until the full response of mirrored requests was received, by side.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"upstream", "side"})
+)
+
+func init() {
+	prometheus.MustRegister(mirrorRequests, mirrorStatus, mirrorLatency)
+}
+
+// Mirror replays requests against shadow upstreams in the background and compares the outcome with the primary.
+// Shadow responses are discarded, they never reach the client.
+type Mirror struct {
+	log       *zap.Logger
+	transport http.RoundTripper
+	timeout   time.Duration
+
+	// slots bounds the shadow requests in flight, requests beyond it are dropped rather than queued
+	slots chan struct{}
+}
+
+// NewMirror builds a Mirror sending through transport, shadow requests are cancelled after timeout
+func NewMirror(log *zap.Logger, transport http.RoundTripper, timeout time.Duration, maxInFlight int) *Mirror {
+	return &Mirror{log: log, transport: transport, timeout: timeout, slots: make(chan struct{}, maxInFlight)}
+}
+
+type primaryOutcome struct {
+	status  int
+	latency time.Duration
+	aborted bool
+}
+
+// shadowRequest is a mirrored request in flight
+type shadowRequest struct {
+	primary chan primaryOutcome
+}
+
+// Start sends req to the shadow upstream named upstream in the background. req must not be tied to the client
+// context. It returns nil when the request was dropped.
+func (m *Mirror) Start(upstream string, req *http.Request) *shadowRequest {
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		mirrorRequests.WithLabelValues(upstream, "dropped").Inc()
+		return nil
+	}
+	s := &shadowRequest{primary: make(chan primaryOutcome, 1)}
+	go func() {
+		defer func() { <-m.slots }()
+		ctx, cancel := context.WithTimeout(req.Context(), m.timeout)
+		defer cancel()
+
+		start := time.Now()
+		resp, err := m.transport.RoundTrip(req.WithContext(ctx))
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		latency := time.Since(start)
+
+		primary := <-s.primary
+		if primary.aborted {
+			mirrorRequests.WithLabelValues(upstream, "aborted").Inc()
+			return
+		}
+		mirrorLatency.WithLabelValues(upstream, "primary").Observe(primary.latency.Seconds())
+		if err != nil {
+			m.log.Sugar().Debugw("mirrored request failed", "upstream", upstream, "path", req.URL.Path, "error", err.Error())
+			mirrorRequests.WithLabelValues(upstream, "error").Inc()
+			return
+		}
+		mirrorLatency.WithLabelValues(upstream, "shadow").Observe(latency.Seconds())
+		mirrorStatus.WithLabelValues(upstream, strconv.Itoa(primary.status), strconv.Itoa(resp.StatusCode)).Inc()
+		result := "match"
+		if primary.status != resp.StatusCode {
+			result = "mismatch"
+			m.log.Sugar().Debugw("mirrored request status differs", "upstream", upstream, "path", req.URL.Path,
+				"primary", primary.status, "shadow", resp.StatusCode)
+		}
+		mirrorRequests.WithLabelValues(upstream, result).Inc()
+	}()
+	return s
+}
+
+// Finish hands the outcome of the primary request to the comparison, safe to call on a dropped request
+func (s *shadowRequest) Finish(status int, latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.primary <- primaryOutcome{status: status, latency: latency}
+}
+
+// Abort tells the comparison the primary request broke off without an outcome, safe to call on a dropped request
+func (s *shadowRequest) Abort() {
+	if s == nil {
+		return
+	}
+	s.primary <- primaryOutcome{aborted: true}
+}
+
+// statusRecorder remembers the status code written to the client
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the client connection
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
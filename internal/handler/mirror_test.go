@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerMirrorsReads(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	shadowed := make(chan *http.Request, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shadowed <- r
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: primary
+    endpoint: `+strings.TrimPrefix(primary.URL, "http://")+`
+    scheme: http
+  - name: shadow
+    endpoint: `+strings.TrimPrefix(shadow.URL, "http://")+`
+    scheme: http
+    region: us-west-1
+default: primary
+mirrors:
+  - match:
+      bucket: mirrored
+    upstream: shadow
+`)
+	log, _ := zap.NewDevelopment()
+	h.Mirror = NewMirror(log, &backendTransport{log: log, base: http.DefaultTransport}, time.Second, 10)
+	mismatches := testutil.ToFloat64(mirrorRequests.WithLabelValues("shadow", "mismatch"))
+
+	rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/mirrored/key", "")
+	assert.Equal(t, "primary", rec.Body.String())
+	select {
+	case r := <-shadowed:
+		assert.Equal(t, "/mirrored/key", r.URL.Path)
+		assert.Contains(t, r.Header.Get("Authorization"), "/us-west-1/s3/")
+	case <-time.After(time.Second):
+		t.Fatal("request was not mirrored")
+	}
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(mirrorRequests.WithLabelValues("shadow", "mismatch")) == mismatches+1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(1), testutil.ToFloat64(mirrorStatus.WithLabelValues("shadow", "200", "404")))
+
+	// Writes and other buckets are never mirrored
+	serveTestRequest(h, http.MethodPut, "http://proxy.example.com/mirrored/key", "data")
+	serveTestRequest(h, http.MethodGet, "http://proxy.example.com/other/key", "")
+	select {
+	case r := <-shadowed:
+		t.Fatalf("unexpected mirrored %s %s", r.Method, r.URL.Path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHandlerMirrorAbortedPrimary(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Promise more than is sent and drop the connection mid body
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		_ = conn.Close()
+	}))
+	defer primary.Close()
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer shadow.Close()
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: primary
+    endpoint: `+strings.TrimPrefix(primary.URL, "http://")+`
+    scheme: http
+  - name: shadow-abort
+    endpoint: `+strings.TrimPrefix(shadow.URL, "http://")+`
+    scheme: http
+default: primary
+mirrors:
+  - match:
+      bucket: mirrored
+    upstream: shadow-abort
+`)
+	log, _ := zap.NewDevelopment()
+	h.Mirror = NewMirror(log, &backendTransport{log: log, base: http.DefaultTransport}, time.Second, 1)
+
+	req := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/mirrored/key", nil)
+	req.Header.Set("Authorization", testAuthHeader)
+	// Under an http.Server ReverseProxy aborts the handler when copying the body fails
+	req = req.WithContext(context.WithValue(req.Context(), http.ServerContextKey, &http.Server{}))
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	})
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(mirrorRequests.WithLabelValues("shadow-abort", "aborted")) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return len(h.Mirror.slots) == 0 }, time.Second, 10*time.Millisecond)
+}
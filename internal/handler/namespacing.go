@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var errAccessDenied = errors.New("access denied")
+
+var (
+	// namespacedListingParams are the query parameters bucket requests on a namespaced bucket may carry, anything
+	// else could read or change state outside the prefix of the identity
+	namespacedListingParams = map[string]bool{
+		"prefix": true, "delimiter": true, "marker": true, "max-keys": true, "encoding-type": true,
+		"list-type": true, "continuation-token": true, "fetch-owner": true, "start-after": true,
+		"key-marker": true, "version-id-marker": true, "upload-id-marker": true, "max-uploads": true,
+		"versions": true, "uploads": true, "location": true,
+	}
+
+	// keyElementRegexp matches the elements naming a key or key prefix in listing, multipart and error bodies
+	keyElementRegexp = regexp.MustCompile(
+		`<(Key|Prefix|StartAfter|Marker|NextMarker|KeyMarker|NextKeyMarker)>([^<]*)</(Key|Prefix|StartAfter|Marker|NextMarker|KeyMarker|NextKeyMarker)>`)
+)
+
+// namespacePrefix returns the key prefix the identity behind accessKey is confined to in a client visible bucket,
+// empty when the bucket has no namespace. Namespaced buckets deny unsigned requests and identities without a user.
+func (h *Handler) namespacePrefix(routes *routing.Table, bucket, accessKey string) (string, error) {
+	if routes == nil || bucket == "" {
+		return "", nil
+	}
+	ns := routes.Namespace(bucket)
+	if ns == nil {
+		return "", nil
+	}
+	if accessKey == "" {
+		return "", fmt.Errorf("%w: unsigned request for namespaced bucket %s", errAccessDenied, bucket)
+	}
+	user := ""
+	if ns.UsesUser() {
+		var err error
+		if user, err = h.AuthCache.GetUser(accessKey); err != nil {
+			return "", fmt.Errorf("%w: no user for access key in namespaced bucket %s: %s", errAccessDenied, bucket, err)
+		}
+	}
+	prefix, err := ns.Prefix(user, accessKey)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errAccessDenied, err)
+	}
+	return prefix, nil
+}
+
+// namespaceLocation confines a request to prefix. Object keys are prefixed in loc and in the path, bucket requests
+// are limited to listings whose prefix and markers are prefixed.
+func namespaceLocation(proxyURL *url.URL, method string, loc routing.Location, prefix string) (routing.Location, error) {
+	if loc.Key != "" {
+		if !isConfinedKey(loc.Key) {
+			return loc, fmt.Errorf("%w: key %q leaves its namespace", errAccessDenied, loc.Key)
+		}
+		loc.Key = prefix + loc.Key
+		if loc.VirtualHost {
+			proxyURL.Path = "/" + loc.Key
+		} else {
+			proxyURL.Path = "/" + loc.Bucket + "/" + loc.Key
+		}
+		return loc, nil
+	}
+
+	if method != http.MethodGet && method != http.MethodHead {
+		return loc, fmt.Errorf("%w: %s on namespaced bucket %s", errAccessDenied, method, loc.Bucket)
+	}
+	query := proxyURL.Query()
+	for name := range query {
+		if !namespacedListingParams[name] {
+			return loc, fmt.Errorf("%w: %s on namespaced bucket %s", errAccessDenied, name, loc.Bucket)
+		}
+	}
+	if _, ok := query["location"]; ok || method == http.MethodHead {
+		return loc, nil
+	}
+	query.Set("prefix", prefix+query.Get("prefix"))
+	for _, name := range []string{"marker", "start-after", "key-marker"} {
+		if value := query.Get(name); value != "" {
+			query.Set(name, prefix+value)
+		}
+	}
+	proxyURL.RawQuery = query.Encode()
+	return loc, nil
+}
+
+// parseCopySource decodes an x-amz-copy-source value formatted as [/]bucket/key[?versionId=] as a whole, the way the
+// gateway does, so the bucket and key are the ones the gateway copies from however they were encoded
+func parseCopySource(value string) (bucket, key, query string, err error) {
+	path := value
+	if i := strings.Index(value, "?"); i >= 0 {
+		path, query = value[:i], value[i:]
+	}
+	decoded, err := url.PathUnescape(path)
+	if err != nil {
+		return "", "", "", fmt.Errorf("%w: copy source %q is not url encoded", errAccessDenied, value)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(decoded, "/"), "/", 2)
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	return parts[0], key, query, nil
+}
+
+// formatCopySource encodes a decoded copy source again, the key is url encoded segment by segment
+func formatCopySource(bucket, key, query string) string {
+	return "/" + bucket + "/" + escapeKey(key) + query
+}
+
+// namespaceCopySource prefixes the key of an x-amz-copy-source value formatted as [/]bucket/key[?versionId=]
+func namespaceCopySource(value, prefix string) (string, error) {
+	bucket, key, query, err := parseCopySource(value)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		return "", fmt.Errorf("%w: copy source %q names no key", errAccessDenied, value)
+	}
+	if !isConfinedKey(key) {
+		return "", fmt.Errorf("%w: copy source %q leaves its namespace", errAccessDenied, value)
+	}
+	return formatCopySource(bucket, prefix+key, query), nil
+}
+
+// namespaceCopySourceOf prefixes the copy source when its bucket is namespaced, with the prefix of the same identity.
+// The value is returned decoded and encoded again, later steps find the bucket by its plain name.
+func (h *Handler) namespaceCopySourceOf(routes *routing.Table, value, accessKey string) (string, error) {
+	bucket, key, query, err := parseCopySource(value)
+	if err != nil {
+		return "", err
+	}
+	prefix, err := h.namespacePrefix(routes, bucket, accessKey)
+	if err != nil {
+		return "", err
+	}
+	if prefix == "" {
+		return formatCopySource(bucket, key, query), nil
+	}
+	return namespaceCopySource(value, prefix)
+}
+
+// isListParts reports whether req lists the parts of a multipart upload, an object request answered with xml
+func isListParts(req *http.Request) bool {
+	_, ok := req.URL.Query()["uploadId"]
+	return ok && req.Method == http.MethodGet
+}
+
+// isConfinedKey rejects keys with . or .. segments, a gateway normalising the path could resolve them outside the
+// prefix they are appended to
+func isConfinedKey(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeKey url encodes every segment of a key and keeps the slashes, the form S3 uses for encoded keys
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// stripNamespace removes prefix from the keys, key prefixes and markers of an xml body, in the plain, xml escaped
+// and url encoded forms listings with encoding-type=url return
+func stripNamespace(body []byte, prefix string) []byte {
+	forms := []string{html.EscapeString(prefix), escapeKey(prefix)}
+	body = keyElementRegexp.ReplaceAllFunc(body, func(element []byte) []byte {
+		m := keyElementRegexp.FindSubmatch(element)
+		value := string(m[2])
+		for _, form := range forms {
+			if strings.HasPrefix(value, form) {
+				value = strings.TrimPrefix(value, form)
+				break
+			}
+		}
+		return []byte("<" + string(m[1]) + ">" + value + "</" + string(m[3]) + ">")
+	})
+	return referenceElementRegexp.ReplaceAllFunc(body, func(element []byte) []byte {
+		m := referenceElementRegexp.FindSubmatch(element)
+		value := string(m[2])
+		for _, form := range forms {
+			if strings.Contains(value, "/"+form) {
+				value = strings.Replace(value, "/"+form, "/", 1)
+				break
+			}
+		}
+		return []byte("<" + string(m[1]) + ">" + value + "</" + string(m[3]) + ">")
+	})
+}
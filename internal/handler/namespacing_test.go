@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNamespaceCopySource(t *testing.T) {
+	value, err := namespaceCopySource("/shared/some%20key?versionId=1", "teams/a b/")
+	assert.NoError(t, err)
+	assert.Equal(t, "/shared/teams/a%20b/some%20key?versionId=1", value)
+	_, err = namespaceCopySource("shared/../other/key", "teams/alice/")
+	assert.ErrorIs(t, err, errAccessDenied)
+	_, err = namespaceCopySource("shared", "teams/alice/")
+	assert.ErrorIs(t, err, errAccessDenied)
+	_, err = namespaceCopySource("/shared/%2e%2e/other/key", "teams/alice/")
+	assert.ErrorIs(t, err, errAccessDenied)
+	_, err = namespaceCopySource("/shared/%zz", "teams/alice/")
+	assert.ErrorIs(t, err, errAccessDenied)
+}
+
+func TestStripNamespace(t *testing.T) {
+	body := stripNamespace([]byte(`<ListBucketResult><Prefix>teams/alice/</Prefix><Marker>teams/alice/a</Marker>`+
+		`<Contents><Key>teams/alice/a%20b</Key></Contents><CommonPrefixes><Prefix>teams/alice/dir/</Prefix></CommonPrefixes>`+
+		`<Contents><Key>other</Key></Contents></ListBucketResult>`), "teams/alice/")
+	assert.Equal(t, `<ListBucketResult><Prefix></Prefix><Marker>a</Marker><Contents><Key>a%20b</Key></Contents>`+
+		`<CommonPrefixes><Prefix>dir/</Prefix></CommonPrefixes><Contents><Key>other</Key></Contents></ListBucketResult>`, string(body))
+
+	body = stripNamespace([]byte(`<Error><Key>teams/alice/missing</Key><Resource>/shared/teams/alice/missing</Resource></Error>`), "teams/alice/")
+	assert.Equal(t, `<Error><Key>missing</Key><Resource>/shared/missing</Resource></Error>`, string(body))
+}
+
+func TestHandlerNamespaces(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.Header().Set("Content-Type", "application/xml")
+		if r.URL.Path == "/shared" || r.URL.Path == "/shared/" {
+			_, _ = w.Write([]byte(`<ListBucketResult><Name>shared</Name><Prefix>` + r.URL.Query().Get("prefix") + `</Prefix>` +
+				`<Contents><Key>teams/alice/docs/a</Key></Contents></ListBucketResult>`))
+			return
+		}
+		_, _ = w.Write([]byte(`<Key>teams/alice/docs/a</Key>`))
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, `
+domains: [object.lga1.example.com]
+upstreams:
+  - name: test
+    endpoint: `+strings.TrimPrefix(upstream.URL, "http://")+`
+    scheme: http
+    addressing: path
+default: test
+namespaces:
+  - bucket: shared
+    prefix: "teams/{user}/"
+`)
+
+	rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/shared/docs/a", "")
+	assert.Equal(t, "/shared/teams/alice/docs/a", received.URL.Path)
+	// Object bodies are passed through untouched
+	assert.Equal(t, `<Key>teams/alice/docs/a</Key>`, rec.Body.String())
+
+	serveTestRequest(h, http.MethodPut, "http://shared.object.lga1.example.com/docs/b", "data")
+	assert.Equal(t, "/shared/teams/alice/docs/b", received.URL.Path)
+
+	rec = serveTestRequest(h, http.MethodGet, "http://proxy.example.com/shared?list-type=2&prefix=docs/&start-after=docs/0", "")
+	assert.Equal(t, "teams/alice/docs/", received.URL.Query().Get("prefix"))
+	assert.Equal(t, "teams/alice/docs/0", received.URL.Query().Get("start-after"))
+	assert.Equal(t, `<ListBucketResult><Name>shared</Name><Prefix>docs/</Prefix><Contents><Key>docs/a</Key></Contents></ListBucketResult>`,
+		rec.Body.String())
+
+	req := httptest.NewRequest(http.MethodPut, "http://proxy.example.com/shared/docs/copy", nil)
+	req.Header.Set("Authorization", testAuthHeader)
+	req.Header.Set(copySourceHeader, "/shared/docs/a")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "/shared/teams/alice/docs/a", received.Header.Get(copySourceHeader))
+
+	// An encoded bucket name is the same bucket to the gateway
+	req = httptest.NewRequest(http.MethodPut, "http://proxy.example.com/shared/docs/copy", nil)
+	req.Header.Set("Authorization", testAuthHeader)
+	req.Header.Set(copySourceHeader, "/%73hared/teams/bob/secret")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "/shared/teams/alice/teams/bob/secret", received.Header.Get(copySourceHeader))
+
+	received = nil
+	for _, target := range []string{
+		"http://proxy.example.com/shared/../bob/secret",
+		"http://proxy.example.com/shared?acl",
+	} {
+		rec = serveTestRequest(h, http.MethodGet, target, "")
+		assert.Equal(t, http.StatusForbidden, rec.Code, target)
+		assert.Contains(t, rec.Body.String(), "<Code>AccessDenied</Code>")
+	}
+	assert.Equal(t, http.StatusForbidden, serveTestRequest(h, http.MethodPost, "http://proxy.example.com/shared?delete", "").Code)
+	assert.Equal(t, http.StatusForbidden, serveTestRequest(h, http.MethodDelete, "http://proxy.example.com/shared", "").Code)
+
+	unsigned := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/shared/docs/a", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, unsigned)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Nil(t, received)
+}
@@ -2,13 +2,17 @@ package handler
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/coreweave/aws-s3-reverse-proxy/internal"
 	"github.com/coreweave/aws-s3-reverse-proxy/internal/cfg"
 	"github.com/coreweave/aws-s3-reverse-proxy/internal/proxy"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
 	"go.uber.org/zap"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -16,6 +20,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -30,14 +36,20 @@ type Handler struct {
 	// Zap Logger
 	log *zap.Logger
 
-	// handler or https
+	// http or https, used without a routing table. Empty uses the scheme the client connected with.
 	UpstreamScheme string
 
+	// TLS settings of the upstream, used without a routing table
+	UpstreamTLS *tls.Config
+
 	// Upstream S3 endpoint URL
 	UpstreamEndpoint string
 
-	// Experimental -- Upstream prefix to swap
-	UpstreamProxyHelper *UpstreamHelper
+	// upstreams holds the *upstreamConfig requests are routed by, a reload swaps it
+	upstreams atomic.Value
+
+	// reloader rebuilds the routing table from its config file, nil without a routing config
+	reloader *routingReloader
 
 	// Allowed endpoint, i.e., Host header to accept incoming requests from
 	AllowedSourceEndpoint string
@@ -45,8 +57,14 @@ type Handler struct {
 	// Allowed source IPs and subnets for incoming requests
 	AllowedSourceSubnet []*net.IPNet
 
+	// ClientIPs finds the client address behind trusted proxies, nil trusts none
+	ClientIPs *ClientIPResolver
+
 	// Reverse Proxies
-	Proxies map[url.URL]*httputil.ReverseProxy
+	Proxies *ProxyRegistry
+
+	// Mirror replays requests matching a mirror of the routing table, nil disables mirroring
+	Mirror *Mirror
 
 	//Auth Header parser
 	AuthParser *AccessKeyParser
@@ -56,13 +74,30 @@ type Handler struct {
 }
 
 // NewAwsS3ReverseProxy parses all options and creates a new HTTP Handler
-func NewAwsS3ReverseProxy(ctx context.Context, log *zap.Logger, opts cfg.Options, cache internal.AuthCache, https bool) (*Handler, error) {
+func NewAwsS3ReverseProxy(ctx context.Context, log *zap.Logger, opts cfg.Options, cache internal.AuthCache) (*Handler, error) {
 
-	scheme := "http"
-
-	if https {
-		scheme = "https"
+	if opts.UpstreamScheme != "" && opts.UpstreamScheme != "http" && opts.UpstreamScheme != "https" {
+		return nil, fmt.Errorf("upstream scheme must be http or https, got %q", opts.UpstreamScheme)
+	}
+	upstreamTLS, err := transport.TLSConfig{
+		CAFile:             opts.UpstreamCAFile,
+		CertFile:           opts.UpstreamCertFile,
+		KeyFile:            opts.UpstreamKeyFile,
+		InsecureSkipVerify: opts.UpstreamInsecure,
+	}.Build()
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream tls settings: %w", err)
 	}
+	if opts.UpstreamInsecure {
+		log.Warn("upstream certificate verification is disabled")
+	}
+	upstreamTransport := transport.NewUpstreamTransport(transport.UpstreamConfig{
+		DialTimeout:         opts.UpstreamDialTimeout,
+		TLSHandshakeTimeout: opts.UpstreamTLSHandshakeTimeout,
+		MaxIdleConnsPerHost: opts.UpstreamMaxIdleConnsPerHost,
+		IdleConnTimeout:     opts.UpstreamIdleConnTimeout,
+		DisableHTTP2:        opts.UpstreamDisableHTTP2,
+	})
 
 	var parsedAllowedSourceSubnet []*net.IPNet
 	for _, sourceSubnet := range opts.AllowedSourceSubnet {
@@ -73,74 +108,244 @@ func NewAwsS3ReverseProxy(ctx context.Context, log *zap.Logger, opts cfg.Options
 		parsedAllowedSourceSubnet = append(parsedAllowedSourceSubnet, subnet)
 	}
 
+	clientIPs, err := NewClientIPResolver(opts.TrustedProxies, opts.TrustedProxyHeader)
+	if err != nil {
+		return nil, err
+	}
+
 	parser := NewAccessKeyParser()
 	if opts.RgwAdminEndpoints == "" || opts.RgwAdminAccessKeys == "" || opts.RgwAdminSecretKeys == "" {
 		log.Sugar().Errorf("missing one of the rgw endpoint variables, please ensure they are set")
 		return nil, errors.New("missing required variable")
 	}
 
+	var routes *routing.Table
 	var upstreamProxyHelper *UpstreamHelper
-	var upstreamEndpoint *string
-	if len(opts.UpstreamEndpoint) != 0 {
-		upstreamEndpoint = &opts.UpstreamEndpoint
-	}
-	var upstreamReplacers []UpstreamReplacer
-	for _, val := range opts.UpstreamMatchers {
-		if upstreamReplacers == nil {
-			upstreamReplacers = make([]UpstreamReplacer, 0)
+	if opts.RoutingConfig != "" {
+		if opts.UpstreamEndpoint != "" || len(opts.UpstreamMatchers) > 0 || len(opts.ClusterUpstreams) > 0 {
+			log.Sugar().Warnf("routing config %s replaces upstream-endpoint, upstream-matchers and cluster-upstream", opts.RoutingConfig)
 		}
-		keys := strings.Split(val, ":")
-		pattern, replacePattern, replaceValue := keys[0], keys[1], keys[2]
-		levelDeep, err := strconv.ParseInt(keys[3], 10, 32)
-		if err != nil {
-			log.Sugar().Errorf("unable to parse levels value from upstream-matchers, invalid: %s", err.Error())
+		if routes, err = loadRoutingTable(log, opts.RoutingConfig, opts.UpstreamInsecure); err != nil {
+			return nil, err
+		}
+	} else {
+		if upstreamProxyHelper, err = newLegacyUpstreamHelper(log, opts, cache); err != nil {
+			log.Sugar().Errorf("unable to build upstream helper: %s", err.Error())
 			return nil, err
 		}
-		upstreamReplacers = append(upstreamReplacers, UpstreamReplacer{
-			MatchPattern:   regexp.MustCompile(pattern),
-			ReplacePattern: regexp.MustCompile(replacePattern),
-			ReplaceWith:    replaceValue,
-			LevelsDeep:     int(levelDeep),
-		})
-
 	}
-	upstreamProxyHelper, err := NewUpstreamHelper(log, upstreamEndpoint, upstreamReplacers)
+	retries, err := NewRetryTransport(log, &backendTransport{log: log, base: upstreamTransport}, RetryPolicy{
+		MaxAttempts:    opts.RetryAttempts,
+		InitialBackoff: opts.RetryInitialBackoff,
+		MaxBackoff:     opts.RetryMaxBackoff,
+		MaxBufferBytes: opts.RetryMaxBufferBytes,
+		BudgetRatio:    opts.RetryBudgetRatio,
+		BudgetBurst:    opts.RetryBudgetBurst,
+	})
 	if err != nil {
-		log.Fatal("unable to build upstream helper due to missing params")
+		return nil, err
 	}
-	proxies := make(map[url.URL]*httputil.ReverseProxy)
+	retries = &breakerTransport{base: retries}
+	var mirror *Mirror
+	var reloader *routingReloader
+	if routes != nil {
+		mirror = NewMirror(log, &backendTransport{log: log, base: upstreamTransport}, opts.MirrorTimeout, opts.MirrorMaxInFlight)
+		// Replicas and migrations are wired up even when the config has none, a reload may add them
+		replicator, err := NewReplicator(log, routes, cache, &backendTransport{log: log, base: upstreamTransport},
+			opts.ReplicationQueueDir, opts.ReplicationTimeout, opts.ReplicationMaxBackoff)
+		if err != nil {
+			return nil, err
+		}
+		replicator.Run(ctx)
+		retries = newMigrationTransport(log, retries, replicator, opts.MigrationMaxCopies)
+		retries = &replicationTransport{log: log, base: retries, replicator: replicator}
+		reloader = &routingReloader{
+			path:       opts.RoutingConfig,
+			insecure:   opts.UpstreamInsecure,
+			transport:  upstreamTransport,
+			replicator: replicator,
+		}
+	}
+	proxies := NewProxyRegistry(retries, opts.ProxyIdleTimeout)
+	proxies.Run(ctx)
 	handler := &Handler{
-		UpstreamScheme:      scheme,
+		UpstreamScheme:      opts.UpstreamScheme,
+		UpstreamTLS:         upstreamTLS,
 		UpstreamEndpoint:    opts.UpstreamEndpoint,
 		AllowedSourceSubnet: parsedAllowedSourceSubnet,
+		ClientIPs:           clientIPs,
 		AuthParser:          parser,
 		AuthCache:           cache,
 		log:                 log,
-		UpstreamProxyHelper: upstreamProxyHelper,
+		reloader:            reloader,
 		Proxies:             proxies,
+		Mirror:              mirror,
+	}
+	upstreams := &upstreamConfig{routes: routes, helper: upstreamProxyHelper}
+	if routes != nil {
+		var healthCtx context.Context
+		healthCtx, upstreams.stopHealthChecks = context.WithCancel(ctx)
+		routes.Start(healthCtx, upstreamTransport)
 	}
+	handler.storeUpstreams(upstreams)
 	return handler, nil
 }
 
+// newLegacyUpstreamHelper builds the upstream helper from the upstream-endpoint, upstream-matchers and cluster-upstream flags
+func newLegacyUpstreamHelper(log *zap.Logger, opts cfg.Options, cache internal.AuthCache) (*UpstreamHelper, error) {
+	var upstreamEndpoint *string
+	if len(opts.UpstreamEndpoint) != 0 {
+		upstreamEndpoint = &opts.UpstreamEndpoint
+	}
+	var upstreamReplacers []UpstreamReplacer
+	for _, val := range opts.UpstreamMatchers {
+		replacer, err := parseUpstreamMatcher(val)
+		if err != nil {
+			return nil, err
+		}
+		upstreamReplacers = append(upstreamReplacers, replacer)
+	}
+	clusterUpstreams := make(map[string]string)
+	for _, val := range opts.ClusterUpstreams {
+		keys := strings.SplitN(val, "=", 2)
+		if len(keys) != 2 || keys[0] == "" || keys[1] == "" {
+			return nil, fmt.Errorf("invalid cluster upstream %q, expected CLUSTER=HOST", val)
+		}
+		clusterUpstreams[keys[0]] = keys[1]
+	}
+	return NewUpstreamHelper(log, upstreamEndpoint, upstreamReplacers, clusterUpstreams, cache)
+}
+
+// parseUpstreamMatcher parses a MATCH_PATTERN:REPLACE_PATTERN:REPLACE_WITH:LEVELS_DEEP matcher or a
+// MATCH -> REPLACE host template
+func parseUpstreamMatcher(val string) (UpstreamReplacer, error) {
+	if strings.Contains(val, "->") {
+		template, err := ParseHostTemplate(val)
+		if err != nil {
+			return UpstreamReplacer{}, err
+		}
+		return UpstreamReplacer{Template: template}, nil
+	}
+	keys := strings.Split(val, ":")
+	if len(keys) != 4 {
+		return UpstreamReplacer{}, fmt.Errorf("invalid upstream matcher %q, expected MATCH_PATTERN:REPLACE_PATTERN:REPLACE_WITH:LEVELS_DEEP", val)
+	}
+	matchPattern, err := regexp.Compile(keys[0])
+	if err != nil {
+		return UpstreamReplacer{}, fmt.Errorf("invalid match pattern in upstream matcher %q: %w", val, err)
+	}
+	replacePattern, err := regexp.Compile(keys[1])
+	if err != nil {
+		return UpstreamReplacer{}, fmt.Errorf("invalid replace pattern in upstream matcher %q: %w", val, err)
+	}
+	levelDeep, err := strconv.ParseInt(keys[3], 10, 32)
+	if err != nil {
+		return UpstreamReplacer{}, fmt.Errorf("unable to parse levels value from upstream matcher %q: %w", val, err)
+	}
+	return UpstreamReplacer{
+		MatchPattern:   matchPattern,
+		ReplacePattern: replacePattern,
+		ReplaceWith:    keys[2],
+		LevelsDeep:     int(levelDeep),
+	}, nil
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.validateIncomingSourceIP(r); err != nil {
+		h.log.Sugar().Infow("request denied", "error", err.Error(), "method", r.Method, "path", r.URL.Path, "peer", r.RemoteAddr)
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "Access Denied", r.URL.Path)
+		return
+	}
 	proxyReq, err := h.BuildUpstreamRequest(r)
+	if errors.Is(err, errAccessDenied) {
+		h.log.Sugar().Infow("request denied", "error", err.Error(), "method", r.Method, "path", r.URL.Path, "client", h.ClientIPs.ClientIP(r).String())
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "Access Denied", r.URL.Path)
+		return
+	}
+	if errors.Is(err, errCircuitOpen) {
+		h.log.Sugar().Infow("upstream unavailable", "error", err.Error(), "method", r.Method, "path", r.URL.Path,
+			"client", h.ClientIPs.ClientIP(r).String())
+		writeS3Error(w, http.StatusServiceUnavailable, "ServiceUnavailable", "The upstream is temporarily unavailable.", r.URL.Path)
+		return
+	}
 	if err != nil {
-		if !errors.Is(err, internal.ErrNoAccessKeyFound) {
-			h.log.Sugar().Infow("unable to proxy request due to error", "error", err.Error(), "request", r.Header)
-			dumpReq, _ := httputil.DumpRequest(r, false)
-			h.log.Sugar().Infow("Unauthenticated request proxied", "request", string(dumpReq))
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
+		h.log.Sugar().Infow("unable to proxy request due to error", "error", err.Error(), "client", h.ClientIPs.ClientIP(r).String(),
+			"request", r.Header)
+		dumpReq, _ := httputil.DumpRequest(r, false)
+		h.log.Sugar().Infow("Unauthenticated request proxied", "request", string(dumpReq))
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
+	defer releaseUnreported(routeFromContext(proxyReq.Context()))
 	upstreamUrl := url.URL{Scheme: proxyReq.URL.Scheme, Host: proxyReq.Host}
 	h.log.Sugar().Debugf("upstreamURL found: %s://%s", upstreamUrl.Scheme, upstreamUrl.Host)
-	if _, ok := h.Proxies[upstreamUrl]; !ok {
-		h.Proxies[upstreamUrl] = httputil.NewSingleHostReverseProxy(&upstreamUrl)
-		h.Proxies[upstreamUrl].FlushInterval = -1
+	shadow := h.startShadowRequest(r)
+	var variant routing.Variant
+	if route := routeFromContext(proxyReq.Context()); route != nil {
+		variant = route.variant
+	}
+	if shadow == nil && variant.Name == "" {
+		h.Proxies.Get(upstreamUrl).ServeHTTP(w, proxyReq)
+		return
 	}
-	h.Proxies[upstreamUrl].ServeHTTP(w, proxyReq)
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w}
+	finished := false
+	defer func() {
+		// ReverseProxy panics with http.ErrAbortHandler when the upstream response breaks off, the shadow request
+		// waits for the primary and holds its slot until it hears of it
+		if !finished {
+			shadow.Abort()
+		}
+	}()
+	h.Proxies.Get(upstreamUrl).ServeHTTP(recorder, proxyReq)
+	finished = true
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	shadow.Finish(recorder.status, time.Since(start))
+	observeVariant(variant, recorder.status, time.Since(start))
+}
+
+// startShadowRequest mirrors a sampled share of the requests matching a mirror, re-signed for the shadow upstream.
+// It returns nil when the request is not mirrored.
+func (h *Handler) startShadowRequest(req *http.Request) *shadowRequest {
+	routes := h.Routes()
+	if h.Mirror == nil || routes == nil {
+		return nil
+	}
+	var key string
+	var signer *v4.Signer
+	if authHeader := req.Header.Get(authorizationHeader); authHeader != "" {
+		var err error
+		if key, err = h.AuthParser.FindAccessKey(authHeader); err != nil {
+			return nil
+		}
+		if signer, err = h.AuthCache.GetRequestSigner(key); err != nil {
+			return nil
+		}
+	}
+	loc := routes.Locate(req.Host, req.URL.Path)
+	mirror := routes.Mirror(routing.Request{
+		Host:      req.Host,
+		Bucket:    loc.Bucket,
+		Path:      req.URL.Path,
+		Method:    req.Method,
+		AccessKey: key,
+	})
+	if mirror == nil || rand.Float64() >= mirror.SampleRate {
+		return nil
+	}
+
+	// The shadow request outlives the client request, it must not carry its context or body
+	detached := req.WithContext(context.Background())
+	detached.Body = http.NoBody
+	shadowReq, err := h.assembleUpstreamReq(routes, signer, detached, mirror.Upstream, loc, key, signer != nil)
+	if err != nil {
+		h.log.Sugar().Debugf("unable to assemble mirrored request: %s", err.Error())
+		return nil
+	}
+	return h.Mirror.Start(mirror.Upstream.Name, shadowReq)
 }
 
 // BuildUpstreamRequest Validates the incoming request and create a new request for an upstream server
@@ -148,12 +353,12 @@ func (h *Handler) BuildUpstreamRequest(req *http.Request) (*http.Request, error)
 
 	signRequest := false
 	var signer *v4.Signer
+	var key string
 
 	accessKey := req.Header.Get(authorizationHeader)
 
 	if accessKey != "" {
 		signRequest = true
-		var key string
 		var err error
 		if key, err = h.AuthParser.FindAccessKey(accessKey); err != nil {
 			h.log.Sugar().Errorf("unable to find an accessKey in auth header: %s", err.Error())
@@ -167,50 +372,158 @@ func (h *Handler) BuildUpstreamRequest(req *http.Request) (*http.Request, error)
 		}
 	}
 
+	// Every step of the request uses the same config, even when a reload swaps it meanwhile
+	upstreams := h.loadUpstreams()
+	upstream, loc, variant, err := h.resolveUpstream(upstreams, req, key)
+	if err != nil {
+		return nil, err
+	}
+	if upstream, err = h.admitUpstream(upstream); err != nil {
+		return nil, err
+	}
+
 	// Assemble a new upstream request
-	proxyReq, err := h.assembleUpstreamReq(signer, req, "", signRequest)
+	proxyReq, err := h.assembleUpstreamReq(upstreams.routes, signer, req, upstream, loc, key, signRequest)
 	if err != nil {
 		h.log.Sugar().Infof("Unable to assemble request: %s", err.Error())
+		if upstream.Breaker != nil {
+			// The request is never sent, a probe slot it took must not wait for OpenFor to be given back
+			upstream.Breaker.Release()
+		}
 		return nil, err
 	}
 
 	// Disable Go's "Transfer-Encoding: chunked" madness
 	proxyReq.ContentLength = req.ContentLength
+	h.ClientIPs.setForwardedFor(proxyReq, req)
+	if r := routeFromContext(proxyReq.Context()); r != nil {
+		r.variant = variant
+	}
 
 	return proxyReq, nil
 }
 
 // Private functions
 
+// validateIncomingSourceIP checks the client address of req against the allowed source subnets, every client is
+// allowed without any
 func (h *Handler) validateIncomingSourceIP(req *http.Request) error {
+	if len(h.AllowedSourceSubnet) == 0 {
+		return nil
+	}
 	allowed := false
+	userIP := h.ClientIPs.ClientIP(req)
 	for _, subnet := range h.AllowedSourceSubnet {
-		ip, _, _ := net.SplitHostPort(req.RemoteAddr)
-		userIP := net.ParseIP(ip)
 		if subnet.Contains(userIP) {
 			allowed = true
 		}
 	}
 	if !allowed {
-		return fmt.Errorf("source IP not allowed: %v", req)
+		return fmt.Errorf("source IP not allowed: %v", userIP)
 	}
 	return nil
 }
 
-func (h *Handler) assembleUpstreamReq(signer *v4.Signer, req *http.Request, region string, sign bool) (proxyReq *http.Request, err error) {
+// resolveUpstream picks the upstream for a request from the routing table, or from the upstream helper without one.
+// The location is only known with a routing table, the upstream helper rewrites whole hosts instead.
+func (h *Handler) resolveUpstream(upstreams *upstreamConfig, req *http.Request, accessKey string) (*routing.Upstream, routing.Location, routing.Variant, error) {
+	if upstreams.routes != nil {
+		loc := upstreams.routes.Locate(req.Host, req.URL.Path)
+		upstream, variant, err := upstreams.routes.MatchVariant(routing.Request{
+			Host:      req.Host,
+			Bucket:    loc.Bucket,
+			Path:      req.URL.Path,
+			Method:    req.Method,
+			AccessKey: accessKey,
+		})
+		if err != nil {
+			h.log.Sugar().Infow("no route for request", "host", req.Host, "path", req.URL.Path, "method", req.Method)
+			return nil, loc, variant, err
+		}
+		h.log.Sugar().Debugf("routing to upstream %s", upstream.Name)
+		return upstream, loc, variant, nil
+	}
+	host, parts, err := upstreams.helper.ResolveHost(req.Host, accessKey)
+	if err != nil {
+		return nil, routing.Location{}, routing.Variant{}, err
+	}
+	// The host was rendered for this request, a bucket named by the template is already part of it
+	var loc routing.Location
+	if bucket := parts[HostPartBucket]; bucket != "" {
+		loc = routing.Location{Bucket: bucket, Key: strings.TrimPrefix(req.URL.Path, "/"), VirtualHost: true}
+	}
+	scheme := h.UpstreamScheme
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+	}
+	upstream := &routing.Upstream{Host: host, Scheme: scheme, TLS: h.UpstreamTLS, Region: parts[HostPartRegion]}
+	return upstream, loc, routing.Variant{}, nil
+}
+
+func (h *Handler) assembleUpstreamReq(routes *routing.Table, signer *v4.Signer, req *http.Request, upstream *routing.Upstream, loc routing.Location, accessKey string, sign bool) (proxyReq *http.Request, err error) {
 
-	proxyURL := req.URL
+	// Copy the url so the incoming request is left untouched
+	proxyURL := new(url.URL)
+	*proxyURL = *req.URL
 	h.log.Sugar().Debugf("URL: %s", proxyURL.String())
 	h.log.Sugar().Debugf("proxyURL: %s", proxyURL.Host)
-	currentHost := req.Host
-	proxyURL.Host, err = h.UpstreamProxyHelper.PrepHost(currentHost)
+	var aliases *routing.Aliases
+	var replica *routing.Replica
+	var migration *routing.Migration
+	if routes != nil {
+		aliases = routes.Aliases()
+		migration = routes.Migration(loc.Bucket)
+		replica = routes.Replica(routing.Request{
+			Host:      req.Host,
+			Bucket:    loc.Bucket,
+			Path:      req.URL.Path,
+			Method:    req.Method,
+			AccessKey: accessKey,
+		})
+	}
+	if err = denyAliasTarget(aliases, loc.Bucket); err != nil {
+		return nil, err
+	}
+	prefix, err := h.namespacePrefix(routes, loc.Bucket, accessKey)
 	if err != nil {
 		return nil, err
 	}
+	if prefix != "" {
+		if loc, err = namespaceLocation(proxyURL, req.Method, loc, prefix); err != nil {
+			return nil, err
+		}
+	}
+	copySource := req.Header.Get(copySourceHeader)
+	if copySource != "" {
+		if copySource, err = h.namespaceCopySourceOf(routes, copySource, accessKey); err != nil {
+			return nil, err
+		}
+		if err = denyAliasTarget(aliases, strings.SplitN(strings.TrimPrefix(copySource, "/"), "/", 2)[0]); err != nil {
+			return nil, err
+		}
+	}
+	loc = aliasLocation(proxyURL, loc, aliases)
+	applyAddressing(proxyURL, upstream, loc)
 	h.log.Sugar().Debugf("Using New Host: %s", proxyURL.Host)
-	proxyURL.Scheme = h.UpstreamScheme
-	proxyURL.RawPath = req.URL.Path
-	proxyReq, err = http.NewRequest(req.Method, proxyURL.String(), req.Body)
+	proxyURL.Scheme = upstream.Scheme
+	proxyURL.RawPath = proxyURL.Path
+	ctx := withRoute(req.Context(), &route{
+		upstream:      upstream,
+		hashKey:       loc.HashKey(upstream.HashOn),
+		signer:        signer,
+		aliases:       aliases,
+		prefix:        prefix,
+		objectRequest: loc.Key != "" && req.Method != http.MethodPost && !isListParts(req),
+		location:      loc,
+		accessKey:     accessKey,
+		replica:       replica,
+		migration:     migration,
+	})
+	ctx = transport.WithTLSConfig(ctx, upstream.TLS)
+	proxyReq, err = http.NewRequestWithContext(ctx, req.Method, proxyURL.String(), req.Body)
 	if err != nil {
 		return nil, err
 	}
@@ -220,10 +533,13 @@ func (h *Handler) assembleUpstreamReq(signer *v4.Signer, req *http.Request, regi
 	if val, ok := req.Header[contentMd5Header]; ok {
 		proxyReq.Header[contentMd5Header] = val
 	}
+	if copySource != "" {
+		proxyReq.Header.Set(copySourceHeader, aliasCopySource(copySource, aliases))
+	}
 	// Only sign if we have the key and a signed request.
 	if sign {
 		// Sign the upstream request
-		if err = proxy.SignRequest(signer, proxyReq, region); err != nil {
+		if err = proxy.SignRequest(signer, proxyReq, upstream.Region); err != nil {
 			h.log.Sugar().Infof("Unable to Sing request")
 			return nil, err
 		}
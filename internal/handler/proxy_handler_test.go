@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"encoding/pem"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/mocks"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testAuthHeader = "AWS4-HMAC-SHA256 Credential=AKID/20220101/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=abc"
+
+func testSigner() *v4.Signer {
+	return v4.NewSigner(credentials.NewStaticCredentialsFromCreds(credentials.Value{
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+	}))
+}
+
+func newTestHandler(t *testing.T, routingConfig string) *Handler {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mCache := mocks.NewMockAuthCache(ctrl)
+	mCache.EXPECT().GetRequestSigner("AKID").Return(testSigner(), nil).AnyTimes()
+	mCache.EXPECT().GetUser("AKID").Return("alice", nil).AnyTimes()
+	config, err := routing.ParseConfig([]byte(routingConfig))
+	assert.NoError(t, err)
+	routes, err := routing.NewTable(log, config)
+	assert.NoError(t, err)
+	h := &Handler{
+		log:        log,
+		AuthParser: NewAccessKeyParser(),
+		AuthCache:  mCache,
+		Proxies:    NewProxyRegistry(&backendTransport{log: log, base: transport.NewUpstreamTransport(transport.UpstreamConfig{})}, 0),
+	}
+	h.storeUpstreams(&upstreamConfig{routes: routes})
+	return h
+}
+
+func serveTestRequest(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", testAuthHeader)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandlerRoutesAndResigns(t *testing.T) {
+	var received *http.Request
+	var receivedBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		b, _ := ioutil.ReadAll(r.Body)
+		receivedBody = string(b)
+		_, _ = w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: test
+    endpoint: `+host+`
+    scheme: http
+    region: lga1
+rules:
+  - match:
+      bucket: my-bucket
+    upstream: test
+`)
+
+	rec := serveTestRequest(h, http.MethodPut, "http://proxy.example.com/my-bucket/some/key", "data")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "upstream", rec.Body.String())
+	assert.Equal(t, "/my-bucket/some/key", received.URL.Path)
+	assert.Equal(t, host, received.Host)
+	assert.Equal(t, "data", receivedBody)
+	assert.Contains(t, received.Header.Get("Authorization"), "Credential=AKID/")
+	assert.Contains(t, received.Header.Get("Authorization"), "/lga1/s3/aws4_request")
+
+	// No rule matches and there is no default upstream
+	rec = serveTestRequest(h, http.MethodGet, "http://proxy.example.com/other-bucket/key", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHandlerConvertsToPathStyle(t *testing.T) {
+	var received *http.Request
+	var signature error
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		signature = verifySignature(r, nil)
+	}))
+	defer upstream.Close()
+
+	h := newTestHandler(t, `
+domains: [object.lga1.example.com]
+upstreams:
+  - name: test
+    endpoint: `+strings.TrimPrefix(upstream.URL, "http://")+`
+    scheme: http
+    addressing: path
+default: test
+`)
+
+	rec := serveTestRequest(h, http.MethodGet, "http://my-bucket.object.lga1.example.com/some/key", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "/my-bucket/some/key", received.URL.Path)
+	// The signature covers the converted host and path
+	assert.Contains(t, received.Header.Get("Authorization"), "SignedHeaders=host;")
+	assert.NoError(t, signature)
+}
+
+func TestHandlerFailsOverToSibling(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(b)
+	}))
+	defer upstream.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadAddr := strings.TrimPrefix(dead.URL, "http://")
+	dead.Close()
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: test
+    endpoint: s3.lga1.example.com
+    scheme: http
+    backends: [`+deadAddr+`, `+strings.TrimPrefix(upstream.URL, "http://")+`]
+    max_fails: 1
+default: test
+`)
+
+	for i := 0; i < 4; i++ {
+		rec := serveTestRequest(h, http.MethodPut, "http://proxy.example.com/bucket/key", "payload")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "payload", rec.Body.String())
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&hits))
+	assert.False(t, h.Routes().Upstreams()[0].Pool.Backends()[0].Healthy())
+}
+
+func TestHandlerConsistentHashing(t *testing.T) {
+	var hitsA, hitsB int32
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { atomic.AddInt32(&hitsA, 1) }))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { atomic.AddInt32(&hitsB, 1) }))
+	defer b.Close()
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: test
+    endpoint: s3.lga1.example.com
+    scheme: http
+    backends: [`+strings.TrimPrefix(a.URL, "http://")+`, `+strings.TrimPrefix(b.URL, "http://")+`]
+    balance: consistent_hash
+    hash_on: bucket
+default: test
+`)
+
+	for i := 0; i < 6; i++ {
+		rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key-"+strconv.Itoa(i), "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	// Every object of the bucket lands on the same backend
+	assert.ElementsMatch(t, []int32{0, 6}, []int32{atomic.LoadInt32(&hitsA), atomic.LoadInt32(&hitsB)})
+	for _, backend := range h.Routes().Upstreams()[0].Pool.Backends() {
+		assert.Equal(t, int64(0), backend.InFlight())
+	}
+}
+
+func TestHandlerReachesHTTPSUpstreamFromPlainListener(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	}))
+	defer upstream.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600))
+
+	h := newTestHandler(t, `
+upstreams:
+  - name: secure
+    endpoint: `+strings.TrimPrefix(upstream.URL, "https://")+`
+    tls:
+      ca_file: `+caFile+`
+default: secure
+`)
+
+	rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "secure", rec.Body.String())
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type registryEntry struct {
+	proxy    *httputil.ReverseProxy
+	lastUsed int64
+}
+
+// ProxyRegistry holds one reverse proxy per upstream scheme and host, every proxy sends requests through the same
+// transport so connections are pooled across them. Safe for concurrent use.
+type ProxyRegistry struct {
+	transport   http.RoundTripper
+	idleTimeout time.Duration
+
+	mu      sync.RWMutex
+	entries map[url.URL]*registryEntry
+}
+
+// NewProxyRegistry builds a registry whose proxies use transport, entries unused for idleTimeout are evicted by Run
+func NewProxyRegistry(transport http.RoundTripper, idleTimeout time.Duration) *ProxyRegistry {
+	return &ProxyRegistry{
+		transport:   transport,
+		idleTimeout: idleTimeout,
+		entries:     make(map[url.URL]*registryEntry),
+	}
+}
+
+// Get returns the proxy for the scheme and host of upstream, creating it on first use
+func (r *ProxyRegistry) Get(upstream url.URL) *httputil.ReverseProxy {
+	now := time.Now().UnixNano()
+	r.mu.RLock()
+	entry, ok := r.entries[upstream]
+	r.mu.RUnlock()
+	if !ok {
+		r.mu.Lock()
+		if entry, ok = r.entries[upstream]; !ok {
+			proxy := httputil.NewSingleHostReverseProxy(&upstream)
+			proxy.FlushInterval = -1
+			proxy.Transport = r.transport
+			proxy.ModifyResponse = rewriteResponse
+			entry = &registryEntry{proxy: proxy}
+			r.entries[upstream] = entry
+		}
+		r.mu.Unlock()
+	}
+	atomic.StoreInt64(&entry.lastUsed, now)
+	return entry.proxy
+}
+
+// Len returns the number of proxies held
+func (r *ProxyRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.entries)
+}
+
+// EvictIdle removes proxies not used since before idle and returns how many were removed
+func (r *ProxyRegistry) EvictIdle(idle time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	evicted := 0
+	for u, entry := range r.entries {
+		if atomic.LoadInt64(&entry.lastUsed) < idle.UnixNano() {
+			delete(r.entries, u)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Run evicts idle proxies until ctx is done, it returns immediately when the idle timeout is zero
+func (r *ProxyRegistry) Run(ctx context.Context) {
+	if r.idleTimeout <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(r.idleTimeout / 2)
+		defer t.Stop()
+		for {
+			select {
+			case now := <-t.C:
+				r.EvictIdle(now.Add(-r.idleTimeout))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Run with -race, concurrent requests used to write the proxy map without a lock
+func TestHandlerParallelRequestsToSeveralHosts(t *testing.T) {
+	const upstreams = 4
+	var hits int32
+	config := "upstreams:\n"
+	rules := "rules:\n"
+	for i := 0; i < upstreams; i++ {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			_, _ = w.Write([]byte(r.URL.Path))
+		}))
+		defer srv.Close()
+		config += fmt.Sprintf("  - name: u%d\n    endpoint: %s\n    scheme: http\n", i, strings.TrimPrefix(srv.URL, "http://"))
+		rules += fmt.Sprintf("  - match:\n      bucket: bucket-%d\n    upstream: u%d\n", i, i)
+	}
+	h := newTestHandler(t, config+rules)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/bucket-%d/key-%d", i%upstreams, i)
+			rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com"+path, "")
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, path, rec.Body.String())
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(50), atomic.LoadInt32(&hits))
+	assert.Equal(t, upstreams, h.Proxies.Len())
+}
+
+func TestProxyRegistryEvictsIdleEntries(t *testing.T) {
+	r := NewProxyRegistry(http.DefaultTransport, time.Minute)
+	a := url.URL{Scheme: "http", Host: "a.example.com"}
+	b := url.URL{Scheme: "http", Host: "b.example.com"}
+
+	first := r.Get(a)
+	assert.Same(t, first, r.Get(a))
+	r.Get(b)
+	assert.Equal(t, 2, r.Len())
+
+	assert.Equal(t, 0, r.EvictIdle(time.Now().Add(-time.Minute)))
+	assert.Equal(t, 2, r.EvictIdle(time.Now().Add(time.Second)))
+	assert.Equal(t, 0, r.Len())
+	assert.NotSame(t, first, r.Get(a))
+}
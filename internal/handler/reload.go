@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	errNoRoutingConfig = errors.New("the proxy was started without a routing config")
+
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_routing_config_reloads_total",
+		Help: "Reloads of the routing config by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(configReloads)
+}
+
+// upstreamConfig is how the handler picks upstreams. A reload swaps it as a whole, requests in flight finish with
+// the config they started with.
+type upstreamConfig struct {
+	// routes is the routing table, nil when the upstream helper picks upstreams
+	routes *routing.Table
+
+	// helper rewrites origin hosts into upstream hosts without a routing table
+	helper *UpstreamHelper
+
+	// stopHealthChecks ends the health checks of routes, nil without a routing table
+	stopHealthChecks context.CancelFunc
+}
+
+// routingReloader rebuilds the routing table from its config file
+type routingReloader struct {
+	path     string
+	insecure bool
+
+	// transport runs the health checks of reloaded tables
+	transport http.RoundTripper
+
+	// replicator looks up the upstreams of replicated writes, nil when nothing is replicated
+	replicator *Replicator
+
+	// mu serializes reloads
+	mu sync.Mutex
+}
+
+// loadRoutingTable reads and compiles the routing config at path, insecure skips certificate verification of every
+// upstream
+func loadRoutingTable(log *zap.Logger, path string, insecure bool) (*routing.Table, error) {
+	config, err := routing.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if insecure {
+		for i := range config.Upstreams {
+			config.Upstreams[i].TLS.InsecureSkipVerify = true
+		}
+	}
+	return routing.NewTable(log, config)
+}
+
+// Routes returns the routing table new requests are routed by, nil without a routing config
+func (h *Handler) Routes() *routing.Table {
+	return h.loadUpstreams().routes
+}
+
+func (h *Handler) loadUpstreams() *upstreamConfig {
+	if config, ok := h.upstreams.Load().(*upstreamConfig); ok {
+		return config
+	}
+	return &upstreamConfig{}
+}
+
+// storeUpstreams swaps in config and stops the health checks of the config it replaces
+func (h *Handler) storeUpstreams(config *upstreamConfig) {
+	previous := h.loadUpstreams()
+	h.upstreams.Store(config)
+	if previous.stopHealthChecks != nil {
+		previous.stopHealthChecks()
+	}
+}
+
+// ReloadRoutes reads the routing config again and swaps it in for new requests. The config is validated first, an
+// invalid config is rejected and the routing table in use is kept. Health checks of the new table run until ctx is
+// done or the table is replaced.
+func (h *Handler) ReloadRoutes(ctx context.Context) error {
+	r := h.reloader
+	if r == nil {
+		return errNoRoutingConfig
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes, err := loadRoutingTable(h.log, r.path, r.insecure)
+	if err == nil && r.replicator != nil {
+		err = r.replicator.SetRoutes(routes)
+	}
+	if err != nil {
+		configReloads.WithLabelValues("rejected").Inc()
+		h.log.Sugar().Errorw("rejected routing config, keeping the current routes", "path", r.path, "error", err.Error())
+		return err
+	}
+	routes.InheritBreakers(h.Routes())
+	routes.InheritPools(h.Routes())
+	healthCtx, stop := context.WithCancel(ctx)
+	routes.Start(healthCtx, r.transport)
+	h.storeUpstreams(&upstreamConfig{routes: routes, stopHealthChecks: stop})
+	configReloads.WithLabelValues("applied").Inc()
+	h.log.Sugar().Infow("reloaded routing config", "path", r.path)
+	return nil
+}
+
+// WatchRoutingConfig reloads the routing config whenever reload delivers a signal and, with a positive
+// pollInterval, whenever the modification time or size of the file changes. It returns immediately, watching
+// stops once ctx is done.
+func (h *Handler) WatchRoutingConfig(ctx context.Context, pollInterval time.Duration, reload <-chan os.Signal) {
+	if h.reloader == nil {
+		return
+	}
+	last := configVersion(h.reloader.path)
+	go func() {
+		var poll <-chan time.Time
+		if pollInterval > 0 {
+			t := time.NewTicker(pollInterval)
+			defer t.Stop()
+			poll = t.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-reload:
+				h.log.Sugar().Infow("reloading routing config", "signal", sig.String())
+			case <-poll:
+				if configVersion(h.reloader.path) == last {
+					continue
+				}
+				h.log.Sugar().Infow("routing config changed, reloading", "path", h.reloader.path)
+			}
+			// A rejected config is not retried until the file changes again
+			last = configVersion(h.reloader.path)
+			_ = h.ReloadRoutes(ctx)
+		}
+	}()
+}
+
+// fileVersion tells versions of a file apart
+type fileVersion struct {
+	modTime int64
+	size    int64
+}
+
+// configVersion returns the version of the file at path, zero when it can't be read. Symlinks are followed, so
+// config maps that swap the link target are noticed.
+func configVersion(path string) fileVersion {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}
+	}
+	return fileVersion{modTime: info.ModTime().UnixNano(), size: info.Size()}
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"context"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/upstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func routingConfigFor(server *httptest.Server) string {
+	return `
+upstreams:
+  - name: test
+    endpoint: ` + strings.TrimPrefix(server.URL, "http://") + `
+    scheme: http
+default: test
+`
+}
+
+func TestHandlerReloadsRoutes(t *testing.T) {
+	var firstHits, secondHits int32
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&firstHits, 1)
+	}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&secondHits, 1)
+	}))
+	defer second.Close()
+
+	path := filepath.Join(t.TempDir(), "routing.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(routingConfigFor(first)), 0600))
+	h := newTestHandler(t, routingConfigFor(first))
+	h.reloader = &routingReloader{path: path, transport: transport.NewUpstreamTransport(transport.UpstreamConfig{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&firstHits))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(routingConfigFor(second)), 0600))
+	assert.NoError(t, h.ReloadRoutes(ctx))
+	serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&secondHits))
+
+	// An invalid config is rejected and the routes in use are kept
+	rejected := testutil.ToFloat64(configReloads.WithLabelValues("rejected"))
+	assert.NoError(t, ioutil.WriteFile(path, []byte("upstreams: []\ndefault: missing\n"), 0600))
+	assert.Error(t, h.ReloadRoutes(ctx))
+	assert.Equal(t, rejected+1, testutil.ToFloat64(configReloads.WithLabelValues("rejected")))
+	rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&secondHits))
+
+	h.reloader = nil
+	assert.ErrorIs(t, h.ReloadRoutes(ctx), errNoRoutingConfig)
+}
+
+// backendGauge returns the value of the gauge name of an upstream backend and whether the series exists
+func backendGauge(t *testing.T, name, upstreamName, backend string) (float64, bool) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["upstream"] == upstreamName && labels["backend"] == backend {
+				return m.GetGauge().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestHandlerReloadKeepsBackendState(t *testing.T) {
+	config := func(name string, backends ...string) string {
+		return `
+upstreams:
+  - name: ` + name + `
+    endpoint: s3.example.com
+    scheme: http
+    backends: [` + strings.Join(backends, ", ") + `]
+    max_fails: 1
+    hedge:
+      percentile: 95
+default: ` + name + `
+`
+	}
+	const healthy, inFlight = "s3proxy_upstream_backend_healthy", "s3proxy_upstream_backend_in_flight_requests"
+	gauge := func(name, backend string) float64 {
+		value, ok := backendGauge(t, name, "reloaded", backend)
+		assert.True(t, ok, "%s of %s is not exported", name, backend)
+		return value
+	}
+	path := filepath.Join(t.TempDir(), "routing.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(config("reloaded", "a:80", "b:80")), 0600))
+	h := newTestHandler(t, config("reloaded", "a:80", "b:80"))
+	h.reloader = &routingReloader{path: path, transport: transport.NewUpstreamTransport(transport.UpstreamConfig{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.Routes().Start(ctx, h.reloader.transport)
+
+	before := h.Routes().Upstream("reloaded")
+	a, b := before.Pool.Backends()[0], before.Pool.Backends()[1]
+	release := before.Pool.Acquire(a)
+	before.Pool.ReportFailure(b)
+	assert.Equal(t, float64(1), gauge(inFlight, "a:80"))
+	assert.Equal(t, float64(0), gauge(healthy, "b:80"))
+
+	// The reloaded pool keeps the backends with their health and requests in flight, so does a rejected reload
+	assert.NoError(t, h.ReloadRoutes(ctx))
+	assert.NoError(t, ioutil.WriteFile(path, []byte("upstreams: []\ndefault: missing\n"), 0600))
+	assert.Error(t, h.ReloadRoutes(ctx))
+	after := h.Routes().Upstream("reloaded")
+	assert.Equal(t, []*upstream.Backend{a, b}, after.Pool.Backends())
+	assert.Same(t, before.Hedge, after.Hedge)
+	assert.False(t, b.Healthy())
+	assert.Equal(t, float64(1), gauge(inFlight, "a:80"))
+	assert.Equal(t, float64(0), gauge(healthy, "b:80"))
+	release()
+	assert.Equal(t, float64(0), gauge(inFlight, "a:80"))
+
+	// Backends and upstreams the config drops lose their series
+	assert.NoError(t, ioutil.WriteFile(path, []byte(config("reloaded", "a:80", "c:80")), 0600))
+	assert.NoError(t, h.ReloadRoutes(ctx))
+	_, ok := backendGauge(t, healthy, "reloaded", "b:80")
+	assert.False(t, ok)
+	assert.Equal(t, float64(1), gauge(healthy, "c:80"))
+	assert.NoError(t, ioutil.WriteFile(path, []byte(config("renamed", "a:80", "c:80")), 0600))
+	assert.NoError(t, h.ReloadRoutes(ctx))
+	for _, backend := range []string{"a:80", "c:80"} {
+		_, ok = backendGauge(t, healthy, "reloaded", backend)
+		assert.False(t, ok)
+		_, ok = backendGauge(t, inFlight, "reloaded", backend)
+		assert.False(t, ok)
+	}
+}
+
+func TestHandlerWatchesRoutingConfig(t *testing.T) {
+	var hits int32
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer next.Close()
+	previous := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer previous.Close()
+
+	for name, pollInterval := range map[string]time.Duration{"signal": 0, "poll": 10 * time.Millisecond} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routing.yaml")
+			assert.NoError(t, ioutil.WriteFile(path, []byte(routingConfigFor(previous)), 0600))
+			h := newTestHandler(t, routingConfigFor(previous))
+			h.reloader = &routingReloader{path: path, transport: transport.NewUpstreamTransport(transport.UpstreamConfig{})}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			reload := make(chan os.Signal, 1)
+			h.WatchRoutingConfig(ctx, pollInterval, reload)
+
+			before := atomic.LoadInt32(&hits)
+			assert.NoError(t, ioutil.WriteFile(path, []byte(routingConfigFor(next)+"\n"), 0600))
+			if pollInterval == 0 {
+				reload <- syscall.SIGHUP
+			}
+			assert.Eventually(t, func() bool {
+				serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "")
+				return atomic.LoadInt32(&hits) > before
+			}, 2*time.Second, 20*time.Millisecond)
+		})
+	}
+}
@@ -0,0 +1,559 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/cenkalti/backoff"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/proxy"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/replication"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replicatePut    = "put"
+	replicateDelete = "delete"
+
+	// maxDeleteObjectsBytes bounds the multi-object delete bodies buffered to replicate the deleted keys, S3 allows
+	// at most 1000 keys of 1024 bytes each
+	maxDeleteObjectsBytes = 2 << 20
+)
+
+var (
+	errNoReplicationQueue = errors.New("async replicas need a replication queue directory")
+	errTargetExists       = errors.New("object exists on the target")
+
+	replicationRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_replication_requests_total",
+		Help: "Replicated writes by replica upstream, consistency and result.",
+	}, []string{"upstream", "consistency", "result"})
+	replicationQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "s3proxy_replication_queue_depth",
+		Help: "Writes queued on disk and not yet replicated.",
+	})
+
+	// dataPreservingSubresources are the query parameters of PUT and DELETE requests that change something other
+	// than the object data, such as its acl or tags, or that upload a part
+	dataPreservingSubresources = []string{"acl", "tagging", "retention", "legal-hold", "partNumber", "uploadId",
+		"versionId"}
+
+	// replicatedHeaders are the object headers copied along with the object data
+	replicatedHeaders = []string{"Content-Type", "Content-Encoding", "Content-Disposition", "Content-Language",
+		"Cache-Control", "Expires"}
+)
+
+func init() {
+	prometheus.MustRegister(replicationRequests, replicationQueueDepth)
+}
+
+// replicationEntry is a write to replicate, queued entries are stored as json
+type replicationEntry struct {
+	Op     string `json:"op"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+
+	// AccessKey signs the replication requests, empty when the write was unsigned
+	AccessKey string `json:"access_key,omitempty"`
+}
+
+// permanentError marks replication failures retrying won't fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Replicator copies the current state of written objects from the upstream they were written to onto a replica.
+// Objects are read back from the source and streamed to the replica rather than replaying the client request, so
+// multipart uploads and copies are replicated once they complete.
+type Replicator struct {
+	log *zap.Logger
+
+	// routes holds the *routing.Table upstreams of entries are looked up in, a reload replaces it
+	routes    atomic.Value
+	cache     internal.AuthCache
+	transport http.RoundTripper
+	timeout   time.Duration
+
+	// queue holds async replicas until they were written, nil without a queue directory
+	queue      *replication.Queue
+	maxBackoff time.Duration
+}
+
+// NewReplicator builds a Replicator for the replicas of routes, async replicas are queued in queueDir. The queue
+// is opened whenever queueDir is set so a reload may add async replicas.
+func NewReplicator(log *zap.Logger, routes *routing.Table, cache internal.AuthCache, rt http.RoundTripper, queueDir string, timeout, maxBackoff time.Duration) (*Replicator, error) {
+	r := &Replicator{log: log, cache: cache, transport: rt, timeout: timeout, maxBackoff: maxBackoff}
+	if queueDir != "" {
+		queue, err := replication.Open(queueDir)
+		if err != nil {
+			return nil, err
+		}
+		r.queue = queue
+		replicationQueueDepth.Set(float64(queue.Len()))
+	}
+	if err := r.SetRoutes(routes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// SetRoutes replaces the table upstreams are looked up in, it fails when routes has async replicas and there is no
+// queue. Queued entries of upstreams routes no longer has are dropped.
+func (r *Replicator) SetRoutes(routes *routing.Table) error {
+	for _, replica := range routes.Replicas() {
+		if replica.Consistency == routing.ConsistencyAsync && r.queue == nil {
+			return errNoReplicationQueue
+		}
+	}
+	r.routes.Store(routes)
+	return nil
+}
+
+func (r *Replicator) upstream(name string) *routing.Upstream {
+	return r.routes.Load().(*routing.Table).Upstream(name)
+}
+
+// Run replicates queued writes in order until ctx is done, failed writes are retried with backoff
+func (r *Replicator) Run(ctx context.Context) {
+	if r.queue == nil {
+		return
+	}
+	go func() {
+		b := backoff.NewExponentialBackOff()
+		b.MaxInterval = r.maxBackoff
+		b.MaxElapsedTime = 0
+		for {
+			record, err := r.queue.Peek()
+			if errors.Is(err, replication.ErrEmpty) {
+				select {
+				case <-r.queue.Notify():
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err == nil {
+				err = r.replicateRecord(ctx, record)
+			}
+			if err != nil {
+				var permanent *permanentError
+				if !errors.As(err, &permanent) {
+					wait := b.NextBackOff()
+					r.log.Sugar().Warnw("unable to replicate queued write, retrying", "error", err.Error(), "backoff", wait)
+					select {
+					case <-time.After(wait):
+						continue
+					case <-ctx.Done():
+						return
+					}
+				}
+				r.log.Sugar().Errorw("dropping queued write that can't be replicated", "error", err.Error())
+			}
+			b.Reset()
+			if err = r.queue.Ack(); err != nil {
+				r.log.Sugar().Errorw("unable to remove replicated write from the queue", "error", err.Error())
+			}
+			replicationQueueDepth.Set(float64(r.queue.Len()))
+		}
+	}()
+}
+
+func (r *Replicator) replicateRecord(ctx context.Context, record []byte) error {
+	var entry replicationEntry
+	if err := json.Unmarshal(record, &entry); err != nil {
+		return &permanentError{fmt.Errorf("invalid queued write %q: %w", record, err)}
+	}
+	err := r.Replicate(ctx, entry)
+	result := "replicated"
+	var permanent *permanentError
+	switch {
+	case errors.As(err, &permanent):
+		result = "dropped"
+	case err != nil:
+		result = "failed"
+	}
+	replicationRequests.WithLabelValues(entry.Target, string(routing.ConsistencyAsync), result).Inc()
+	return err
+}
+
+// Enqueue queues entry on disk, it returns once the entry is durable
+func (r *Replicator) Enqueue(entry replicationEntry) error {
+	if r.queue == nil {
+		return errNoReplicationQueue
+	}
+	record, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = r.queue.Push(record); err != nil {
+		return err
+	}
+	replicationQueueDepth.Set(float64(r.queue.Len()))
+	return nil
+}
+
+// Replicate writes the current state of the object of entry to the replica, deleting it there when the source
+// no longer has it
+func (r *Replicator) Replicate(ctx context.Context, entry replicationEntry) error {
+	source, target := r.upstream(entry.Source), r.upstream(entry.Target)
+	if source == nil || target == nil {
+		return &permanentError{fmt.Errorf("upstream %s or %s is no longer configured", entry.Source, entry.Target)}
+	}
+	signer, err := r.signer(entry)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	loc := routing.Location{Bucket: entry.Bucket, Key: entry.Key}
+
+	if entry.Op == replicatePut {
+		found, err := r.copyObject(ctx, source, target, loc, signer, nil)
+		if found || err != nil {
+			return err
+		}
+		// The object was deleted since, the replica follows suit
+	}
+
+	resp, err := r.send(ctx, http.MethodDelete, target, loc, signer, nil, nil)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices && resp.StatusCode != http.StatusNotFound {
+		return statusError("deleting from", target, resp.StatusCode)
+	}
+	return nil
+}
+
+// CopyIfAbsent copies the object of entry from the source to the target unless the target has it by the time the
+// copy is written. It reports whether the object was copied, a write to the target racing the copy is never
+// overwritten.
+func (r *Replicator) CopyIfAbsent(ctx context.Context, entry replicationEntry) (bool, error) {
+	source, target := r.upstream(entry.Source), r.upstream(entry.Target)
+	if source == nil || target == nil {
+		return false, &permanentError{fmt.Errorf("upstream %s or %s is no longer configured", entry.Source, entry.Target)}
+	}
+	signer, err := r.signer(entry)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	found, err := r.copyObject(ctx, source, target, routing.Location{Bucket: entry.Bucket, Key: entry.Key}, signer,
+		http.Header{"If-None-Match": {"*"}})
+	if errors.Is(err, errTargetExists) {
+		return false, nil
+	}
+	return found && err == nil, err
+}
+
+// copyObject streams the object at loc from source to target, the headers in put are added to the write. It reports
+// whether the source had the object.
+func (r *Replicator) copyObject(ctx context.Context, source, target *routing.Upstream, loc routing.Location, signer *v4.Signer, put http.Header) (bool, error) {
+	resp, err := r.send(ctx, http.MethodGet, source, loc, signer, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= http.StatusMultipleChoices:
+		return false, statusError("reading", source, resp.StatusCode)
+	}
+	header := http.Header{}
+	for _, name := range replicatedHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			header[name] = values
+		}
+	}
+	for name, values := range put {
+		header[name] = values
+	}
+	if resp.ContentLength < 0 {
+		return true, fmt.Errorf("reading %s returned no content length", source.Name)
+	}
+	written, err := r.send(ctx, http.MethodPut, target, loc, signer, header, &sizedBody{resp.Body, resp.ContentLength})
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(ioutil.Discard, written.Body)
+	_ = written.Body.Close()
+	switch {
+	case written.StatusCode == http.StatusPreconditionFailed:
+		return true, errTargetExists
+	case written.StatusCode >= http.StatusMultipleChoices:
+		return true, statusError("writing", target, written.StatusCode)
+	}
+	return true, nil
+}
+
+// Exists reports whether the target of entry has the object of entry
+func (r *Replicator) Exists(ctx context.Context, entry replicationEntry) (bool, error) {
+	target := r.upstream(entry.Target)
+	if target == nil {
+		return false, &permanentError{fmt.Errorf("upstream %s is no longer configured", entry.Target)}
+	}
+	signer, err := r.signer(entry)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	resp, err := r.send(ctx, http.MethodHead, target, routing.Location{Bucket: entry.Bucket, Key: entry.Key}, signer, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= http.StatusMultipleChoices:
+		return false, statusError("checking", target, resp.StatusCode)
+	}
+	return true, nil
+}
+
+// signer returns the signer of the access key of entry, nil for unsigned writes
+func (r *Replicator) signer(entry replicationEntry) (*v4.Signer, error) {
+	if entry.AccessKey == "" {
+		return nil, nil
+	}
+	signer, err := r.cache.GetRequestSigner(entry.AccessKey)
+	if err != nil {
+		return nil, fmt.Errorf("no signer for access key %s: %w", entry.AccessKey, err)
+	}
+	return signer, nil
+}
+
+type sizedBody struct {
+	io.Reader
+	size int64
+}
+
+func (r *Replicator) send(ctx context.Context, method string, target *routing.Upstream, loc routing.Location, signer *v4.Signer, header http.Header, body *sizedBody) (*http.Response, error) {
+	u := &url.URL{Path: "/" + loc.Bucket + "/" + loc.Key}
+	applyAddressing(u, target, loc)
+	u.Scheme = target.Scheme
+	u.RawPath = u.Path
+	ctx = withRoute(ctx, &route{upstream: target, hashKey: loc.HashKey(target.HashOn), signer: signer})
+	ctx = transport.WithTLSConfig(ctx, target.TLS)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, &permanentError{err}
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(body.Reader)
+		req.ContentLength = body.size
+	}
+	if signer != nil {
+		if err = proxy.SignStreamingRequest(signer, req, target.Region); err != nil {
+			return nil, err
+		}
+	}
+	return r.transport.RoundTrip(req)
+}
+
+func statusError(action string, target *routing.Upstream, status int) error {
+	err := fmt.Errorf("%s %s failed with status %d", action, target.Name, status)
+	if status >= http.StatusBadRequest && status < http.StatusInternalServerError &&
+		status != http.StatusRequestTimeout && status != http.StatusTooManyRequests && status != http.StatusForbidden {
+		return &permanentError{err}
+	}
+	return err
+}
+
+// replicationOp returns the replicated operation of a write request, empty for requests that don't change object
+// data. Parts of multipart uploads are replicated once the upload completes. Other query parameters, such as the
+// x-id=PutObject that SDKs add, don't matter.
+func replicationOp(req *http.Request, loc routing.Location) string {
+	if loc.Key == "" {
+		return ""
+	}
+	query := req.URL.Query()
+	switch req.Method {
+	case http.MethodPost:
+		if _, upload := query["uploadId"]; upload {
+			return replicatePut
+		}
+		return ""
+	case http.MethodPut, http.MethodDelete:
+	default:
+		return ""
+	}
+	// Version ids differ between upstreams, only writes of the current object are replicated
+	for _, subresource := range dataPreservingSubresources {
+		if _, ok := query[subresource]; ok {
+			return ""
+		}
+	}
+	if req.Method == http.MethodPut {
+		return replicatePut
+	}
+	return replicateDelete
+}
+
+// isDeleteObjects reports whether req is a multi-object delete, POST /bucket?delete
+func isDeleteObjects(req *http.Request, loc routing.Location) bool {
+	_, ok := req.URL.Query()["delete"]
+	return ok && req.Method == http.MethodPost && loc.Bucket != "" && loc.Key == ""
+}
+
+// deleteObjectsRequest is the body of a multi-object delete
+type deleteObjectsRequest struct {
+	Objects []deletedObject `xml:"Object"`
+}
+
+// deleteObjectsResult is the response to a multi-object delete, only the keys that failed matter
+type deleteObjectsResult struct {
+	Errors []deletedObject `xml:"Error"`
+}
+
+type deletedObject struct {
+	Key       string `xml:"Key"`
+	VersionId string `xml:"VersionId"`
+}
+
+// replicationTransport replicates successful writes of requests routed with a replica. Sync replicas are written
+// before the response is returned and fail the request when they can't be, async replicas are queued.
+type replicationTransport struct {
+	log        *zap.Logger
+	base       http.RoundTripper
+	replicator *Replicator
+}
+
+func (t *replicationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := routeFromContext(req.Context())
+	if r == nil || r.replica == nil || r.replica.Upstream == r.upstream {
+		return t.base.RoundTrip(req)
+	}
+	if isDeleteObjects(req, r.location) {
+		return t.deleteObjects(req, r)
+	}
+	op := replicationOp(req, r.location)
+	if op == "" {
+		return t.base.RoundTrip(req)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp, err
+	}
+	return t.replicate(req, resp, r, op, r.location.Key), nil
+}
+
+// deleteObjects sends a multi-object delete and replicates a delete of every key the primary didn't report an error
+// for. Keys deleted by version id are left alone like versioned deletes of single objects.
+func (t *replicationTransport) deleteObjects(req *http.Request, r *route) (*http.Response, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxDeleteObjectsBytes+1))
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var request deleteObjectsRequest
+	if len(body) > maxDeleteObjectsBytes || xml.Unmarshal(body, &request) != nil {
+		return s3ErrorResponse(req, http.StatusBadRequest, "MalformedXML",
+			"The XML you provided was not well-formed or did not validate against our published schema."), nil
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp, err
+	}
+	result, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(result))
+	var deleted deleteObjectsResult
+	if err == nil {
+		err = xml.Unmarshal(result, &deleted)
+	}
+	if err != nil {
+		replicationRequests.WithLabelValues(r.replica.Upstream.Name, string(r.replica.Consistency), "failed").Inc()
+		t.log.Sugar().Errorw("unable to read the deleted keys of a multi-object delete", "bucket", r.location.Bucket,
+			"error", err.Error())
+		return s3ErrorResponse(req, http.StatusServiceUnavailable, "ServiceUnavailable",
+			"The write succeeded on the primary but could not be replicated."), nil
+	}
+	failed := make(map[string]bool, len(deleted.Errors))
+	for _, o := range deleted.Errors {
+		failed[o.Key] = true
+	}
+	var keys []string
+	for _, o := range request.Objects {
+		if o.VersionId == "" && !failed[o.Key] {
+			keys = append(keys, o.Key)
+		}
+	}
+	return t.replicate(req, resp, r, replicateDelete, keys...), nil
+}
+
+// replicate writes op of every key to the replica of r once resp answered req successfully. The client is told the
+// write wasn't replicated when one of them fails.
+func (t *replicationTransport) replicate(req *http.Request, resp *http.Response, r *route, op string, keys ...string) *http.Response {
+	consistency := string(r.replica.Consistency)
+	result := "replicated"
+	if r.replica.Consistency == routing.ConsistencyAsync {
+		result = "queued"
+	}
+	for _, key := range keys {
+		entry := replicationEntry{
+			Op:        op,
+			Source:    r.upstream.Name,
+			Target:    r.replica.Upstream.Name,
+			Bucket:    r.location.Bucket,
+			Key:       key,
+			AccessKey: r.accessKey,
+		}
+		var err error
+		if r.replica.Consistency == routing.ConsistencySync {
+			err = t.replicator.Replicate(req.Context(), entry)
+		} else {
+			err = t.replicator.Enqueue(entry)
+		}
+		if err != nil {
+			replicationRequests.WithLabelValues(entry.Target, consistency, "failed").Inc()
+			t.log.Sugar().Errorw("unable to replicate write", "upstream", entry.Target, "consistency", consistency,
+				"bucket", entry.Bucket, "key", entry.Key, "error", err.Error())
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+			return s3ErrorResponse(req, http.StatusServiceUnavailable, "ServiceUnavailable",
+				"The write succeeded on the primary but could not be replicated.")
+		}
+		replicationRequests.WithLabelValues(entry.Target, consistency, result).Inc()
+	}
+	return resp
+}
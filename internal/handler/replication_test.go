@@ -0,0 +1,238 @@
+package handler
+
+import (
+	"context"
+	"encoding/xml"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// objectStore is a minimal S3 upstream keeping objects by path
+type objectStore struct {
+	mu      sync.Mutex
+	objects map[string]string
+	headers map[string]http.Header
+	fail    bool
+
+	// beforeRead runs ahead of every GET and HEAD
+	beforeRead func(r *http.Request)
+}
+
+func newObjectStore() (*objectStore, *httptest.Server) {
+	s := &objectStore{objects: map[string]string{}, headers: map[string]http.Header{}}
+	return s, httptest.NewServer(s)
+}
+
+func (s *objectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if _, ok := s.objects[r.URL.Path]; ok && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			body = []byte(s.objects["/"+strings.TrimPrefix(source, "/")])
+		}
+		s.objects[r.URL.Path] = string(body)
+		s.headers[r.URL.Path] = r.Header.Clone()
+	case http.MethodPost:
+		// Multi-object delete, keys named locked can't be deleted
+		var request deleteObjectsRequest
+		body, _ := ioutil.ReadAll(r.Body)
+		_ = xml.Unmarshal(body, &request)
+		result := "<DeleteResult>"
+		for _, o := range request.Objects {
+			if strings.HasPrefix(o.Key, "locked") {
+				result += "<Error><Key>" + o.Key + "</Key><Code>AccessDenied</Code></Error>"
+				continue
+			}
+			delete(s.objects, r.URL.Path+"/"+o.Key)
+			result += "<Deleted><Key>" + o.Key + "</Key></Deleted>"
+		}
+		_, _ = w.Write([]byte(result + "</DeleteResult>"))
+	case http.MethodDelete:
+		if _, tagging := r.URL.Query()["tagging"]; tagging {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		if s.beforeRead != nil {
+			s.beforeRead(r)
+		}
+		body, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+			return
+		}
+		w.Header().Set("Content-Type", s.headers[r.URL.Path].Get("Content-Type"))
+		w.Header().Set("X-Amz-Meta-Owner", s.headers[r.URL.Path].Get("X-Amz-Meta-Owner"))
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+func (s *objectStore) get(path string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, ok := s.objects[path]
+	return body, ok
+}
+
+func newReplicatedTestHandler(t *testing.T, primary, replica *httptest.Server, consistency, queueDir string) (*Handler, *Replicator) {
+	h := newTestHandler(t, `
+upstreams:
+  - name: primary
+    endpoint: `+strings.TrimPrefix(primary.URL, "http://")+`
+    scheme: http
+  - name: dr
+    endpoint: `+strings.TrimPrefix(replica.URL, "http://")+`
+    scheme: http
+default: primary
+replicas:
+  - match:
+      bucket: replicated
+    upstream: dr
+    consistency: `+consistency+`
+`)
+	log, _ := zap.NewDevelopment()
+	base := &backendTransport{log: log, base: transport.NewUpstreamTransport(transport.UpstreamConfig{})}
+	replicator, err := NewReplicator(log, h.Routes(), h.AuthCache, base, queueDir, time.Second, 10*time.Millisecond)
+	assert.NoError(t, err)
+	h.Proxies = NewProxyRegistry(&replicationTransport{log: log, base: base, replicator: replicator}, 0)
+	return h, replicator
+}
+
+func TestHandlerSyncReplication(t *testing.T) {
+	primaryStore, primary := newObjectStore()
+	defer primary.Close()
+	replicaStore, replica := newObjectStore()
+	defer replica.Close()
+	h, _ := newReplicatedTestHandler(t, primary, replica, "sync", "")
+
+	req := httptest.NewRequest(http.MethodPut, "http://proxy.example.com/replicated/key", strings.NewReader("data"))
+	req.Header.Set("Authorization", testAuthHeader)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Amz-Meta-Owner", "alice")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body, _ := replicaStore.get("/replicated/key")
+	assert.Equal(t, "data", body)
+	assert.Equal(t, "text/plain", replicaStore.headers["/replicated/key"].Get("Content-Type"))
+	assert.Equal(t, "alice", replicaStore.headers["/replicated/key"].Get("X-Amz-Meta-Owner"))
+	assert.Equal(t, "UNSIGNED-PAYLOAD", replicaStore.headers["/replicated/key"].Get("X-Amz-Content-Sha256"))
+
+	// Part uploads and other buckets are not replicated
+	serveTestRequest(h, http.MethodPut, "http://proxy.example.com/replicated/part?partNumber=1&uploadId=1", "part")
+	serveTestRequest(h, http.MethodPut, "http://proxy.example.com/other/key", "data")
+	_, ok := replicaStore.get("/replicated/part")
+	assert.False(t, ok)
+	_, ok = replicaStore.get("/other/key")
+	assert.False(t, ok)
+
+	assert.Equal(t, http.StatusNoContent, serveTestRequest(h, http.MethodDelete, "http://proxy.example.com/replicated/key", "").Code)
+	_, ok = replicaStore.get("/replicated/key")
+	assert.False(t, ok)
+
+	replicaStore.fail = true
+	rec = serveTestRequest(h, http.MethodPut, "http://proxy.example.com/replicated/key", "data")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<Code>ServiceUnavailable</Code>")
+	// The primary keeps the write, the client is told it wasn't replicated
+	body, _ = primaryStore.get("/replicated/key")
+	assert.Equal(t, "data", body)
+}
+
+func TestHandlerReplicatesSDKWrites(t *testing.T) {
+	primaryStore, primary := newObjectStore()
+	defer primary.Close()
+	replicaStore, replica := newObjectStore()
+	defer replica.Close()
+	h, _ := newReplicatedTestHandler(t, primary, replica, "sync", "")
+
+	// SDKs name the operation in the query, it is a plain write all the same
+	serveTestRequest(h, http.MethodPut, "http://proxy.example.com/replicated/key?x-id=PutObject", "data")
+	body, _ := replicaStore.get("/replicated/key")
+	assert.Equal(t, "data", body)
+	req := httptest.NewRequest(http.MethodPut, "http://proxy.example.com/replicated/copy?x-id=CopyObject", nil)
+	req.Header.Set("Authorization", testAuthHeader)
+	req.Header.Set("X-Amz-Copy-Source", "/replicated/key")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	body, _ = replicaStore.get("/replicated/copy")
+	assert.Equal(t, "data", body)
+
+	// Subresources leave the replicated object alone
+	replicaStore.mu.Lock()
+	replicaStore.objects["/replicated/key"] = "replica"
+	replicaStore.mu.Unlock()
+	serveTestRequest(h, http.MethodPut, "http://proxy.example.com/replicated/key?tagging&x-id=PutObjectTagging", "<Tagging/>")
+	serveTestRequest(h, http.MethodDelete, "http://proxy.example.com/replicated/key?tagging", "")
+	serveTestRequest(h, http.MethodPut, "http://proxy.example.com/replicated/key?acl", "<AccessControlPolicy/>")
+	body, ok := replicaStore.get("/replicated/key")
+	assert.True(t, ok)
+	assert.Equal(t, "replica", body)
+
+	// Multi-object deletes are replicated for the keys the primary deleted, not for versions or failed keys
+	for _, key := range []string{"versioned", "locked", "other"} {
+		primaryStore.objects["/replicated/"+key] = "data"
+		replicaStore.objects["/replicated/"+key] = "data"
+	}
+	rec := serveTestRequest(h, http.MethodPost, "http://proxy.example.com/replicated?delete", `<Delete>
+<Object><Key>key</Key></Object><Object><Key>copy</Key></Object><Object><Key>locked</Key></Object>
+<Object><Key>versioned</Key><VersionId>1</VersionId></Object></Delete>`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<Deleted><Key>key</Key></Deleted>")
+	for key, exists := range map[string]bool{"key": false, "copy": false, "locked": true, "versioned": true, "other": true} {
+		_, ok = replicaStore.get("/replicated/" + key)
+		assert.Equal(t, exists, ok, key)
+	}
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(h, http.MethodPost, "http://proxy.example.com/replicated?delete", "<Delete>").Code)
+}
+
+func TestHandlerAsyncReplication(t *testing.T) {
+	_, primary := newObjectStore()
+	defer primary.Close()
+	replicaStore, replica := newObjectStore()
+	defer replica.Close()
+	dir, _ := ioutil.TempDir("", "replication")
+	defer os.RemoveAll(dir)
+	h, replicator := newReplicatedTestHandler(t, primary, replica, "async", dir)
+
+	replicaStore.fail = true
+	assert.Equal(t, http.StatusOK, serveTestRequest(h, http.MethodPut, "http://proxy.example.com/replicated/key", "data").Code)
+	assert.Equal(t, 1, replicator.queue.Len())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	replicator.Run(ctx)
+	time.Sleep(50 * time.Millisecond)
+	replicaStore.mu.Lock()
+	replicaStore.fail = false
+	replicaStore.mu.Unlock()
+	assert.Eventually(t, func() bool {
+		body, _ := replicaStore.get("/replicated/key")
+		return body == "data" && replicator.queue.Len() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	_, err := NewReplicator(zap.NewNop(), h.Routes(), h.AuthCache, nil, "", time.Second, time.Second)
+	assert.ErrorIs(t, err, errNoReplicationQueue)
+}
@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"github.com/cenkalti/backoff"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// legacyRetryBudget names the budget shared by requests without a routing table. Their hosts are built per bucket by
+// upstream templates, keying on them would grow a budget and a metric series for every bucket.
+const legacyRetryBudget = "legacy"
+
+var (
+	errInvalidRetryPolicy = errors.New("retry attempts must be at least 1 and backoff and budget values must not be negative")
+
+	upstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_upstream_retries_total",
+		Help: "Requests retried against an upstream by the reason of the failed attempt.",
+	}, []string{"upstream", "reason"})
+	upstreamRetryBudgetExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_upstream_retry_budget_exhausted_total",
+		Help: "Failed requests that were not retried because the retry budget of the upstream was used up.",
+	}, []string{"upstream"})
+)
+
+func init() {
+	prometheus.MustRegister(upstreamRetries, upstreamRetryBudgetExhausted)
+}
+
+// RetryPolicy controls retries of safe requests that failed with a connection error or a 5xx from the upstream
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts of a request, 1 disables retries
+	MaxAttempts int
+
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// MaxBufferBytes bounds the size of PUT bodies buffered in memory so they can be retried
+	MaxBufferBytes int64
+
+	// BudgetRatio is the number of retries earned by each request, BudgetBurst the most retries that can be saved up.
+	// Once an upstream fails most requests the budget runs out and failures go straight to the client.
+	BudgetRatio float64
+	BudgetBurst int
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts < 1 || p.InitialBackoff < 0 || p.MaxBackoff < 0 || p.MaxBufferBytes < 0 || p.BudgetRatio < 0 || p.BudgetBurst < 0 {
+		return errInvalidRetryPolicy
+	}
+	return nil
+}
+
+// retryBudget is a token bucket refilled by requests and drained by retries
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	ratio  float64
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryTransport retries safe requests with exponential backoff, every attempt is signed again over the same headers
+// so the signature date stays fresh. Each upstream has its own budget so retries can't amplify an outage.
+type retryTransport struct {
+	log    *zap.Logger
+	base   http.RoundTripper
+	policy RetryPolicy
+
+	mu      sync.Mutex
+	budgets map[string]*retryBudget
+}
+
+// NewRetryTransport wraps base with the retry policy
+func NewRetryTransport(log *zap.Logger, base http.RoundTripper, policy RetryPolicy) (http.RoundTripper, error) {
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return &retryTransport{
+		log:     log,
+		base:    base,
+		policy:  policy,
+		budgets: make(map[string]*retryBudget),
+	}, nil
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.policy.MaxAttempts <= 1 || !t.retryable(req) {
+		return t.base.RoundTrip(req)
+	}
+	name := legacyRetryBudget
+	r := routeFromContext(req.Context())
+	if r != nil && r.upstream.Name != "" {
+		name = r.upstream.Name
+	}
+	budget := t.budget(name)
+	budget.deposit()
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = t.policy.InitialBackoff
+	b.MaxInterval = t.policy.MaxBackoff
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	attempt := req
+	for i := 1; ; i++ {
+		resp, err := t.base.RoundTrip(attempt)
+		reason := retryReason(resp, err)
+		if reason == "" || i >= t.policy.MaxAttempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		if !budget.withdraw() {
+			upstreamRetryBudgetExhausted.WithLabelValues(name).Inc()
+			t.log.Sugar().Warnw("retry budget exhausted, not retrying", "upstream", name, "reason", reason)
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		wait := b.NextBackOff()
+		t.log.Sugar().Infow("retrying upstream request", "upstream", name, "method", req.Method,
+			"attempt", i+1, "reason", reason, "backoff", wait)
+		upstreamRetries.WithLabelValues(name, reason).Inc()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+
+		if attempt, err = t.nextAttempt(req, r); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryable reports whether req is safe to send again, small PUT bodies that can't be replayed are buffered
+func (t *retryTransport) retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return canReplayBody(req)
+	case http.MethodPut:
+		if canReplayBody(req) {
+			return true
+		}
+		if req.ContentLength < 0 || req.ContentLength > t.policy.MaxBufferBytes {
+			return false
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		// A body that failed to read is shorter than its content length, the transport rejects it
+		return err == nil
+	}
+	return false
+}
+
+// nextAttempt clones req with a fresh body and signature
+func (t *retryTransport) nextAttempt(req *http.Request, r *route) (*http.Request, error) {
+	attempt := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		attempt.Body = body
+	}
+	if r == nil || r.signer == nil {
+		return attempt, nil
+	}
+	if err := proxy.ResignRequest(r.signer, attempt, r.upstream.Region); err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+func (t *retryTransport) budget(name string) *retryBudget {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.budgets[name]
+	if !ok {
+		b = &retryBudget{
+			tokens: float64(t.policy.BudgetBurst),
+			max:    float64(t.policy.BudgetBurst),
+			ratio:  t.policy.BudgetRatio,
+		}
+		t.budgets[name] = b
+	}
+	return b
+}
+
+// retryReason returns why an attempt should be retried, or an empty string when it succeeded or can't be helped
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		return "error"
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return strconv.Itoa(resp.StatusCode)
+	}
+	return ""
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/proxy"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyUpstream fails the first failures requests with a 503 and records every request it receives
+type flakyUpstream struct {
+	mu       sync.Mutex
+	failures int
+	bodies   []string
+	auth     []string
+
+	// signatures holds the outcome of verifying the signature of every request with the secret of testSigner
+	signatures []error
+}
+
+func (f *flakyUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bodies = append(f.bodies, string(body))
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	f.signatures = append(f.signatures, verifySignature(r, body))
+	if len(f.bodies) <= f.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
+}
+
+// verifySignature checks the v4 signature of r the way the upstream would, over the headers it names as signed
+func verifySignature(r *http.Request, body []byte) error {
+	auth := r.Header.Get("Authorization")
+	signed := proxy.SignedHeaders(auth)
+	date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if signed == nil || err != nil {
+		return fmt.Errorf("not signed: %q", auth)
+	}
+	scope := strings.Split(strings.SplitN(auth, "Credential=", 2)[1], "/")
+	check, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	for name, values := range r.Header {
+		if signed[strings.ToLower(name)] {
+			check.Header[name] = values
+		}
+	}
+	if _, err = testSigner().Sign(check, bytes.NewReader(body), "s3", scope[2], date); err != nil {
+		return err
+	}
+	if check.Header.Get("Authorization") != auth {
+		return fmt.Errorf("signature mismatch: got %q, expected %q", auth, check.Header.Get("Authorization"))
+	}
+	return nil
+}
+
+func newRetryTestHandler(t *testing.T, upstream *httptest.Server, policy RetryPolicy) *Handler {
+	h := newTestHandler(t, `
+upstreams:
+  - name: test
+    endpoint: `+strings.TrimPrefix(upstream.URL, "http://")+`
+    scheme: http
+default: test
+`)
+	log, _ := zap.NewDevelopment()
+	transport, err := NewRetryTransport(log, h.Proxies.transport, policy)
+	assert.NoError(t, err)
+	h.Proxies = NewProxyRegistry(transport, 0)
+	return h
+}
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     time.Millisecond,
+	MaxBufferBytes: 1024,
+	BudgetRatio:    1,
+	BudgetBurst:    10,
+}
+
+func TestRetryResignsAttempts(t *testing.T) {
+	flaky := &flakyUpstream{failures: 2}
+	upstream := httptest.NewServer(flaky)
+	defer upstream.Close()
+	h := newRetryTestHandler(t, upstream, testRetryPolicy)
+
+	req := httptest.NewRequest(http.MethodPut, "http://proxy.example.com/bucket/key", strings.NewReader("payload"))
+	req.Header.Set("Authorization", testAuthHeader)
+	req.Header.Set("Content-Type", "text/plain")
+	// Client headers are forwarded unsigned, a retry must not start signing them
+	req.Header.Set("X-Amz-Meta-Owner", "alice")
+	req.Header.Set("Accept-Encoding", "identity")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"payload", "payload", "payload"}, flaky.bodies)
+	for i, auth := range flaky.auth {
+		assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/"), auth)
+		assert.NotEqual(t, testAuthHeader, auth)
+		assert.NoError(t, flaky.signatures[i])
+		assert.Equal(t, proxy.SignedHeaders(flaky.auth[0]), proxy.SignedHeaders(auth))
+	}
+	assert.False(t, proxy.SignedHeaders(flaky.auth[0])["x-amz-meta-owner"])
+	assert.True(t, proxy.SignedHeaders(flaky.auth[0])["content-type"])
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	flaky := &flakyUpstream{failures: 5}
+	upstream := httptest.NewServer(flaky)
+	defer upstream.Close()
+	h := newRetryTestHandler(t, upstream, testRetryPolicy)
+
+	rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Len(t, flaky.bodies, 3)
+}
+
+func TestRetrySkipsUnsafeMethods(t *testing.T) {
+	flaky := &flakyUpstream{failures: 1}
+	upstream := httptest.NewServer(flaky)
+	defer upstream.Close()
+	h := newRetryTestHandler(t, upstream, testRetryPolicy)
+
+	rec := serveTestRequest(h, http.MethodPost, "http://proxy.example.com/bucket/key?uploads", "")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Len(t, flaky.bodies, 1)
+}
+
+func TestRetryBudget(t *testing.T) {
+	flaky := &flakyUpstream{failures: 100}
+	upstream := httptest.NewServer(flaky)
+	defer upstream.Close()
+	policy := testRetryPolicy
+	policy.BudgetRatio = 0
+	policy.BudgetBurst = 2
+	h := newRetryTestHandler(t, upstream, policy)
+
+	// The first request spends the whole budget, later ones are only attempted once
+	for i := 0; i < 3; i++ {
+		rec := serveTestRequest(h, http.MethodGet, "http://proxy.example.com/bucket/key", "")
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	}
+	assert.Len(t, flaky.bodies, 5)
+}
+
+func TestRetryPolicyValidation(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	_, err := NewRetryTransport(log, http.DefaultTransport, RetryPolicy{})
+	assert.ErrorIs(t, err, errInvalidRetryPolicy)
+	_, err = NewRetryTransport(log, http.DefaultTransport, RetryPolicy{MaxAttempts: 1, BudgetRatio: -1})
+	assert.ErrorIs(t, err, errInvalidRetryPolicy)
+}
+
+func TestRetryBudgetWithoutRoutingTable(t *testing.T) {
+	flaky := &flakyUpstream{failures: 100}
+	upstream := httptest.NewServer(flaky)
+	defer upstream.Close()
+	log, _ := zap.NewDevelopment()
+	transport, err := NewRetryTransport(log, http.DefaultTransport, testRetryPolicy)
+	assert.NoError(t, err)
+
+	// Upstream templates give every bucket its own host, they share one budget
+	for _, bucket := range []string{"one", "two", "three"} {
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/key", nil)
+		req.Host = bucket + ".s3.example.com"
+		resp, err := transport.RoundTrip(req)
+		assert.NoError(t, err)
+		_ = resp.Body.Close()
+	}
+	budgets := transport.(*retryTransport).budgets
+	assert.Len(t, budgets, 1)
+	assert.Contains(t, budgets, legacyRetryBudget)
+}
@@ -3,38 +3,71 @@ package handler
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/ceph/go-ceph/rgw/admin"
 	"github.com/coreweave/aws-s3-reverse-proxy/internal"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
+// RgwCredentialSource tags credentials loaded from the rgw admin api
+const RgwCredentialSource = "rgw"
+
 type RgwAdminClient struct {
-	client []*admin.API
+	client   []*admin.API
+	clusters []string
 }
 
-func NewRgwAdminClient(adminAccess, adminSecret, endpoint string) internal.AdminClient {
+var (
+	errMismatchedRgwKeys     = errors.New("mismatched endpoint and key pairs for rgw endpoints")
+	errMismatchedRgwClusters = errors.New("mismatched cluster names and rgw endpoints")
+)
+
+// NewRgwAdminClient builds a client per comma separated endpoint. Keys loaded from an endpoint are owned by the
+// cluster at the same position in clusters, when clusters is empty the endpoint host names the cluster.
+func NewRgwAdminClient(adminAccess, adminSecret, endpoint, clusters string, httpClient *http.Client) (internal.AdminClient, error) {
 	endpoints := strings.Split(endpoint, ",")
 	keys := strings.Split(adminAccess, ",")
 	secrets := strings.Split(adminSecret, ",")
-	if len(endpoints) != len(keys) && len(endpoints) != len(secrets) {
-		panic(errors.New("mismatched endpoint and key pairs for rgw endpoints"))
+	if len(endpoints) != len(keys) || len(endpoints) != len(secrets) {
+		return nil, errMismatchedRgwKeys
+	}
+	var names []string
+	if clusters != "" {
+		names = strings.Split(clusters, ",")
+		if len(names) != len(endpoints) {
+			return nil, errMismatchedRgwClusters
+		}
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
 	}
 	var clients []*admin.API
 	for i := 0; i < len(endpoints); i++ {
-		goCephClient, err := admin.New(endpoints[i], keys[i], secrets[i], http.DefaultClient)
+		goCephClient, err := admin.New(endpoints[i], keys[i], secrets[i], httpClient)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("unable to build rgw admin client for %s: %w", endpoints[i], err)
 		}
 		clients = append(clients, goCephClient)
+		if clusters == "" {
+			names = append(names, clusterFromEndpoint(endpoints[i]))
+		}
+	}
+	return &RgwAdminClient{client: clients, clusters: names}, nil
+}
+
+func clusterFromEndpoint(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil && u.Hostname() != "" {
+		return u.Hostname()
 	}
-	return &RgwAdminClient{client: clients}
+	return endpoint
 }
 
-func (r *RgwAdminClient) LoadUserCredentials() (map[string]string, error) {
+func (r *RgwAdminClient) LoadUserCredentials() (map[string]internal.Credential, error) {
 	ctx := context.Background()
-	results := make(map[string]string)
-	for _, c := range r.client {
+	results := make(map[string]internal.Credential)
+	for i, c := range r.client {
 		userResult, err := c.GetUsers(ctx)
 
 		if err != nil {
@@ -46,7 +79,16 @@ func (r *RgwAdminClient) LoadUserCredentials() (map[string]string, error) {
 				return nil, err
 			}
 			for _, keys := range userInfo.Keys {
-				results[keys.AccessKey] = keys.SecretKey
+				// A key is owned by the first cluster it was found in
+				if _, ok := results[keys.AccessKey]; ok {
+					continue
+				}
+				results[keys.AccessKey] = internal.Credential{
+					SecretKey: keys.SecretKey,
+					Source:    RgwCredentialSource,
+					Cluster:   r.clusters[i],
+					User:      user,
+				}
 			}
 		}
 	}
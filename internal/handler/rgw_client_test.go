@@ -15,3 +15,34 @@ func TestEndpointsSplit(t *testing.T) {
 	assert.Equal(t, values[1], "https://object.lga1.coreweave.com")
 	assert.Equal(t, values[2], "https://object.ord1.coreweave.com")
 }
+
+func TestClusterFromEndpoint(t *testing.T) {
+	assert.Equal(t, "object.las1.coreweave.com", clusterFromEndpoint("https://object.las1.coreweave.com"))
+	assert.Equal(t, "object.lga1.coreweave.com", clusterFromEndpoint("http://object.lga1.coreweave.com:8080"))
+}
+
+func TestRgwClusterNames(t *testing.T) {
+	client, err := NewRgwAdminClient("a,b", "x,y", "https://object.las1.coreweave.com,https://object.lga1.coreweave.com", "las1,lga1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"las1", "lga1"}, client.(*RgwAdminClient).clusters)
+
+	client, err = NewRgwAdminClient("a", "x", "https://object.las1.coreweave.com", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"object.las1.coreweave.com"}, client.(*RgwAdminClient).clusters)
+
+	_, err = NewRgwAdminClient("a,b", "x,y", "https://object.las1.coreweave.com,https://object.lga1.coreweave.com", "las1", nil)
+	assert.ErrorIs(t, err, errMismatchedRgwClusters)
+}
+
+func TestRgwMismatchedKeys(t *testing.T) {
+	endpoints := "https://object.las1.coreweave.com,https://object.lga1.coreweave.com"
+
+	// Any single list out of step with the endpoints is rejected
+	_, err := NewRgwAdminClient("a,b", "x", endpoints, "", nil)
+	assert.ErrorIs(t, err, errMismatchedRgwKeys)
+	_, err = NewRgwAdminClient("a", "x,y", endpoints, "", nil)
+	assert.ErrorIs(t, err, errMismatchedRgwKeys)
+
+	_, err = NewRgwAdminClient("a,b", "x,y", "https://object.las1.coreweave.com,", "", nil)
+	assert.Error(t, err)
+}
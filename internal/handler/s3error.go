@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// s3Error is the error document S3 answers failed requests with
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+func s3ErrorBody(code, message, resource string) []byte {
+	body, _ := xml.Marshal(s3Error{Code: code, Message: message, Resource: resource})
+	return append([]byte(xml.Header), body...)
+}
+
+// writeS3Error answers with an S3 error document so SDKs surface the code rather than a bare status
+func writeS3Error(w http.ResponseWriter, status int, code, message, resource string) {
+	body := s3ErrorBody(code, message, resource)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// s3ErrorResponse builds an S3 error response to req for transports answering in place of the upstream
+func s3ErrorResponse(req *http.Request, status int, code, message string) *http.Response {
+	body := s3ErrorBody(code, message, req.URL.Path)
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/xml"}, "Content-Length": {strconv.Itoa(len(body))}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -2,7 +2,10 @@ package handler
 
 import (
 	"errors"
+	"fmt"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal"
 	"go.uber.org/zap"
+	"net"
 	"regexp"
 	"strings"
 )
@@ -10,55 +13,229 @@ import (
 var errNoHostMatch = errors.New("unable to modify host with upstream changes")
 var errMissingUpstreamParameters = errors.New("missing valid parameters to format upstream requests")
 
+// Host parts a template can name that the rest of the pipeline uses
+const (
+	// HostPartBucket is the bucket the request addresses, it may span several labels of the host
+	HostPartBucket = "bucket"
+	// HostPartRegion is the region upstream requests are signed for
+	HostPartRegion = "region"
+)
+
+var hostPlaceholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+var hostPartNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// HostTemplate rewrites hosts shaped like a pattern such as {bucket}.object.{region}.example.com into the host
+// a replacement such as {bucket}.s3.{region}.internal builds from the named parts
+type HostTemplate struct {
+	match *regexp.Regexp
+
+	// replace is the replacement in the syntax of regexp.Expand
+	replace string
+}
+
+// ParseHostTemplate parses a template formatted as MATCH -> REPLACE. Every placeholder but {bucket} matches a
+// single host label, the replacement may only name placeholders of the match.
+func ParseHostTemplate(val string) (*HostTemplate, error) {
+	parts := strings.SplitN(val, "->", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid host template %q, expected MATCH -> REPLACE", val)
+	}
+	match, replace := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if match == "" || replace == "" {
+		return nil, fmt.Errorf("invalid host template %q, expected MATCH -> REPLACE", val)
+	}
+
+	expr := "^"
+	names := make(map[string]bool)
+	err := splitHostTemplate(match, func(literal string) {
+		expr += regexp.QuoteMeta(strings.ToLower(literal))
+	}, func(name string) error {
+		if names[name] {
+			return fmt.Errorf("placeholder {%s} is named twice", name)
+		}
+		names[name] = true
+		part := `[^.]+`
+		if name == HostPartBucket {
+			part = `.+`
+		}
+		expr += "(?P<" + name + ">" + part + ")"
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid match of host template %q: %w", val, err)
+	}
+
+	var expand string
+	err = splitHostTemplate(replace, func(literal string) {
+		expand += strings.ReplaceAll(literal, "$", "$$")
+	}, func(name string) error {
+		if !names[name] {
+			return fmt.Errorf("placeholder {%s} is not named by the match", name)
+		}
+		expand += "${" + name + "}"
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid replacement of host template %q: %w", val, err)
+	}
+	return &HostTemplate{match: regexp.MustCompile(expr + "$"), replace: expand}, nil
+}
+
+// splitHostTemplate calls literal and placeholder for the parts of a template in order
+func splitHostTemplate(template string, literal func(string), placeholder func(string) error) error {
+	last := 0
+	for _, m := range hostPlaceholderRegexp.FindAllStringSubmatchIndex(template, -1) {
+		if err := hostTemplateLiteral(template[last:m[0]], literal); err != nil {
+			return err
+		}
+		name := template[m[2]:m[3]]
+		if !hostPartNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid placeholder {%s}", name)
+		}
+		if err := placeholder(name); err != nil {
+			return err
+		}
+		last = m[1]
+	}
+	return hostTemplateLiteral(template[last:], literal)
+}
+
+func hostTemplateLiteral(s string, literal func(string)) error {
+	if strings.ContainsAny(s, "{}") {
+		return fmt.Errorf("unbalanced brace in %q", s)
+	}
+	if s != "" {
+		literal(s)
+	}
+	return nil
+}
+
+// Expand returns the rewritten host and the parts the template named, ok is false when host doesn't match.
+// The port of host is ignored.
+func (t *HostTemplate) Expand(host string) (result string, parts map[string]string, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	submatches := t.match.FindStringSubmatchIndex(host)
+	if submatches == nil {
+		return "", nil, false
+	}
+	parts = make(map[string]string)
+	for i, name := range t.match.SubexpNames() {
+		if name != "" {
+			parts[name] = host[submatches[2*i]:submatches[2*i+1]]
+		}
+	}
+	return string(t.match.ExpandString(nil, t.replace, host, submatches)), parts, true
+}
+
+// UpstreamReplacer rewrites an origin host into an upstream host, either by a template or by replacing a pattern
+// in hosts with LevelsDeep dots that match MatchPattern
 type UpstreamReplacer struct {
 	LevelsDeep     int
 	MatchPattern   *regexp.Regexp
 	ReplacePattern *regexp.Regexp
 	ReplaceWith    string
+
+	// Template replaces the patterns when set
+	Template *HostTemplate
 }
 
 func (u UpstreamReplacer) IsMatch(host string) bool {
+	if u.Template != nil {
+		_, _, ok := u.Template.Expand(host)
+		return ok
+	}
 	return u.MatchPattern.MatchString(host)
 }
 
 func (u UpstreamReplacer) MatchAndReplace(host string) (string, error) {
+	result, _, err := u.Rewrite(host)
+	return result, err
+}
+
+// Rewrite returns the upstream host for host and the parts a template named, parts is nil for pattern replacers
+func (u UpstreamReplacer) Rewrite(host string) (string, map[string]string, error) {
+	if u.Template != nil {
+		if result, parts, ok := u.Template.Expand(host); ok {
+			return result, parts, nil
+		}
+		return "", nil, errNoHostMatch
+	}
 	if u.LevelsDeep != strings.Count(host, ".") {
-		return "", errNoHostMatch
+		return "", nil, errNoHostMatch
 	}
 	if u.MatchPattern.MatchString(host) {
-		return u.ReplacePattern.ReplaceAllString(host, u.ReplaceWith), nil
+		return u.ReplacePattern.ReplaceAllString(host, u.ReplaceWith), nil, nil
 	}
-	return "", errNoHostMatch
+	return "", nil, errNoHostMatch
 }
 
 type UpstreamHelper struct {
 	log              *zap.Logger
 	upstreamEndpoint *string
 	replacers        []UpstreamReplacer
+
+	// Upstream host per rgw cluster, used when the origin host does not name a cluster
+	clusterUpstreams map[string]string
+	owners           internal.ClusterOwners
 }
 
-func NewUpstreamHelper(log *zap.Logger, upstreamEndpoint *string, replacers []UpstreamReplacer) (*UpstreamHelper, error) {
-	if upstreamEndpoint == nil && replacers == nil {
+func NewUpstreamHelper(log *zap.Logger, upstreamEndpoint *string, replacers []UpstreamReplacer, clusterUpstreams map[string]string, owners internal.ClusterOwners) (*UpstreamHelper, error) {
+	if upstreamEndpoint == nil && replacers == nil && len(clusterUpstreams) == 0 {
+		return nil, errMissingUpstreamParameters
+	}
+	if len(clusterUpstreams) > 0 && owners == nil {
 		return nil, errMissingUpstreamParameters
 	}
 
 	return &UpstreamHelper{
 		replacers:        replacers,
 		upstreamEndpoint: upstreamEndpoint,
+		clusterUpstreams: clusterUpstreams,
+		owners:           owners,
 		log:              log,
 	}, nil
 }
 
-func (u UpstreamHelper) PrepHost(originHost string) (result string, err error) {
+// PrepHost finds the upstream host for a request, hosts that match no replacer are routed to the cluster owning accessKey
+func (u UpstreamHelper) PrepHost(originHost, accessKey string) (string, error) {
+	result, _, err := u.ResolveHost(originHost, accessKey)
+	return result, err
+}
+
+// ResolveHost is PrepHost that also returns the parts of originHost named by a template replacer, such as
+// HostPartBucket and HostPartRegion. parts is nil when no template matched.
+func (u UpstreamHelper) ResolveHost(originHost, accessKey string) (result string, parts map[string]string, err error) {
 	if u.upstreamEndpoint != nil {
-		return *u.upstreamEndpoint, nil
+		return *u.upstreamEndpoint, nil, nil
 	}
 
+	err = errNoHostMatch
 	for _, replace := range u.replacers {
-		if result, err = replace.MatchAndReplace(originHost); err == nil {
-			return result, nil
+		if result, parts, err = replace.Rewrite(originHost); err == nil {
+			return result, parts, nil
 		}
 	}
+	if accessKey != "" && len(u.clusterUpstreams) > 0 {
+		result, err = u.hostForKey(accessKey)
+		return result, nil, err
+	}
 	u.log.Sugar().Infow("did not match the origin format, err no host", "host", originHost)
-	return "", err
+	return "", nil, err
+}
+
+func (u UpstreamHelper) hostForKey(accessKey string) (string, error) {
+	cluster, err := u.owners.GetCluster(accessKey)
+	if err != nil {
+		u.log.Sugar().Infow("unable to find owning cluster for access key", "accessKey", accessKey, "error", err.Error())
+		return "", errNoHostMatch
+	}
+	if host, ok := u.clusterUpstreams[cluster]; ok {
+		u.log.Sugar().Debugw("routing by access key owner", "accessKey", accessKey, "cluster", cluster, "host", host)
+		return host, nil
+	}
+	u.log.Sugar().Infow("no upstream configured for owning cluster", "accessKey", accessKey, "cluster", cluster)
+	return "", errNoHostMatch
 }
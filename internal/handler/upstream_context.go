@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"context"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/routing"
+)
+
+type routeContextKey struct{}
+
+// route is what the handler decided for a proxied request, the transports read it from the request context
+type route struct {
+	upstream *routing.Upstream
+
+	// hashKey is the key the upstream pool balances the request by
+	hashKey string
+
+	// signer re-signs retried requests, nil when the request is forwarded unsigned
+	signer *v4.Signer
+
+	// aliases renames buckets in responses back to their client names
+	aliases *routing.Aliases
+
+	// prefix is stripped from keys in responses, empty outside namespaced buckets
+	prefix string
+
+	// objectRequest is set for requests whose successful response body is object data
+	objectRequest bool
+
+	// location is the bucket and key the request addresses upstream, after aliasing and namespacing
+	location routing.Location
+
+	// accessKey signed the request, empty for unsigned requests
+	accessKey string
+
+	// replica receives the objects the request writes or deletes, nil when writes are not replicated
+	replica *routing.Replica
+
+	// migration reads keys the upstream doesn't have from the upstream the bucket moves away from, nil outside
+	// migrated buckets
+	migration *routing.Migration
+
+	// variant is the side of a canary rule the request was sent to, zero outside canary rules
+	variant routing.Variant
+
+	// reported is set once the outcome of the request was recorded by the circuit breaker of the upstream
+	reported bool
+}
+
+func withRoute(ctx context.Context, r *route) context.Context {
+	return context.WithValue(ctx, routeContextKey{}, r)
+}
+
+// routeFromContext returns the route of a proxied request, nil for requests not built by the handler
+func routeFromContext(ctx context.Context) *route {
+	r, _ := ctx.Value(routeContextKey{}).(*route)
+	return r
+}
@@ -1,10 +1,17 @@
 package handler
 
 import (
+	"errors"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/mocks"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -24,32 +31,200 @@ func TestUpstreamProxy(t *testing.T) {
 		LevelsDeep:     4,
 	},
 	}
-	upstream, _ := NewUpstreamHelper(log, nil, replacers)
+	upstream, _ := NewUpstreamHelper(log, nil, replacers, nil, nil)
 
 	testValue := "my-bucket.object.las1.coreweave.com"
 	expectedValue := "my-bucket.s3.las1.coreweave.com"
 
-	result, err := upstream.PrepHost(testValue)
+	result, err := upstream.PrepHost(testValue, "")
 
 	assert.NoError(t, err)
 	assert.Equal(t, expectedValue, result)
 
 	testValue2 := "obj.las1.coreweave.com"
 	expectedValue = "s3.las1.coreweave.com"
-	result, err = upstream.PrepHost(testValue2)
+	result, err = upstream.PrepHost(testValue2, "")
 	assert.NoError(t, err)
 	assert.Equal(t, expectedValue, result)
 }
 
 func TestUpstreamWithEndpoint(t *testing.T) {
 	log, _ := zap.NewDevelopment()
-	upstream, _ := NewUpstreamHelper(log, aws.String("s3.las1.coreweave.com"), nil)
+	upstream, _ := NewUpstreamHelper(log, aws.String("s3.las1.coreweave.com"), nil, nil, nil)
 
 	testValue := "my-bucket.s3.las1.coreweave.com"
 	expectedValue := "s3.las1.coreweave.com"
 
-	result, err := upstream.PrepHost(testValue)
+	result, err := upstream.PrepHost(testValue, "")
 
 	assert.NoError(t, err)
 	assert.Equal(t, expectedValue, result)
 }
+
+func TestUpstreamRoutesByKeyOwner(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	owners := mocks.NewMockClusterOwners(ctrl)
+	owners.EXPECT().GetCluster("lgakey").Return("lga1", nil).AnyTimes()
+	owners.EXPECT().GetCluster("unknown").Return("", errors.New("no key")).AnyTimes()
+	owners.EXPECT().GetCluster("phxkey").Return("phx1", nil).AnyTimes()
+	replacers := []UpstreamReplacer{{
+		MatchPattern:   regexp.MustCompile("(^.*).object.(las1)|(lga1)|(ord1)|.coreweave.com"),
+		ReplacePattern: regexp.MustCompile(".object."),
+		ReplaceWith:    ".s3.",
+		LevelsDeep:     4,
+	}}
+	clusters := map[string]string{
+		"las1": "s3.las1.coreweave.com",
+		"lga1": "s3.lga1.coreweave.com",
+	}
+	upstream, err := NewUpstreamHelper(log, nil, replacers, clusters, owners)
+	assert.NoError(t, err)
+
+	// A host naming the cluster still wins over the key owner
+	result, err := upstream.PrepHost("my-bucket.object.las1.coreweave.com", "lgakey")
+	assert.NoError(t, err)
+	assert.Equal(t, "my-bucket.s3.las1.coreweave.com", result)
+
+	result, err = upstream.PrepHost("s3.coreweave.com", "lgakey")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3.lga1.coreweave.com", result)
+
+	_, err = upstream.PrepHost("s3.coreweave.com", "unknown")
+	assert.ErrorIs(t, err, errNoHostMatch)
+	_, err = upstream.PrepHost("s3.coreweave.com", "phxkey")
+	assert.ErrorIs(t, err, errNoHostMatch)
+	_, err = upstream.PrepHost("s3.coreweave.com", "")
+	assert.ErrorIs(t, err, errNoHostMatch)
+
+	_, err = NewUpstreamHelper(log, nil, nil, clusters, nil)
+	assert.ErrorIs(t, err, errMissingUpstreamParameters)
+}
+
+func TestParseUpstreamMatcher(t *testing.T) {
+	replacer, err := parseUpstreamMatcher(`(^.*).object.(las1)|(lga1)|(ord1)|.coreweave.com:.object.:.s3.:4`)
+	assert.NoError(t, err)
+	assert.Equal(t, ".s3.", replacer.ReplaceWith)
+	assert.Equal(t, 4, replacer.LevelsDeep)
+
+	// The old flag default has a single part and used to index out of range
+	_, err = parseUpstreamMatcher("object")
+	assert.Error(t, err)
+	_, err = parseUpstreamMatcher("(:.object.:.s3.:4")
+	assert.Error(t, err)
+	_, err = parseUpstreamMatcher("object:.object.:.s3.:four")
+	assert.Error(t, err)
+
+	replacer, err = parseUpstreamMatcher("{bucket}.object.{region}.example.com -> {bucket}.s3.{region}.internal")
+	assert.NoError(t, err)
+	assert.NotNil(t, replacer.Template)
+	_, err = parseUpstreamMatcher("{bucket}.object.example.com -> {bucket}.s3.{region}.internal")
+	assert.Error(t, err)
+}
+
+func TestHostTemplate(t *testing.T) {
+	template, err := ParseHostTemplate("{bucket}.object.{region}.example.com -> {bucket}.s3.{region}.internal")
+	assert.NoError(t, err)
+
+	host, parts, ok := template.Expand("my-bucket.object.las1.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "my-bucket.s3.las1.internal", host)
+	assert.Equal(t, map[string]string{"bucket": "my-bucket", "region": "las1"}, parts)
+
+	// Buckets may be dotted, other parts are a single label, the port and case are ignored
+	host, parts, ok = template.Expand("My.Bucket.object.lga1.example.com:8443")
+	assert.True(t, ok)
+	assert.Equal(t, "my.bucket.s3.lga1.internal", host)
+	assert.Equal(t, map[string]string{"bucket": "my.bucket", "region": "lga1"}, parts)
+
+	for _, host := range []string{
+		"object.las1.example.com",
+		"my-bucket.object.las1.example.org",
+		"my-bucket.object.las1.sub.example.com",
+		"my-bucket.objectxlas1.example.com",
+	} {
+		_, _, ok = template.Expand(host)
+		assert.False(t, ok, host)
+	}
+
+	for _, val := range []string{
+		"{bucket}.object.example.com",
+		"{bucket}.object.example.com -> ",
+		"{bucket}.{bucket}.example.com -> {bucket}.internal",
+		"{Bucket}.example.com -> s3.internal",
+		"{bucket.example.com -> s3.internal",
+		"{bucket}.example.com -> {bucket}}.internal",
+	} {
+		_, err = ParseHostTemplate(val)
+		assert.Error(t, err, val)
+	}
+}
+
+func TestUpstreamTemplateRoutesAndSigns(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer upstream.Close()
+
+	template, err := ParseHostTemplate("{bucket}.object.{region}.example.com -> " + strings.TrimPrefix(upstream.URL, "http://"))
+	assert.NoError(t, err)
+	helper, err := NewUpstreamHelper(log, nil, []UpstreamReplacer{{Template: template}}, nil, nil)
+	assert.NoError(t, err)
+	host, parts, err := helper.ResolveHost("my-bucket.object.las1.example.com", "")
+	assert.NoError(t, err)
+	assert.Equal(t, strings.TrimPrefix(upstream.URL, "http://"), host)
+	assert.Equal(t, "las1", parts[HostPartRegion])
+
+	ctrl := gomock.NewController(t)
+	mCache := mocks.NewMockAuthCache(ctrl)
+	mCache.EXPECT().GetRequestSigner("AKID").Return(testSigner(), nil).AnyTimes()
+	h := &Handler{
+		log:            log,
+		AuthParser:     NewAccessKeyParser(),
+		AuthCache:      mCache,
+		UpstreamScheme: "http",
+		Proxies:        NewProxyRegistry(&backendTransport{log: log, base: transport.NewUpstreamTransport(transport.UpstreamConfig{})}, 0),
+	}
+	h.storeUpstreams(&upstreamConfig{helper: helper})
+
+	req := httptest.NewRequest(http.MethodGet, "http://my-bucket.object.las1.example.com/some/key", nil)
+	req.Header.Set("Authorization", testAuthHeader)
+	proxyReq, err := h.BuildUpstreamRequest(req)
+	assert.NoError(t, err)
+	route := routeFromContext(proxyReq.Context())
+	assert.Equal(t, "my-bucket", route.location.Bucket)
+	assert.Equal(t, "some/key", route.location.Key)
+
+	rec := serveTestRequest(h, http.MethodGet, "http://my-bucket.object.las1.example.com/some/key", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	// The host already names the bucket, it is not moved into the path
+	assert.Equal(t, "/some/key", received.URL.Path)
+	assert.Contains(t, received.Header.Get("Authorization"), "/las1/s3/aws4_request")
+}
+
+func TestUpstreamSchemeFollowsListener(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	helper, err := NewUpstreamHelper(log, aws.String("s3.las1.coreweave.com"), nil, nil, nil)
+	assert.NoError(t, err)
+	ctrl := gomock.NewController(t)
+	mCache := mocks.NewMockAuthCache(ctrl)
+	mCache.EXPECT().GetRequestSigner("AKID").Return(testSigner(), nil).AnyTimes()
+	h := &Handler{log: log, AuthParser: NewAccessKeyParser(), AuthCache: mCache}
+	h.storeUpstreams(&upstreamConfig{helper: helper})
+
+	build := func(target string) string {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", testAuthHeader)
+		proxyReq, err := h.BuildUpstreamRequest(req)
+		assert.NoError(t, err)
+		return proxyReq.URL.Scheme
+	}
+
+	assert.Equal(t, "http", build("http://proxy.example.com/bucket/key"))
+	// httptest sets TLS for https targets like the https listener does
+	assert.Equal(t, "https", build("https://proxy.example.com/bucket/key"))
+	h.UpstreamScheme = "https"
+	assert.Equal(t, "https", build("http://proxy.example.com/bucket/key"))
+}
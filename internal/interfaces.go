@@ -12,16 +12,36 @@ import (
 var ErrNoAccessKeyFound = errors.New("no access key found in Authorization header")
 var ErrNoAuthHeaderFound = errors.New("no auth header found between listed formats")
 
+// Credential is the secret for an access key along with the source and rgw cluster it was loaded from
+type Credential struct {
+	SecretKey string
+	Source    string
+	Cluster   string
+
+	// User is the identity owning the key, empty when the source doesn't know it
+	User string
+}
+
 type AdminClient interface {
-	LoadUserCredentials() (map[string]string, error)
+	LoadUserCredentials() (map[string]Credential, error)
 }
 
 type AuthParser interface {
 	FindAccessKey(authHeader string) (string, error)
 }
 
+// ClusterOwners resolves the rgw cluster an access key belongs to
+type ClusterOwners interface {
+	GetCluster(accessKeyId string) (string, error)
+}
+
 type AuthCache interface {
 	RunSync(interval time.Duration, ctx context.Context)
 	GetRequestSigner(accessKeyId string) (*v4.Signer, error)
 	Load() (err error)
+	Refresh(accessKeyIds ...string) error
+	Put(accessKeyId string, cred Credential) error
+	Evict(accessKeyId string)
+	GetCluster(accessKeyId string) (string, error)
+	GetUser(accessKeyId string) (string, error)
 }
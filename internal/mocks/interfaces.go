@@ -10,6 +10,7 @@ import (
 	time "time"
 
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	internal "github.com/coreweave/aws-s3-reverse-proxy/internal"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -37,10 +38,10 @@ func (m *MockAdminClient) EXPECT() *MockAdminClientMockRecorder {
 }
 
 // LoadUserCredentials mocks base method.
-func (m *MockAdminClient) LoadUserCredentials() (map[string]string, error) {
+func (m *MockAdminClient) LoadUserCredentials() (map[string]internal.Credential, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "LoadUserCredentials")
-	ret0, _ := ret[0].(map[string]string)
+	ret0, _ := ret[0].(map[string]internal.Credential)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
@@ -89,6 +90,44 @@ func (mr *MockAuthParserMockRecorder) FindAccessKey(authHeader interface{}) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindAccessKey", reflect.TypeOf((*MockAuthParser)(nil).FindAccessKey), authHeader)
 }
 
+// MockClusterOwners is a mock of ClusterOwners interface.
+type MockClusterOwners struct {
+	ctrl     *gomock.Controller
+	recorder *MockClusterOwnersMockRecorder
+}
+
+// MockClusterOwnersMockRecorder is the mock recorder for MockClusterOwners.
+type MockClusterOwnersMockRecorder struct {
+	mock *MockClusterOwners
+}
+
+// NewMockClusterOwners creates a new mock instance.
+func NewMockClusterOwners(ctrl *gomock.Controller) *MockClusterOwners {
+	mock := &MockClusterOwners{ctrl: ctrl}
+	mock.recorder = &MockClusterOwnersMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockClusterOwners) EXPECT() *MockClusterOwnersMockRecorder {
+	return m.recorder
+}
+
+// GetCluster mocks base method.
+func (m *MockClusterOwners) GetCluster(accessKeyId string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCluster", accessKeyId)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCluster indicates an expected call of GetCluster.
+func (mr *MockClusterOwnersMockRecorder) GetCluster(accessKeyId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCluster", reflect.TypeOf((*MockClusterOwners)(nil).GetCluster), accessKeyId)
+}
+
 // MockAuthCache is a mock of AuthCache interface.
 type MockAuthCache struct {
 	ctrl     *gomock.Controller
@@ -112,6 +151,33 @@ func (m *MockAuthCache) EXPECT() *MockAuthCacheMockRecorder {
 	return m.recorder
 }
 
+// Evict mocks base method.
+func (m *MockAuthCache) Evict(accessKeyId string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Evict", accessKeyId)
+}
+
+// Evict indicates an expected call of Evict.
+func (mr *MockAuthCacheMockRecorder) Evict(accessKeyId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Evict", reflect.TypeOf((*MockAuthCache)(nil).Evict), accessKeyId)
+}
+
+// GetCluster mocks base method.
+func (m *MockAuthCache) GetCluster(accessKeyId string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCluster", accessKeyId)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCluster indicates an expected call of GetCluster.
+func (mr *MockAuthCacheMockRecorder) GetCluster(accessKeyId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCluster", reflect.TypeOf((*MockAuthCache)(nil).GetCluster), accessKeyId)
+}
+
 // GetRequestSigner mocks base method.
 func (m *MockAuthCache) GetRequestSigner(accessKeyId string) (*v4.Signer, error) {
 	m.ctrl.T.Helper()
@@ -127,6 +193,21 @@ func (mr *MockAuthCacheMockRecorder) GetRequestSigner(accessKeyId interface{}) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRequestSigner", reflect.TypeOf((*MockAuthCache)(nil).GetRequestSigner), accessKeyId)
 }
 
+// GetUser mocks base method.
+func (m *MockAuthCache) GetUser(accessKeyId string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUser", accessKeyId)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUser indicates an expected call of GetUser.
+func (mr *MockAuthCacheMockRecorder) GetUser(accessKeyId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUser", reflect.TypeOf((*MockAuthCache)(nil).GetUser), accessKeyId)
+}
+
 // Load mocks base method.
 func (m *MockAuthCache) Load() error {
 	m.ctrl.T.Helper()
@@ -141,6 +222,38 @@ func (mr *MockAuthCacheMockRecorder) Load() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Load", reflect.TypeOf((*MockAuthCache)(nil).Load))
 }
 
+// Put mocks base method.
+func (m *MockAuthCache) Put(accessKeyId string, cred internal.Credential) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Put", accessKeyId, cred)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Put indicates an expected call of Put.
+func (mr *MockAuthCacheMockRecorder) Put(accessKeyId, cred interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*MockAuthCache)(nil).Put), accessKeyId, cred)
+}
+
+// Refresh mocks base method.
+func (m *MockAuthCache) Refresh(accessKeyIds ...string) error {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{}
+	for _, a := range accessKeyIds {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Refresh", varargs...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Refresh indicates an expected call of Refresh.
+func (mr *MockAuthCacheMockRecorder) Refresh(accessKeyIds ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Refresh", reflect.TypeOf((*MockAuthCache)(nil).Refresh), accessKeyIds...)
+}
+
 // RunSync mocks base method.
 func (m *MockAuthCache) RunSync(interval time.Duration, ctx context.Context) {
 	m.ctrl.T.Helper()
@@ -3,8 +3,10 @@ package proxy
 import (
 	"bytes"
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -20,12 +22,54 @@ func SignRequestWithTime(signer *v4.Signer, req *http.Request, region string, si
 			return err
 		}
 		body = bytes.NewReader(b)
+		// The body is buffered anyway, let it be replayed for failover and retries
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}
 	}
 
 	_, err := signer.Sign(req, body, "s3", region, signTime)
 	return err
 }
 
+// ResignRequest signs req again, such as a retried copy whose signature date went stale, over the same headers as
+// its current signature. Headers added after req was signed, like the client headers copied onto proxied requests,
+// stay unsigned so every attempt is signed the same way.
+func ResignRequest(signer *v4.Signer, req *http.Request, region string) error {
+	signed := SignedHeaders(req.Header.Get("Authorization"))
+	if signed == nil {
+		return SignRequest(signer, req, region)
+	}
+	unsigned := http.Header{}
+	for name, values := range req.Header {
+		if !signed[strings.ToLower(name)] {
+			unsigned[name] = values
+			delete(req.Header, name)
+		}
+	}
+	if err := SignRequest(signer, req, region); err != nil {
+		return err
+	}
+	CopyHeaderWithoutOverwrite(req.Header, unsigned)
+	return nil
+}
+
+// SignedHeaders returns the lower case names of the headers a v4 Authorization header covers, nil when it names
+// none
+func SignedHeaders(authorization string) map[string]bool {
+	for _, field := range strings.Split(authorization, ",") {
+		field = strings.TrimSpace(field)
+		if i := strings.LastIndex(field, "SignedHeaders="); i >= 0 {
+			signed := map[string]bool{}
+			for _, name := range strings.Split(field[i+len("SignedHeaders="):], ";") {
+				signed[name] = true
+			}
+			return signed
+		}
+	}
+	return nil
+}
+
 func CopyHeaderWithoutOverwrite(dst http.Header, src http.Header) {
 	for k, v := range src {
 		if _, ok := dst[k]; !ok {
@@ -35,3 +79,13 @@ func CopyHeaderWithoutOverwrite(dst http.Header, src http.Header) {
 		}
 	}
 }
+
+// SignStreamingRequest signs req without hashing its body so the body can be streamed, the payload is declared
+// UNSIGNED-PAYLOAD. The body is left attached to req.
+func SignStreamingRequest(signer *v4.Signer, req *http.Request, region string) error {
+	body := req.Body
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	_, err := signer.Sign(req, nil, "s3", region, time.Now())
+	req.Body = body
+	return err
+}
@@ -0,0 +1,300 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	headFile = "queue.head"
+
+	// compactBytes is how far the head may advance into the log before acknowledged records are dropped from disk
+	compactBytes = 16 << 20
+)
+
+var (
+	ErrEmpty         = errors.New("replication queue is empty")
+	errInvalidRecord = errors.New("queued records must not be empty or contain newlines")
+)
+
+// Queue is a durable FIFO of records kept in a directory. Records are appended to a log and synced before Push
+// returns, the generation of the log and the offset of the oldest unacknowledged record are kept next to it. A
+// record is only removed by Ack, so after a crash the record being processed is delivered again. Acknowledged records
+// are dropped by moving the rest to a log of the next generation, which only counts once the head naming it is
+// synced. Logs of older generations are removed after that, newer ones are never removed.
+type Queue struct {
+	dir    string
+	notify chan struct{}
+
+	mu     sync.Mutex
+	log    *os.File
+	gen    int64
+	head   int64
+	tail   int64
+	length int
+
+	// peeked is the size of the record returned by the last Peek, including its newline
+	peeked int64
+}
+
+// Open opens the queue kept in dir, creating it when it doesn't exist. A record torn by a crash while it was
+// appended is discarded.
+func Open(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create replication queue directory: %w", err)
+	}
+	q := &Queue{dir: dir, notify: make(chan struct{}, 1)}
+	if err := q.recover(); err != nil {
+		if q.log != nil {
+			_ = q.log.Close()
+		}
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) logPath(gen int64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("queue.%d.log", gen))
+}
+
+// logGen returns the generation of the log at path, -1 when path is not a log
+func logGen(path string) int64 {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, "queue.") || !strings.HasSuffix(name, ".log") {
+		return -1
+	}
+	gen, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, "queue."), ".log"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return gen
+}
+
+func (q *Queue) recover() error {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, headFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read replication queue head: %w", err)
+	}
+	logs, _ := filepath.Glob(filepath.Join(q.dir, "queue.*.log"))
+	if len(data) == 0 {
+		// Without a head the newest log is read from its start. Each log holds every record not acknowledged when
+		// it was written, so at worst records are delivered again.
+		for _, path := range logs {
+			if gen := logGen(path); gen > q.gen {
+				q.gen = gen
+			}
+		}
+	} else {
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid replication queue head %q", data)
+		}
+		q.gen, err = strconv.ParseInt(fields[0], 10, 64)
+		if err == nil {
+			q.head, err = strconv.ParseInt(fields[1], 10, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid replication queue head %q: %w", data, err)
+		}
+	}
+	if q.log, err = os.OpenFile(q.logPath(q.gen), os.O_RDWR|os.O_CREATE, 0o600); err != nil {
+		return fmt.Errorf("unable to open replication queue: %w", err)
+	}
+	if err = syncDir(q.dir); err != nil {
+		return fmt.Errorf("unable to open replication queue: %w", err)
+	}
+	// Older logs were left behind by a crash after compaction. A newer log belongs to a compaction that never
+	// switched over, it is replaced by the next one.
+	for _, path := range logs {
+		if gen := logGen(path); gen >= 0 && gen < q.gen {
+			_ = os.Remove(path)
+		}
+	}
+
+	info, err := q.log.Stat()
+	if err != nil {
+		return err
+	}
+	if q.head > info.Size() {
+		return fmt.Errorf("replication queue head %d is past the end of the log", q.head)
+	}
+
+	q.tail = q.head
+	r := bufio.NewReader(io.NewSectionReader(q.log, q.head, info.Size()-q.head))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		q.tail += int64(len(line))
+		q.length++
+	}
+	if q.tail < info.Size() {
+		if err = q.log.Truncate(q.tail); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Push appends record to the queue, it returns once the record is on disk
+func (q *Queue) Push(record []byte) error {
+	if len(record) == 0 || bytes.IndexByte(record, '\n') >= 0 {
+		return errInvalidRecord
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n, err := q.log.WriteAt(append(record, '\n'), q.tail)
+	if err == nil {
+		err = q.log.Sync()
+	}
+	if err != nil {
+		// Drop whatever part of the record made it to the log
+		_ = q.log.Truncate(q.tail)
+		return fmt.Errorf("unable to append to replication queue: %w", err)
+	}
+	q.tail += int64(n)
+	q.length++
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek returns the oldest record without removing it, ErrEmpty when there is none
+func (q *Queue) Peek() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.length == 0 {
+		return nil, ErrEmpty
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(q.log, q.head, q.tail-q.head)).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("unable to read replication queue: %w", err)
+	}
+	q.peeked = int64(len(line))
+	return line[:len(line)-1], nil
+}
+
+// Ack removes the record returned by the last Peek
+func (q *Queue) Ack() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.length == 0 || q.peeked == 0 {
+		return ErrEmpty
+	}
+	q.head += q.peeked
+	q.peeked = 0
+	q.length--
+	if q.length == 0 || (q.head > compactBytes && q.head > q.tail/2) {
+		return q.compact()
+	}
+	_, err := q.writeHead(q.gen, q.head)
+	return err
+}
+
+// compact moves the unacknowledged records to a log of the next generation, writing the head switches over
+func (q *Queue) compact() error {
+	path := q.logPath(q.gen + 1)
+	next, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to compact replication queue: %w", err)
+	}
+	switched := false
+	if _, err = io.Copy(next, io.NewSectionReader(q.log, q.head, q.tail-q.head)); err == nil {
+		err = next.Sync()
+	}
+	if err == nil {
+		switched, err = q.writeHead(q.gen+1, 0)
+	}
+	if !switched {
+		_ = next.Close()
+		_ = os.Remove(path)
+		return fmt.Errorf("unable to compact replication queue: %w", err)
+	}
+	_ = q.log.Close()
+	// A head that may not be on disk yet could still name the old log after a crash
+	if err == nil {
+		_ = os.Remove(q.logPath(q.gen))
+	}
+	q.log = next
+	q.gen++
+	q.tail -= q.head
+	q.head = 0
+	if err != nil {
+		return fmt.Errorf("unable to compact replication queue: %w", err)
+	}
+	return nil
+}
+
+// writeHead replaces the head file atomically so a crash leaves either the old or the new position. The new head is
+// synced before it replaces the old one and the directory after, so it is on disk once writeHead returns without an
+// error. It reports whether the new head replaced the old one, which it may have even when syncing the directory
+// failed.
+func (q *Queue) writeHead(gen, head int64) (bool, error) {
+	path := filepath.Join(q.dir, headFile)
+	data := []byte(strconv.FormatInt(gen, 10) + " " + strconv.FormatInt(head, 10))
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return false, fmt.Errorf("unable to write replication queue head: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to write replication queue head: %w", err)
+	}
+	if err = syncDir(q.dir); err != nil {
+		return true, fmt.Errorf("unable to sync replication queue head: %w", err)
+	}
+	return true, nil
+}
+
+// syncDir makes created, renamed and removed entries of dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Len returns the number of records in the queue
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.length
+}
+
+// Notify receives a value after records were pushed
+func (q *Queue) Notify() <-chan struct{} {
+	return q.notify
+}
+
+// Close closes the log, the queue must not be used afterwards
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.log.Close()
+}
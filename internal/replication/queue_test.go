@@ -0,0 +1,109 @@
+package replication
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueueOrderAndRecovery(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir)
+	assert.NoError(t, err)
+	_, err = q.Peek()
+	assert.ErrorIs(t, err, ErrEmpty)
+	assert.NoError(t, q.Push([]byte("one")))
+	assert.NoError(t, q.Push([]byte("two")))
+	assert.NoError(t, q.Push([]byte("three")))
+	assert.ErrorIs(t, q.Push([]byte("multi\nline")), errInvalidRecord)
+	assert.Equal(t, 3, q.Len())
+
+	record, _ := q.Peek()
+	assert.Equal(t, "one", string(record))
+	assert.NoError(t, q.Ack())
+	// A record peeked but not acknowledged is delivered again after a restart
+	record, _ = q.Peek()
+	assert.Equal(t, "two", string(record))
+	assert.NoError(t, q.Close())
+
+	q, err = Open(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, q.Len())
+	record, _ = q.Peek()
+	assert.Equal(t, "two", string(record))
+	assert.NoError(t, q.Ack())
+	record, _ = q.Peek()
+	assert.Equal(t, "three", string(record))
+	assert.NoError(t, q.Ack())
+	assert.Equal(t, 0, q.Len())
+	assert.NoError(t, q.Close())
+
+	// Draining the queue moved it to an empty log of the next generation
+	logs, _ := filepath.Glob(filepath.Join(dir, "queue.*.log"))
+	assert.Equal(t, []string{filepath.Join(dir, "queue.1.log")}, logs)
+}
+
+func TestQueueDropsTornRecord(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+
+	q, _ := Open(dir)
+	assert.NoError(t, q.Push([]byte("complete")))
+	_ = q.Close()
+	f, _ := os.OpenFile(filepath.Join(dir, "queue.0.log"), os.O_APPEND|os.O_WRONLY, 0)
+	_, _ = f.Write([]byte("torn"))
+	_ = f.Close()
+
+	q, err := Open(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.Len())
+	assert.NoError(t, q.Push([]byte("next")))
+	record, _ := q.Peek()
+	assert.Equal(t, "complete", string(record))
+	_ = q.Ack()
+	record, _ = q.Peek()
+	assert.Equal(t, "next", string(record))
+}
+
+func TestQueueKeepsNewerLogs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+
+	// A crash during compaction leaves the log of the next generation behind without a head naming it
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "queue.0.log"), []byte("old\n"), 0o600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "queue.1.log"), []byte("current\n"), 0o600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "queue.2.log"), []byte("next\n"), 0o600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, headFile), []byte("1 0"), 0o600))
+
+	q, err := Open(dir)
+	assert.NoError(t, err)
+	record, _ := q.Peek()
+	assert.Equal(t, "current", string(record))
+	assert.NoError(t, q.Close())
+	logs, _ := filepath.Glob(filepath.Join(dir, "queue.*.log"))
+	assert.Equal(t, []string{filepath.Join(dir, "queue.1.log"), filepath.Join(dir, "queue.2.log")}, logs)
+}
+
+func TestQueueRecoversWithoutHead(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+
+	// A head that never made it to disk is read as empty, the newest log holds every unacknowledged record
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "queue.3.log"), []byte("one\ntwo\n"), 0o600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "queue.4.log"), []byte("two\n"), 0o600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, headFile), nil, 0o600))
+
+	q, err := Open(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.Len())
+	record, _ := q.Peek()
+	assert.Equal(t, "two", string(record))
+	assert.NoError(t, q.Ack())
+	assert.NoError(t, q.Close())
+	_, err = os.Stat(filepath.Join(dir, headFile+".tmp"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,50 @@
+package routing
+
+// Aliases maps client visible bucket names to the bucket names used upstream and back
+type Aliases struct {
+	upstream map[string]string
+	client   map[string]string
+}
+
+// NewAliases builds Aliases from a map of client bucket names to upstream bucket names, the map must be one to one
+func NewAliases(aliases map[string]string) *Aliases {
+	a := &Aliases{
+		upstream: make(map[string]string, len(aliases)),
+		client:   make(map[string]string, len(aliases)),
+	}
+	for client, upstream := range aliases {
+		a.upstream[client] = upstream
+		a.client[upstream] = client
+	}
+	return a
+}
+
+// Upstream returns the upstream name of a client bucket, buckets without an alias keep their name
+func (a *Aliases) Upstream(bucket string) string {
+	if a == nil {
+		return bucket
+	}
+	if upstream, ok := a.upstream[bucket]; ok {
+		return upstream
+	}
+	return bucket
+}
+
+// Client returns the client name of an upstream bucket, buckets without an alias keep their name
+func (a *Aliases) Client(bucket string) string {
+	if a == nil {
+		return bucket
+	}
+	if client, ok := a.client[bucket]; ok {
+		return client
+	}
+	return bucket
+}
+
+// Len returns the number of aliases
+func (a *Aliases) Len() int {
+	if a == nil {
+		return 0
+	}
+	return len(a.upstream)
+}
@@ -0,0 +1,486 @@
+package routing
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/upstream"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config is the declarative routing table, rules are evaluated in order and the first match wins
+type Config struct {
+	// Domains are the client facing base hosts, a host with extra leading labels addresses a bucket virtual-host style
+	Domains []string `yaml:"domains"`
+
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+	Rules     []RuleConfig     `yaml:"rules"`
+
+	// Default names the upstream for requests no rule matches, without it those requests are rejected
+	Default string `yaml:"default"`
+
+	// Aliases maps bucket names clients use to the bucket names upstream, rules match the client name
+	Aliases map[string]string `yaml:"aliases"`
+
+	// Namespaces confine the keys of shared buckets to a prefix per identity
+	Namespaces []NamespaceConfig `yaml:"namespaces"`
+
+	// Mirrors send a sampled copy of matching reads to a shadow upstream, the first matching mirror is used
+	Mirrors []MirrorConfig `yaml:"mirrors"`
+
+	// Replicas copy objects written through matching requests to a second upstream, the first matching replica is used
+	Replicas []ReplicaConfig `yaml:"replicas"`
+
+	// Migrations read objects missing from the routed upstream from the upstream their bucket is moving away from
+	Migrations []MigrationConfig `yaml:"migrations"`
+}
+
+// MigrationConfig retries GET and HEAD requests for keys the routed upstream doesn't have against From
+type MigrationConfig struct {
+	// Bucket is a glob pattern of the client visible buckets being migrated, the first matching migration is used
+	Bucket string `yaml:"bucket"`
+	From   string `yaml:"from"`
+
+	// Copy writes objects found on From to the routed upstream in the background
+	Copy bool `yaml:"copy"`
+}
+
+// ReplicaConfig replicates objects written or deleted by requests matching every set field of Match to Upstream
+type ReplicaConfig struct {
+	Name     string      `yaml:"name"`
+	Match    MatchConfig `yaml:"match"`
+	Upstream string      `yaml:"upstream"`
+
+	// Consistency is sync, where the client only succeeds once both upstreams have the object, or async, where the
+	// replica is queued on disk once the routed upstream succeeded. Defaults to async.
+	Consistency string `yaml:"consistency"`
+}
+
+// MirrorConfig replays GET and HEAD requests matching every set field of Match against Upstream
+type MirrorConfig struct {
+	Name     string      `yaml:"name"`
+	Match    MatchConfig `yaml:"match"`
+	Upstream string      `yaml:"upstream"`
+
+	// SampleRate is the fraction of matching requests mirrored, defaults to 1
+	SampleRate float64 `yaml:"sample_rate"`
+}
+
+// NamespaceConfig confines every identity to its own prefix of Bucket, the client visible bucket name
+type NamespaceConfig struct {
+	Bucket string `yaml:"bucket"`
+
+	// Prefix is prepended to every key, {user} and {access_key} are replaced with the identity of the request
+	Prefix string `yaml:"prefix"`
+}
+
+// UpstreamConfig is a named S3 endpoint requests can be routed to
+type UpstreamConfig struct {
+	Name string `yaml:"name"`
+
+	// Endpoint is the upstream host with an optional port
+	Endpoint string `yaml:"endpoint"`
+
+	// Scheme is http or https, defaults to https
+	Scheme string `yaml:"scheme"`
+
+	// Region is used to sign requests for this upstream
+	Region string `yaml:"region"`
+
+	// Addressing is preserve, path or virtual, defaults to preserve which forwards the style the client used
+	Addressing string `yaml:"addressing"`
+
+	TLS transport.TLSConfig `yaml:"tls"`
+
+	// Backends are the gateway addresses serving the endpoint, defaults to the endpoint itself
+	Backends []string `yaml:"backends"`
+
+	// Discovery resolves the backends from DNS periodically instead of listing them in Backends
+	Discovery *upstream.DiscoveryConfig `yaml:"discovery"`
+
+	// Balance is round_robin, least_outstanding or consistent_hash, defaults to round_robin
+	Balance string `yaml:"balance"`
+
+	// HashOn is bucket or object and picks the key consistent_hash spreads requests by, defaults to object
+	HashOn string `yaml:"hash_on"`
+
+	HealthCheck upstream.HealthCheckConfig `yaml:"health_check"`
+
+	// MaxFails consecutive failed requests remove a backend for FailTimeout, zero disables passive detection
+	MaxFails    int           `yaml:"max_fails"`
+	FailTimeout time.Duration `yaml:"fail_timeout"`
+
+	// Hedge sends GET and HEAD requests that are slow to answer to a second backend, nil disables hedging
+	Hedge *upstream.HedgeConfig `yaml:"hedge"`
+
+	// CircuitBreaker stops sending requests to the upstream while too many of them fail, nil disables the breaker
+	CircuitBreaker *upstream.BreakerConfig `yaml:"circuit_breaker"`
+
+	// Fallback names the upstream requests are sent to while the circuit breaker is open, requests fail with
+	// ServiceUnavailable without one
+	Fallback string `yaml:"fallback"`
+}
+
+// RuleConfig sends requests matching every set field of Match to Upstream
+type RuleConfig struct {
+	Name     string      `yaml:"name"`
+	Match    MatchConfig `yaml:"match"`
+	Upstream string      `yaml:"upstream"`
+
+	// Canary sends a sticky share of the matching requests to another upstream
+	Canary *CanaryConfig `yaml:"canary"`
+}
+
+// CanaryConfig splits the traffic of a rule between its upstream and Upstream
+type CanaryConfig struct {
+	Upstream string `yaml:"upstream"`
+
+	// Weight is the percentage of access keys or buckets sent to the canary
+	Weight float64 `yaml:"weight"`
+
+	// StickyOn is access_key or bucket and keeps every request of one of them on the same variant, defaults to
+	// access_key
+	StickyOn string `yaml:"sticky_on"`
+}
+
+// MatchConfig fields are optional, Host and Bucket accept glob patterns
+type MatchConfig struct {
+	Host       string   `yaml:"host"`
+	Bucket     string   `yaml:"bucket"`
+	PathPrefix string   `yaml:"path_prefix"`
+	Methods    []string `yaml:"methods"`
+	AccessKeys []string `yaml:"access_keys"`
+}
+
+func (m MatchConfig) validate(v *ValidationError, where string) {
+	if _, err := path.Match(m.Host, ""); err != nil {
+		v.add("%s: invalid host pattern %q", where, m.Host)
+	}
+	if _, err := path.Match(m.Bucket, ""); err != nil {
+		v.add("%s: invalid bucket pattern %q", where, m.Bucket)
+	}
+	if m.PathPrefix != "" && !strings.HasPrefix(m.PathPrefix, "/") {
+		v.add("%s: path_prefix %q must start with /", where, m.PathPrefix)
+	}
+	for _, method := range m.Methods {
+		if !validMethods[strings.ToUpper(method)] {
+			v.add("%s: unknown method %q", where, method)
+		}
+	}
+}
+
+// ValidationError lists every problem found in a Config
+type ValidationError struct {
+	Problems []string
+}
+
+func (v *ValidationError) Error() string {
+	return "invalid routing config:\n  - " + strings.Join(v.Problems, "\n  - ")
+}
+
+func (v *ValidationError) add(format string, args ...interface{}) {
+	v.Problems = append(v.Problems, fmt.Sprintf(format, args...))
+}
+
+// LoadConfig reads and validates a yaml routing config
+func LoadConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read routing config: %w", err)
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig decodes and validates a yaml routing config, unknown fields are rejected
+func ParseConfig(data []byte) (*Config, error) {
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("unable to parse routing config: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validate checks the config for errors, it returns a *ValidationError listing all of them
+func (c *Config) Validate() error {
+	v := &ValidationError{}
+	if len(c.Upstreams) == 0 {
+		v.add("at least one upstream is required")
+	}
+	for i, d := range c.Domains {
+		if d == "" || strings.ContainsAny(d, "/*") {
+			v.add("domains[%d]: %q is not a host name", i, d)
+		}
+	}
+
+	upstreams := make(map[string]bool, len(c.Upstreams))
+	for i, u := range c.Upstreams {
+		where := fmt.Sprintf("upstreams[%d]", i)
+		if u.Name == "" {
+			v.add("%s: name is required", where)
+		} else {
+			where = fmt.Sprintf("upstreams[%d] (%s)", i, u.Name)
+			if upstreams[u.Name] {
+				v.add("%s: duplicate upstream name", where)
+			}
+			upstreams[u.Name] = true
+		}
+		if u.Endpoint == "" {
+			v.add("%s: endpoint is required", where)
+		} else if strings.Contains(u.Endpoint, "/") {
+			v.add("%s: endpoint %q must be a host and optional port without scheme or path", where, u.Endpoint)
+		}
+		switch u.Scheme {
+		case "", "http", "https":
+		default:
+			v.add("%s: scheme must be http or https, got %q", where, u.Scheme)
+		}
+		switch Addressing(u.Addressing) {
+		case "", AddressingPreserve, AddressingPath, AddressingVirtual:
+		default:
+			v.add("%s: addressing must be preserve, path or virtual, got %q", where, u.Addressing)
+		}
+		if _, err := u.TLS.Build(); err != nil {
+			v.add("%s: tls: %s", where, err.Error())
+		}
+		for j, b := range u.Backends {
+			if b == "" || strings.Contains(b, "/") {
+				v.add("%s: backends[%d] %q must be a host and optional port", where, j, b)
+			}
+		}
+		if d := u.Discovery; d != nil {
+			if len(u.Backends) > 0 {
+				v.add("%s: backends and discovery can't be used together", where)
+			}
+			if d.Name == "" {
+				v.add("%s: discovery name is required", where)
+			}
+			switch d.Type {
+			case "", upstream.DiscoveryA:
+				if d.Port < 0 || d.Port > 65535 {
+					v.add("%s: discovery port must be between 1 and 65535, got %d", where, d.Port)
+				}
+			case upstream.DiscoverySRV:
+				if d.Port != 0 {
+					v.add("%s: discovery port can't be set for srv records", where)
+				}
+			default:
+				v.add("%s: discovery type must be a or srv, got %q", where, d.Type)
+			}
+			if d.Interval < 0 {
+				v.add("%s: discovery interval must not be negative", where)
+			}
+		}
+		if !upstream.ValidStrategy(upstream.Strategy(u.Balance)) {
+			v.add("%s: balance must be round_robin, least_outstanding or consistent_hash, got %q", where, u.Balance)
+		}
+		switch HashOn(u.HashOn) {
+		case "", HashOnBucket, HashOnObject:
+		default:
+			v.add("%s: hash_on must be bucket or object, got %q", where, u.HashOn)
+		}
+		hc := u.HealthCheck
+		if hc.Interval < 0 || hc.Timeout < 0 || hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+			v.add("%s: health_check values must not be negative", where)
+		} else if hc.Interval > 0 && hc.Timeout > hc.Interval {
+			v.add("%s: health_check timeout %s exceeds interval %s", where, hc.Timeout, hc.Interval)
+		}
+		if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+			v.add("%s: health_check path %q must start with /", where, hc.Path)
+		}
+		if u.MaxFails < 0 || u.FailTimeout < 0 {
+			v.add("%s: max_fails and fail_timeout must not be negative", where)
+		}
+		if h := u.Hedge; h != nil {
+			if h.Percentile <= 0 || h.Percentile >= 100 {
+				v.add("%s: hedge percentile must be between 0 and 100, got %v", where, h.Percentile)
+			}
+			if h.MinDelay < 0 || h.MaxDelay < 0 {
+				v.add("%s: hedge delays must not be negative", where)
+			} else if h.MaxDelay > 0 && h.MinDelay > h.MaxDelay {
+				v.add("%s: hedge min_delay %s exceeds max_delay %s", where, h.MinDelay, h.MaxDelay)
+			}
+			if len(u.Backends) < 2 && u.Discovery == nil {
+				v.add("%s: hedge needs at least two backends", where)
+			}
+		}
+		if b := u.CircuitBreaker; b != nil {
+			if b.Window < 0 || b.MinRequests < 0 || b.SlowThreshold < 0 || b.OpenFor < 0 || b.HalfOpenRequests < 0 {
+				v.add("%s: circuit_breaker values must not be negative", where)
+			}
+			if b.ErrorRate < 0 || b.ErrorRate > 1 {
+				v.add("%s: circuit_breaker error_rate must be between 0 and 1, got %v", where, b.ErrorRate)
+			}
+		}
+	}
+	for i, u := range c.Upstreams {
+		if u.Fallback == "" {
+			continue
+		}
+		where := fmt.Sprintf("upstreams[%d] (%s)", i, u.Name)
+		switch {
+		case u.CircuitBreaker == nil:
+			v.add("%s: fallback needs a circuit_breaker", where)
+		case !upstreams[u.Fallback]:
+			v.add("%s: fallback upstream %q is not defined", where, u.Fallback)
+		case u.Fallback == u.Name:
+			v.add("%s: fallback upstream must differ from the upstream", where)
+		}
+	}
+
+	for i, r := range c.Rules {
+		where := fmt.Sprintf("rules[%d]", i)
+		if r.Name != "" {
+			where = fmt.Sprintf("rules[%d] (%s)", i, r.Name)
+		}
+		if r.Upstream == "" {
+			v.add("%s: upstream is required", where)
+		} else if !upstreams[r.Upstream] {
+			v.add("%s: upstream %q is not defined", where, r.Upstream)
+		}
+		r.Match.validate(v, where)
+		if c := r.Canary; c != nil {
+			if c.Upstream == "" {
+				v.add("%s: canary upstream is required", where)
+			} else if !upstreams[c.Upstream] {
+				v.add("%s: canary upstream %q is not defined", where, c.Upstream)
+			} else if c.Upstream == r.Upstream {
+				v.add("%s: canary upstream must differ from the rule upstream", where)
+			}
+			if c.Weight < 0 || c.Weight > 100 {
+				v.add("%s: canary weight must be a percentage between 0 and 100, got %v", where, c.Weight)
+			}
+			switch StickyOn(c.StickyOn) {
+			case "", StickyOnAccessKey, StickyOnBucket:
+			default:
+				v.add("%s: canary sticky_on must be access_key or bucket, got %q", where, c.StickyOn)
+			}
+		}
+	}
+	if c.Default != "" && !upstreams[c.Default] {
+		v.add("default: upstream %q is not defined", c.Default)
+	}
+
+	clients := make([]string, 0, len(c.Aliases))
+	for client := range c.Aliases {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	targets := make(map[string]string, len(c.Aliases))
+	for _, client := range clients {
+		target := c.Aliases[client]
+		where := fmt.Sprintf("aliases[%s]", client)
+		switch {
+		case client == "" || target == "" || strings.Contains(client+target, "/"):
+			v.add("%s: bucket names must not be empty or contain /", where)
+		case client == target:
+			v.add("%s: bucket is aliased to itself", where)
+		case targets[target] != "":
+			v.add("%s: upstream bucket %q is already aliased by %s", where, target, targets[target])
+		default:
+			if _, ok := c.Aliases[target]; ok {
+				v.add("%s: upstream bucket %q is itself an alias", where, target)
+			}
+		}
+		targets[target] = client
+	}
+
+	namespaces := make(map[string]bool, len(c.Namespaces))
+	for i, n := range c.Namespaces {
+		where := fmt.Sprintf("namespaces[%d]", i)
+		if n.Bucket == "" || strings.Contains(n.Bucket, "/") {
+			v.add("%s: bucket %q must be a bucket name", where, n.Bucket)
+		} else if namespaces[n.Bucket] {
+			v.add("%s: bucket %s already has a namespace", where, n.Bucket)
+		}
+		namespaces[n.Bucket] = true
+		if _, ok := c.Aliases[n.Bucket]; ok || targets[n.Bucket] != "" {
+			v.add("%s: bucket %s is aliased, a namespaced bucket must only be reachable by one name", where, n.Bucket)
+		}
+		if !strings.Contains(n.Prefix, userPlaceholder) && !strings.Contains(n.Prefix, accessKeyPlaceholder) {
+			v.add("%s: prefix %q must contain {user} or {access_key}", where, n.Prefix)
+		}
+		if strings.HasPrefix(n.Prefix, "/") {
+			v.add("%s: prefix %q must not start with /", where, n.Prefix)
+		}
+	}
+
+	for i, m := range c.Mirrors {
+		where := fmt.Sprintf("mirrors[%d]", i)
+		if m.Name != "" {
+			where = fmt.Sprintf("mirrors[%d] (%s)", i, m.Name)
+		}
+		if m.Upstream == "" {
+			v.add("%s: upstream is required", where)
+		} else if !upstreams[m.Upstream] {
+			v.add("%s: upstream %q is not defined", where, m.Upstream)
+		}
+		m.Match.validate(v, where)
+		for _, method := range m.Match.Methods {
+			if upper := strings.ToUpper(method); validMethods[upper] && upper != http.MethodGet && upper != http.MethodHead {
+				v.add("%s: only GET and HEAD can be mirrored, got %q", where, method)
+			}
+		}
+		if m.SampleRate < 0 || m.SampleRate > 1 {
+			v.add("%s: sample_rate must be between 0 and 1, got %v", where, m.SampleRate)
+		}
+	}
+
+	for i, r := range c.Replicas {
+		where := fmt.Sprintf("replicas[%d]", i)
+		if r.Name != "" {
+			where = fmt.Sprintf("replicas[%d] (%s)", i, r.Name)
+		}
+		if r.Upstream == "" {
+			v.add("%s: upstream is required", where)
+		} else if !upstreams[r.Upstream] {
+			v.add("%s: upstream %q is not defined", where, r.Upstream)
+		}
+		r.Match.validate(v, where)
+		switch Consistency(r.Consistency) {
+		case "", ConsistencySync, ConsistencyAsync:
+		default:
+			v.add("%s: consistency must be sync or async, got %q", where, r.Consistency)
+		}
+	}
+
+	for i, m := range c.Migrations {
+		where := fmt.Sprintf("migrations[%d]", i)
+		if m.Bucket == "" {
+			v.add("%s: bucket is required", where)
+		} else if _, err := path.Match(m.Bucket, ""); err != nil {
+			v.add("%s: invalid bucket pattern %q", where, m.Bucket)
+		}
+		if m.From == "" {
+			v.add("%s: from is required", where)
+		} else if !upstreams[m.From] {
+			v.add("%s: upstream %q is not defined", where, m.From)
+		}
+	}
+
+	if len(v.Problems) > 0 {
+		return v
+	}
+	return nil
+}
+
+var validMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPut:     true,
+	http.MethodPost:    true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	http.MethodPatch:   true,
+}
@@ -0,0 +1,172 @@
+package routing
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const validConfig = `
+domains:
+  - object.lga1.example.com
+upstreams:
+  - name: lga1
+    endpoint: s3.lga1.example.com
+    region: lga1
+  - name: legacy
+    endpoint: 10.0.0.1:7480
+    scheme: http
+    backends: [10.0.0.1:7480, 10.0.0.2:7480]
+    balance: consistent_hash
+    hash_on: bucket
+    health_check:
+      interval: 5s
+      timeout: 1s
+      unhealthy_threshold: 3
+    max_fails: 2
+rules:
+  - name: legacy-buckets
+    match:
+      bucket: legacy-*
+      methods: [get, HEAD]
+    upstream: legacy
+default: lga1
+`
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(validConfig))
+	assert.NoError(t, err)
+	assert.Len(t, config.Upstreams, 2)
+	assert.Equal(t, "legacy", config.Rules[0].Upstream)
+	assert.Equal(t, []string{"get", "HEAD"}, config.Rules[0].Match.Methods)
+	assert.Equal(t, 5*time.Second, config.Upstreams[1].HealthCheck.Interval)
+	assert.Equal(t, 3, config.Upstreams[1].HealthCheck.UnhealthyThreshold)
+	assert.Equal(t, 2, config.Upstreams[1].MaxFails)
+	assert.Equal(t, "consistent_hash", config.Upstreams[1].Balance)
+}
+
+func TestParseConfigValidation(t *testing.T) {
+	_, err := ParseConfig([]byte(`
+upstreams:
+  - name: a
+    endpoint: https://s3.example.com
+    scheme: ftp
+    addressing: dns
+    balance: random
+    hash_on: key
+    circuit_breaker:
+      error_rate: 2
+      open_for: -1s
+    fallback: a
+  - name: a
+    tls:
+      cert_file: client.pem
+    backends: [""]
+    health_check:
+      interval: 1s
+      timeout: 5s
+    hedge:
+      percentile: 100
+      min_delay: 2s
+      max_delay: 1s
+    fallback: missing
+  - name: discovered
+    endpoint: s3.example.com
+    backends: [10.0.0.1:80]
+    discovery:
+      type: mx
+      interval: -1s
+rules:
+  - name: broken
+    match:
+      bucket: "[abc"
+      path_prefix: bucket
+      methods: [FETCH]
+    upstream: missing
+    canary:
+      upstream: a
+      weight: 150
+      sticky_on: user
+  - match:
+      host: s3.example.com
+default: nowhere
+aliases:
+  legacy: legacy
+  old: new
+  older: new
+  new: newest
+namespaces:
+  - bucket: shared
+    prefix: "teams/{user}/"
+  - bucket: shared
+    prefix: /static/
+  - bucket: newest
+    prefix: "{user}/"
+mirrors:
+  - name: shadow
+    match:
+      methods: [GET, PUT]
+    upstream: missing
+    sample_rate: 2
+replicas:
+  - upstream: a
+    consistency: quorum
+migrations:
+  - bucket: "[abc"
+    from: missing
+`))
+	assert.IsType(t, &ValidationError{}, err)
+	assert.Equal(t, []string{
+		`upstreams[0] (a): endpoint "https://s3.example.com" must be a host and optional port without scheme or path`,
+		`upstreams[0] (a): scheme must be http or https, got "ftp"`,
+		`upstreams[0] (a): addressing must be preserve, path or virtual, got "dns"`,
+		`upstreams[0] (a): balance must be round_robin, least_outstanding or consistent_hash, got "random"`,
+		`upstreams[0] (a): hash_on must be bucket or object, got "key"`,
+		`upstreams[0] (a): circuit_breaker values must not be negative`,
+		`upstreams[0] (a): circuit_breaker error_rate must be between 0 and 1, got 2`,
+		`upstreams[1] (a): duplicate upstream name`,
+		`upstreams[1] (a): endpoint is required`,
+		`upstreams[1] (a): tls: client certificate and key must be set together`,
+		`upstreams[1] (a): backends[0] "" must be a host and optional port`,
+		`upstreams[1] (a): health_check timeout 5s exceeds interval 1s`,
+		`upstreams[1] (a): hedge percentile must be between 0 and 100, got 100`,
+		`upstreams[1] (a): hedge min_delay 2s exceeds max_delay 1s`,
+		`upstreams[1] (a): hedge needs at least two backends`,
+		`upstreams[2] (discovered): backends and discovery can't be used together`,
+		`upstreams[2] (discovered): discovery name is required`,
+		`upstreams[2] (discovered): discovery type must be a or srv, got "mx"`,
+		`upstreams[2] (discovered): discovery interval must not be negative`,
+		`upstreams[0] (a): fallback upstream must differ from the upstream`,
+		`upstreams[1] (a): fallback needs a circuit_breaker`,
+		`rules[0] (broken): upstream "missing" is not defined`,
+		`rules[0] (broken): invalid bucket pattern "[abc"`,
+		`rules[0] (broken): path_prefix "bucket" must start with /`,
+		`rules[0] (broken): unknown method "FETCH"`,
+		`rules[0] (broken): canary weight must be a percentage between 0 and 100, got 150`,
+		`rules[0] (broken): canary sticky_on must be access_key or bucket, got "user"`,
+		`rules[1]: upstream is required`,
+		`default: upstream "nowhere" is not defined`,
+		`aliases[legacy]: bucket is aliased to itself`,
+		`aliases[old]: upstream bucket "new" is itself an alias`,
+		`aliases[older]: upstream bucket "new" is already aliased by old`,
+		`namespaces[1]: bucket shared already has a namespace`,
+		`namespaces[1]: prefix "/static/" must contain {user} or {access_key}`,
+		`namespaces[1]: prefix "/static/" must not start with /`,
+		`namespaces[2]: bucket newest is aliased, a namespaced bucket must only be reachable by one name`,
+		`mirrors[0] (shadow): upstream "missing" is not defined`,
+		`mirrors[0] (shadow): only GET and HEAD can be mirrored, got "PUT"`,
+		`mirrors[0] (shadow): sample_rate must be between 0 and 1, got 2`,
+		`replicas[0]: consistency must be sync or async, got "quorum"`,
+		`migrations[0]: invalid bucket pattern "[abc"`,
+		`migrations[0]: upstream "missing" is not defined`,
+	}, err.(*ValidationError).Problems)
+}
+
+func TestParseConfigUnknownField(t *testing.T) {
+	_, err := ParseConfig([]byte("upstreams:\n  - name: a\n    endpont: s3.example.com\n"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "endpont")
+
+	_, err = ParseConfig([]byte(""))
+	assert.EqualError(t, err, "invalid routing config:\n  - at least one upstream is required")
+}
@@ -0,0 +1,35 @@
+package routing
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	userPlaceholder      = "{user}"
+	accessKeyPlaceholder = "{access_key}"
+)
+
+var ErrNoIdentity = errors.New("the namespace prefix needs an identity the request does not have")
+
+// Namespace confines the keys of a shared bucket to a prefix derived from the identity of each request
+type Namespace struct {
+	Bucket string
+	prefix string
+}
+
+// Prefix returns the key prefix of an identity, user may be empty when the template doesn't use it
+func (n *Namespace) Prefix(user, accessKey string) (string, error) {
+	if strings.Contains(n.prefix, userPlaceholder) && user == "" {
+		return "", ErrNoIdentity
+	}
+	if strings.Contains(n.prefix, accessKeyPlaceholder) && accessKey == "" {
+		return "", ErrNoIdentity
+	}
+	return strings.NewReplacer(userPlaceholder, user, accessKeyPlaceholder, accessKey).Replace(n.prefix), nil
+}
+
+// UsesUser reports whether the prefix is derived from the user owning the access key
+func (n *Namespace) UsesUser() bool {
+	return strings.Contains(n.prefix, userPlaceholder)
+}
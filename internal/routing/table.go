@@ -0,0 +1,626 @@
+package routing
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/upstream"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+var ErrNoRoute = errors.New("no route matches the request")
+
+// Addressing is how an upstream expects the bucket of a request to be named
+type Addressing string
+
+const (
+	// AddressingPreserve forwards requests in the style the client used
+	AddressingPreserve Addressing = "preserve"
+	// AddressingPath names the bucket in the first path segment
+	AddressingPath Addressing = "path"
+	// AddressingVirtual names the bucket in the leading host labels
+	AddressingVirtual Addressing = "virtual"
+)
+
+// HashOn is the part of a request consistent hashing keeps on the same backend
+type HashOn string
+
+const (
+	// HashOnBucket sends every request for a bucket to the same backend
+	HashOnBucket HashOn = "bucket"
+	// HashOnObject sends every request for an object to the same backend
+	HashOnObject HashOn = "object"
+)
+
+// StickyOn is the part of a request that keeps it on one variant of a canary rule
+type StickyOn string
+
+const (
+	// StickyOnAccessKey sends every request of an access key to the same variant
+	StickyOnAccessKey StickyOn = "access_key"
+	// StickyOnBucket sends every request for a bucket to the same variant
+	StickyOnBucket StickyOn = "bucket"
+)
+
+const (
+	// VariantStable is the upstream of a rule
+	VariantStable = "stable"
+	// VariantCanary is the canary upstream of a rule
+	VariantCanary = "canary"
+)
+
+// Variant is the side of a canary rule a request was sent to
+type Variant struct {
+	// Route names the rule, its name or the name of its stable upstream
+	Route string
+
+	// Name is VariantStable or VariantCanary
+	Name string
+}
+
+// Consistency is when a replicated write is reported back to the client
+type Consistency string
+
+const (
+	// ConsistencySync succeeds once the routed upstream and the replica have the object
+	ConsistencySync Consistency = "sync"
+	// ConsistencyAsync succeeds once the routed upstream has the object, the replica is written from a queue
+	ConsistencyAsync Consistency = "async"
+)
+
+const (
+	defaultHealthCheckPath    = "/"
+	defaultHealthCheckTimeout = 2 * time.Second
+	defaultFailTimeout        = 30 * time.Second
+	defaultHedgeMinDelay      = 10 * time.Millisecond
+	defaultHedgeMaxDelay      = time.Second
+	defaultBreakerWindow      = 10 * time.Second
+	defaultBreakerMinRequests = 20
+	defaultBreakerErrorRate   = 0.5
+	defaultBreakerOpenFor     = 30 * time.Second
+	defaultBreakerProbes      = 5
+	defaultDiscoveryInterval  = 30 * time.Second
+)
+
+// Upstream is a compiled UpstreamConfig
+type Upstream struct {
+	Name       string
+	Host       string
+	Scheme     string
+	Region     string
+	Addressing Addressing
+	HashOn     HashOn
+
+	// TLS is used for https connections to the upstream, see transport.WithTLSConfig
+	TLS *tls.Config
+
+	// Pool holds the gateways serving Host, nil sends requests to Host directly
+	Pool *upstream.Pool
+
+	// Hedge times GET and HEAD requests that are sent to a second backend when slow, nil disables hedging
+	Hedge *upstream.Hedger
+
+	// Breaker stops requests to the upstream while too many of them fail, nil disables the breaker
+	Breaker *upstream.Breaker
+
+	// Fallback receives the requests the breaker rejects, nil fails them
+	Fallback *Upstream
+}
+
+// Request holds the parts of an incoming request rules match on
+type Request struct {
+	Host      string
+	Bucket    string
+	Path      string
+	Method    string
+	AccessKey string
+}
+
+type rule struct {
+	name string
+	matcher
+	upstream *Upstream
+	canary   *canary
+}
+
+type canary struct {
+	upstream *Upstream
+
+	// threshold is the weight in hundredths of a percent, requests hashing below it go to the canary
+	threshold uint64
+	stickyOn  StickyOn
+}
+
+// pick returns the upstream and variant of req, the same sticky key always lands on the same variant
+func (r rule) pick(req Request) (*Upstream, Variant) {
+	if r.canary == nil {
+		return r.upstream, Variant{}
+	}
+	route := r.name
+	if route == "" {
+		route = r.upstream.Name
+	}
+	key := req.AccessKey
+	if r.canary.stickyOn == StickyOnBucket {
+		key = req.Bucket
+	}
+	if upstream.HashKey(route+"\x00"+key)%10000 < r.canary.threshold {
+		return r.canary.upstream, Variant{Route: route, Name: VariantCanary}
+	}
+	return r.upstream, Variant{Route: route, Name: VariantStable}
+}
+
+// Mirror is a compiled MirrorConfig
+type Mirror struct {
+	Name       string
+	Upstream   *Upstream
+	SampleRate float64
+	matcher
+}
+
+// Replica is a compiled ReplicaConfig
+type Replica struct {
+	Name        string
+	Upstream    *Upstream
+	Consistency Consistency
+	matcher
+}
+
+// Migration is a compiled MigrationConfig
+type Migration struct {
+	Bucket string
+	From   *Upstream
+	Copy   bool
+}
+
+type matcher struct {
+	host       string
+	bucket     string
+	pathPrefix string
+	methods    map[string]bool
+	accessKeys map[string]bool
+}
+
+func newMatcher(m MatchConfig) matcher {
+	compiled := matcher{
+		host:       strings.ToLower(m.Host),
+		bucket:     m.Bucket,
+		pathPrefix: m.PathPrefix,
+	}
+	if len(m.Methods) > 0 {
+		compiled.methods = make(map[string]bool, len(m.Methods))
+		for _, method := range m.Methods {
+			compiled.methods[strings.ToUpper(method)] = true
+		}
+	}
+	if len(m.AccessKeys) > 0 {
+		compiled.accessKeys = make(map[string]bool, len(m.AccessKeys))
+		for _, k := range m.AccessKeys {
+			compiled.accessKeys[k] = true
+		}
+	}
+	return compiled
+}
+
+func (r matcher) matches(req Request) bool {
+	if r.host != "" {
+		if ok, _ := path.Match(r.host, stripPort(req.Host)); !ok {
+			return false
+		}
+	}
+	if r.bucket != "" {
+		if ok, _ := path.Match(r.bucket, req.Bucket); !ok {
+			return false
+		}
+	}
+	if r.pathPrefix != "" && !strings.HasPrefix(req.Path, r.pathPrefix) {
+		return false
+	}
+	if len(r.methods) > 0 && !r.methods[req.Method] {
+		return false
+	}
+	if len(r.accessKeys) > 0 && !r.accessKeys[req.AccessKey] {
+		return false
+	}
+	return true
+}
+
+// Table is an immutable compiled routing config
+type Table struct {
+	domains    []string
+	rules      []rule
+	upstreams  map[string]*Upstream
+	fallback   *Upstream
+	aliases    *Aliases
+	namespaces map[string]*Namespace
+	mirrors    []*Mirror
+	replicas   []*Replica
+	migrations []*Migration
+}
+
+// NewTable validates config and compiles it into a Table
+func NewTable(log *zap.Logger, config *Config) (*Table, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	t := &Table{
+		upstreams: make(map[string]*Upstream, len(config.Upstreams)),
+	}
+	for _, d := range config.Domains {
+		t.domains = append(t.domains, strings.ToLower(d))
+	}
+	for _, u := range config.Upstreams {
+		tlsConfig, err := u.TLS.Build()
+		if err != nil {
+			return nil, err
+		}
+		scheme := u.Scheme
+		if scheme == "" {
+			scheme = "https"
+		}
+		addressing := Addressing(u.Addressing)
+		if addressing == "" {
+			addressing = AddressingPreserve
+		}
+		backends := u.Backends
+		var discovery *upstream.DiscoveryConfig
+		if u.Discovery != nil {
+			discovery = withDiscoveryDefaults(*u.Discovery, scheme)
+		}
+		if len(backends) == 0 && discovery == nil {
+			backends = []string{u.Endpoint}
+		} else if tlsConfig.ServerName == "" {
+			// Backends are dialed by address but must present a certificate for the endpoint
+			tlsConfig.ServerName = stripPort(u.Endpoint)
+		}
+		health := u.HealthCheck
+		if health.Path == "" {
+			health.Path = defaultHealthCheckPath
+		}
+		if health.Timeout == 0 {
+			health.Timeout = defaultHealthCheckTimeout
+			if health.Interval > 0 && health.Interval < health.Timeout {
+				health.Timeout = health.Interval
+			}
+		}
+		passive := upstream.PassiveConfig{MaxFails: u.MaxFails, FailTimeout: u.FailTimeout}
+		if passive.FailTimeout == 0 {
+			passive.FailTimeout = defaultFailTimeout
+		}
+		hashOn := HashOn(u.HashOn)
+		if hashOn == "" {
+			hashOn = HashOnObject
+		}
+		pool, err := upstream.NewPool(log, upstream.PoolConfig{
+			Name:        u.Name,
+			Scheme:      scheme,
+			Host:        u.Endpoint,
+			Addresses:   backends,
+			HealthCheck: health,
+			Passive:     passive,
+			Strategy:    upstream.Strategy(u.Balance),
+			Discovery:   discovery,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var hedger *upstream.Hedger
+		if u.Hedge != nil {
+			hedge := *u.Hedge
+			if hedge.MinDelay == 0 {
+				hedge.MinDelay = defaultHedgeMinDelay
+			}
+			if hedge.MaxDelay == 0 {
+				hedge.MaxDelay = defaultHedgeMaxDelay
+			}
+			if hedge.MinDelay > hedge.MaxDelay {
+				hedge.MinDelay = hedge.MaxDelay
+			}
+			hedger = upstream.NewHedger(hedge)
+		}
+		var breaker *upstream.Breaker
+		if u.CircuitBreaker != nil {
+			breaker = upstream.NewBreaker(log, u.Name, withBreakerDefaults(*u.CircuitBreaker))
+		}
+		t.upstreams[u.Name] = &Upstream{
+			Name:       u.Name,
+			Host:       u.Endpoint,
+			Scheme:     scheme,
+			Region:     u.Region,
+			Addressing: addressing,
+			HashOn:     hashOn,
+			TLS:        tlsConfig,
+			Pool:       pool,
+			Hedge:      hedger,
+			Breaker:    breaker,
+		}
+	}
+	for _, u := range config.Upstreams {
+		if u.Fallback != "" {
+			t.upstreams[u.Name].Fallback = t.upstreams[u.Fallback]
+		}
+	}
+	for _, r := range config.Rules {
+		compiled := rule{name: r.Name, matcher: newMatcher(r.Match), upstream: t.upstreams[r.Upstream]}
+		if c := r.Canary; c != nil {
+			stickyOn := StickyOn(c.StickyOn)
+			if stickyOn == "" {
+				stickyOn = StickyOnAccessKey
+			}
+			compiled.canary = &canary{
+				upstream:  t.upstreams[c.Upstream],
+				threshold: uint64(c.Weight*100 + 0.5),
+				stickyOn:  stickyOn,
+			}
+		}
+		t.rules = append(t.rules, compiled)
+	}
+	for _, r := range config.Replicas {
+		consistency := Consistency(r.Consistency)
+		if consistency == "" {
+			consistency = ConsistencyAsync
+		}
+		t.replicas = append(t.replicas, &Replica{
+			Name:        r.Name,
+			Upstream:    t.upstreams[r.Upstream],
+			Consistency: consistency,
+			matcher:     newMatcher(r.Match),
+		})
+	}
+	for _, m := range config.Migrations {
+		t.migrations = append(t.migrations, &Migration{Bucket: m.Bucket, From: t.upstreams[m.From], Copy: m.Copy})
+	}
+	for _, m := range config.Mirrors {
+		sampleRate := m.SampleRate
+		if sampleRate == 0 {
+			sampleRate = 1
+		}
+		t.mirrors = append(t.mirrors, &Mirror{
+			Name:       m.Name,
+			Upstream:   t.upstreams[m.Upstream],
+			SampleRate: sampleRate,
+			matcher:    newMatcher(m.Match),
+		})
+	}
+	if config.Default != "" {
+		t.fallback = t.upstreams[config.Default]
+	}
+	if len(config.Aliases) > 0 {
+		t.aliases = NewAliases(config.Aliases)
+	}
+	for _, n := range config.Namespaces {
+		if t.namespaces == nil {
+			t.namespaces = make(map[string]*Namespace, len(config.Namespaces))
+		}
+		t.namespaces[n.Bucket] = &Namespace{Bucket: n.Bucket, prefix: n.Prefix}
+	}
+	return t, nil
+}
+
+// withDiscoveryDefaults fills in the discovery settings left out of config, a records default to the port of scheme
+func withDiscoveryDefaults(config upstream.DiscoveryConfig, scheme string) *upstream.DiscoveryConfig {
+	if config.Type == "" {
+		config.Type = upstream.DiscoveryA
+	}
+	if config.Type == upstream.DiscoveryA && config.Port == 0 {
+		config.Port = 443
+		if scheme == "http" {
+			config.Port = 80
+		}
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultDiscoveryInterval
+	}
+	return &config
+}
+
+// withBreakerDefaults fills in the circuit breaker settings left out of config
+func withBreakerDefaults(config upstream.BreakerConfig) upstream.BreakerConfig {
+	if config.Window == 0 {
+		config.Window = defaultBreakerWindow
+	}
+	if config.MinRequests == 0 {
+		config.MinRequests = defaultBreakerMinRequests
+	}
+	if config.ErrorRate == 0 {
+		config.ErrorRate = defaultBreakerErrorRate
+	}
+	if config.OpenFor == 0 {
+		config.OpenFor = defaultBreakerOpenFor
+	}
+	if config.HalfOpenRequests == 0 {
+		config.HalfOpenRequests = defaultBreakerProbes
+	}
+	return config
+}
+
+// Match returns the upstream of the first rule matching req, or the default upstream
+func (t *Table) Match(req Request) (*Upstream, error) {
+	upstream, _, err := t.MatchVariant(req)
+	return upstream, err
+}
+
+// MatchVariant is Match also returning the variant picked by a canary rule, the zero Variant without a canary
+func (t *Table) MatchVariant(req Request) (*Upstream, Variant, error) {
+	for _, r := range t.rules {
+		if r.matches(req) {
+			upstream, variant := r.pick(req)
+			return upstream, variant, nil
+		}
+	}
+	if t.fallback != nil {
+		return t.fallback, Variant{}, nil
+	}
+	return nil, Variant{}, ErrNoRoute
+}
+
+// Mirror returns the first mirror matching req, nil when the request is not mirrored. Only GET and HEAD requests
+// are mirrored, sampling is left to the caller.
+func (t *Table) Mirror(req Request) *Mirror {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil
+	}
+	for _, m := range t.mirrors {
+		if m.matches(req) {
+			return m
+		}
+	}
+	return nil
+}
+
+// Replica returns the first replica matching req, nil when writes of the request are not replicated
+func (t *Table) Replica(req Request) *Replica {
+	for _, r := range t.replicas {
+		if r.matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Migration returns the first migration of a client visible bucket, nil when the bucket isn't being migrated
+func (t *Table) Migration(bucket string) *Migration {
+	for _, m := range t.migrations {
+		if ok, _ := path.Match(m.Bucket, bucket); ok {
+			return m
+		}
+	}
+	return nil
+}
+
+// Migrations returns every migration of the table
+func (t *Table) Migrations() []*Migration {
+	return t.migrations
+}
+
+// Replicas returns every replica of the table
+func (t *Table) Replicas() []*Replica {
+	return t.replicas
+}
+
+// Upstream returns the upstream named name, nil when there is none
+func (t *Table) Upstream(name string) *Upstream {
+	return t.upstreams[name]
+}
+
+// InheritBreakers hands the circuit breakers of previous to the upstreams of t with the same name and breaker
+// settings, so reloading the routing config doesn't reset their state. Breakers of upstreams that t drops or no
+// longer guards are retired.
+func (t *Table) InheritBreakers(previous *Table) {
+	if previous == nil {
+		return
+	}
+	for name, u := range t.upstreams {
+		if old := previous.upstreams[name]; u.Breaker != nil && old != nil {
+			u.Breaker = u.Breaker.Inherit(old.Breaker)
+		}
+	}
+	for name, old := range previous.upstreams {
+		if u := t.upstreams[name]; old.Breaker != nil && (u == nil || u.Breaker == nil) {
+			old.Breaker.Retire()
+		}
+	}
+}
+
+// InheritPools hands the backends of previous, with their health and requests in flight, and the latencies observed
+// by its hedgers to the upstreams of t with the same name, so reloading the routing config doesn't return dead
+// backends to the rotation. The pools of upstreams that t drops are retired. It must be called before t is started.
+func (t *Table) InheritPools(previous *Table) {
+	if previous == nil {
+		return
+	}
+	for name, old := range previous.upstreams {
+		u := t.upstreams[name]
+		if u == nil {
+			old.Pool.Retire()
+			continue
+		}
+		u.Pool.Inherit(old.Pool)
+		if u.Hedge != nil {
+			u.Hedge = u.Hedge.Inherit(old.Hedge)
+		}
+	}
+}
+
+// Start publishes the metrics of every upstream pool, resolves the backends of upstreams with DNS discovery and runs
+// the discovery and health checks of every upstream pool through rt until ctx is done. It is called once t serves
+// requests.
+func (t *Table) Start(ctx context.Context, rt http.RoundTripper) {
+	for _, u := range t.upstreams {
+		u.Pool.Publish()
+		u.Pool.RunDiscovery(ctx)
+		u.Pool.RunHealthChecks(transport.WithTLSConfig(ctx, u.TLS), rt)
+	}
+}
+
+// Aliases returns the bucket aliases of the table, nil when there are none
+func (t *Table) Aliases() *Aliases {
+	return t.aliases
+}
+
+// Namespace returns the namespace of a client visible bucket, nil when keys of the bucket are not confined
+func (t *Table) Namespace(bucket string) *Namespace {
+	return t.namespaces[bucket]
+}
+
+// Upstreams returns every upstream in the table
+func (t *Table) Upstreams() []*Upstream {
+	result := make([]*Upstream, 0, len(t.upstreams))
+	for _, u := range t.upstreams {
+		result = append(result, u)
+	}
+	return result
+}
+
+// Location is the bucket and object key a request addresses
+type Location struct {
+	Bucket string
+
+	// Key is the object key without a leading slash, empty for bucket and service requests
+	Key string
+
+	// VirtualHost is set when the bucket was named by the host rather than the path
+	VirtualHost bool
+}
+
+// HashKey returns the key consistent hashing places the request by
+func (l Location) HashKey(on HashOn) string {
+	if on == HashOnBucket || l.Key == "" {
+		return l.Bucket
+	}
+	return l.Bucket + "/" + l.Key
+}
+
+// Locate finds the bucket a request addresses. A host below one of the domains names the bucket in its leading
+// labels, any other host is treated as path-style with the bucket in the first path segment.
+func (t *Table) Locate(host, requestPath string) Location {
+	host = strings.ToLower(stripPort(host))
+	for _, d := range t.domains {
+		if strings.HasSuffix(host, "."+d) {
+			return Location{
+				Bucket:      strings.TrimSuffix(host, "."+d),
+				Key:         strings.TrimPrefix(requestPath, "/"),
+				VirtualHost: true,
+			}
+		}
+	}
+	segments := strings.SplitN(strings.TrimPrefix(requestPath, "/"), "/", 2)
+	loc := Location{Bucket: segments[0]}
+	if len(segments) == 2 {
+		loc.Key = segments[1]
+	}
+	return loc
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
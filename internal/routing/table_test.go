@@ -0,0 +1,233 @@
+package routing
+
+import (
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/upstream"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTableMatch(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+upstreams:
+  - name: primary
+    endpoint: s3.lga1.example.com
+  - name: archive
+    endpoint: archive.lga1.example.com
+    scheme: http
+  - name: batch
+    endpoint: batch.lga1.example.com
+rules:
+  - match:
+      host: "*.ord1.example.com"
+    upstream: archive
+  - match:
+      bucket: archive-*
+      methods: [GET]
+    upstream: archive
+  - match:
+      path_prefix: /logs/2020
+    upstream: archive
+  - match:
+      access_keys: [BATCHKEY]
+    upstream: batch
+`))
+	assert.NoError(t, err)
+	log, _ := zap.NewDevelopment()
+	table, err := NewTable(log, config)
+	assert.NoError(t, err)
+
+	upstream, err := table.Match(Request{Host: "bucket.ord1.example.com:8080", Method: "PUT"})
+	assert.NoError(t, err)
+	assert.Equal(t, "archive", upstream.Name)
+	assert.Equal(t, "http", upstream.Scheme)
+
+	upstream, _ = table.Match(Request{Bucket: "archive-2019", Method: "GET"})
+	assert.Equal(t, "archive", upstream.Name)
+	upstream, _ = table.Match(Request{Path: "/logs/2020/01/01", Method: "GET"})
+	assert.Equal(t, "archive", upstream.Name)
+	upstream, _ = table.Match(Request{Bucket: "archive-2019", Method: "PUT", AccessKey: "BATCHKEY"})
+	assert.Equal(t, "batch", upstream.Name)
+	assert.Equal(t, "https", upstream.Scheme)
+
+	_, err = table.Match(Request{Bucket: "archive-2019", Method: "PUT"})
+	assert.ErrorIs(t, err, ErrNoRoute)
+}
+
+func TestTableDefault(t *testing.T) {
+	config, _ := ParseConfig([]byte(validConfig))
+	log, _ := zap.NewDevelopment()
+	table, err := NewTable(log, config)
+	assert.NoError(t, err)
+
+	upstream, err := table.Match(Request{Bucket: "other", Method: "GET"})
+	assert.NoError(t, err)
+	assert.Equal(t, "lga1", upstream.Name)
+	assert.Equal(t, "lga1", upstream.Region)
+	assert.Equal(t, AddressingPreserve, upstream.Addressing)
+	assert.Len(t, table.Upstreams(), 2)
+}
+
+func TestTableLocate(t *testing.T) {
+	config, _ := ParseConfig([]byte(validConfig))
+	log, _ := zap.NewDevelopment()
+	table, _ := NewTable(log, config)
+
+	assert.Equal(t, Location{Bucket: "my-bucket", Key: "some/key", VirtualHost: true},
+		table.Locate("my-bucket.object.lga1.example.com", "/some/key"))
+	assert.Equal(t, Location{Bucket: "my.dotted.bucket", Key: "key", VirtualHost: true},
+		table.Locate("My.Dotted.Bucket.object.lga1.example.com:443", "/key"))
+	assert.Equal(t, Location{Bucket: "my-bucket", Key: "some/key"}, table.Locate("object.lga1.example.com", "/my-bucket/some/key"))
+	assert.Equal(t, Location{Bucket: "my-bucket"}, table.Locate("s3.other.example.com", "/my-bucket"))
+	assert.Equal(t, Location{}, table.Locate("object.lga1.example.com", "/"))
+}
+
+func TestTableNamespace(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+upstreams:
+  - name: lga1
+    endpoint: s3.lga1.example.com
+default: lga1
+namespaces:
+  - bucket: shared
+    prefix: "teams/{user}/"
+  - bucket: scratch
+    prefix: "{access_key}/"
+`))
+	assert.NoError(t, err)
+	log, _ := zap.NewDevelopment()
+	table, _ := NewTable(log, config)
+
+	assert.Nil(t, table.Namespace("other"))
+	shared := table.Namespace("shared")
+	assert.True(t, shared.UsesUser())
+	prefix, err := shared.Prefix("alice", "AKID")
+	assert.NoError(t, err)
+	assert.Equal(t, "teams/alice/", prefix)
+	_, err = shared.Prefix("", "AKID")
+	assert.ErrorIs(t, err, ErrNoIdentity)
+
+	prefix, _ = table.Namespace("scratch").Prefix("", "AKID")
+	assert.Equal(t, "AKID/", prefix)
+}
+
+func TestTableCanary(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+upstreams:
+  - name: stable
+    endpoint: s3.lga1.example.com
+  - name: next
+    endpoint: canary.lga1.example.com
+rules:
+  - match:
+      host: pinned.example.com
+    upstream: stable
+    canary:
+      upstream: next
+      weight: 100
+      sticky_on: bucket
+  - name: rollout
+    match:
+      bucket: "*"
+    upstream: stable
+    canary:
+      upstream: next
+      weight: 20
+`))
+	assert.NoError(t, err)
+	log, _ := zap.NewDevelopment()
+	table, _ := NewTable(log, config)
+
+	canaries := 0
+	for i := 0; i < 1000; i++ {
+		key := "KEY" + strconv.Itoa(i)
+		upstream, variant, err := table.MatchVariant(Request{Bucket: "bucket", AccessKey: key})
+		assert.NoError(t, err)
+		if variant.Name == VariantCanary {
+			canaries++
+			assert.Equal(t, "next", upstream.Name)
+		} else {
+			assert.Equal(t, "stable", upstream.Name)
+		}
+		assert.Equal(t, "rollout", variant.Route)
+		// Every request of an access key lands on the same variant
+		_, again, _ := table.MatchVariant(Request{Bucket: "other", AccessKey: key})
+		assert.Equal(t, variant, again)
+	}
+	assert.InDelta(t, 200, canaries, 50)
+
+	upstream, variant, _ := table.MatchVariant(Request{Host: "pinned.example.com", AccessKey: "KEY"})
+	assert.Equal(t, "next", upstream.Name)
+	assert.Equal(t, Variant{Route: "stable", Name: VariantCanary}, variant)
+}
+
+func TestTableCircuitBreaker(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+upstreams:
+  - name: primary
+    endpoint: s3.lga1.example.com
+    circuit_breaker:
+      error_rate: 0.2
+    fallback: standby
+  - name: standby
+    endpoint: s3.ord1.example.com
+default: primary
+`))
+	assert.NoError(t, err)
+	log, _ := zap.NewDevelopment()
+	table, err := NewTable(log, config)
+	assert.NoError(t, err)
+
+	primary := table.Upstream("primary")
+	assert.NotNil(t, primary.Breaker)
+	assert.Same(t, table.Upstream("standby"), primary.Fallback)
+	assert.Nil(t, primary.Fallback.Breaker)
+	assert.Equal(t, "closed", string(primary.Breaker.Status().State))
+
+	// A reloaded table keeps the breakers whose settings didn't change
+	reloaded, err := NewTable(log, config)
+	assert.NoError(t, err)
+	reloaded.InheritBreakers(table)
+	assert.Same(t, primary.Breaker, reloaded.Upstream("primary").Breaker)
+
+	config.Upstreams[0].CircuitBreaker.ErrorRate = 0.5
+	changed, err := NewTable(log, config)
+	assert.NoError(t, err)
+	changed.InheritBreakers(table)
+	assert.NotSame(t, primary.Breaker, changed.Upstream("primary").Breaker)
+}
+
+func TestTableDiscovery(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+upstreams:
+  - name: rgw
+    endpoint: s3.lga1.example.com
+    discovery:
+      name: rgw.lga1.internal
+    hedge:
+      percentile: 95
+  - name: srv
+    endpoint: s3.ord1.example.com
+    scheme: http
+    discovery:
+      name: _s3._tcp.rgw.ord1.internal
+      type: srv
+      interval: 5s
+default: rgw
+`))
+	assert.NoError(t, err)
+	log, _ := zap.NewDevelopment()
+	table, err := NewTable(log, config)
+	assert.NoError(t, err)
+
+	// Backends are only known once discovery ran, they are dialed by address
+	rgw := table.Upstream("rgw")
+	assert.Empty(t, rgw.Pool.Backends())
+	assert.Equal(t, "s3.lga1.example.com", rgw.TLS.ServerName)
+	assert.Equal(t, &upstream.DiscoveryConfig{Name: "rgw.lga1.internal", Type: upstream.DiscoveryA, Port: 443, Interval: 30 * time.Second},
+		withDiscoveryDefaults(*config.Upstreams[0].Discovery, "https"))
+	assert.Equal(t, &upstream.DiscoveryConfig{Name: "_s3._tcp.rgw.ord1.internal", Type: upstream.DiscoverySRV, Interval: 5 * time.Second},
+		withDiscoveryDefaults(*config.Upstreams[1].Discovery, "http"))
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout bounds how long a trusted sender may take to send the PROXY header
+	proxyHeaderTimeout = 5 * time.Second
+
+	// proxyV1MaxLength is the longest v1 header including the CRLF
+	proxyV1MaxLength = 107
+)
+
+// proxyV2Signature starts every v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+	errMissingProxyHeader = errors.New("missing PROXY protocol header")
+
+	proxyConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_proxy_protocol_connections_total",
+		Help: "Accepted connections by the PROXY protocol header they started with: v1, v2, none, untrusted, missing or invalid.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(proxyConnections)
+}
+
+// proxyProtocolListener reads the HAProxy PROXY protocol header of connections from trusted senders and reports the
+// client address it carries as the remote address. Connections from other addresses are passed through untouched, a
+// header they send is not interpreted.
+type proxyProtocolListener struct {
+	net.Listener
+	log     *zap.Logger
+	trusted []*net.IPNet
+
+	// required closes connections from trusted senders without a header
+	required bool
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		proxyConnections.WithLabelValues("untrusted").Inc()
+		return conn, nil
+	}
+	// The header is read by the goroutine serving the connection, a slow sender can't stall Accept
+	return &proxyProtocolConn{Conn: conn, log: l.log, reader: bufio.NewReader(conn), required: l.required}, nil
+}
+
+func (l *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, subnet := range l.trusted {
+		if subnet.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn is a connection from a trusted sender, the header is read on first use
+type proxyProtocolConn struct {
+	net.Conn
+	log      *zap.Logger
+	reader   *bufio.Reader
+	required bool
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address of the header, or the address of the sender when it sent none
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	version, remote, err := readProxyHeader(c.reader)
+	_ = c.Conn.SetReadDeadline(time.Time{})
+	result := version
+	switch {
+	case err != nil:
+		result = "invalid"
+	case version == "none" && c.required:
+		result, err = "missing", errMissingProxyHeader
+	}
+	proxyConnections.WithLabelValues(result).Inc()
+	if err != nil {
+		c.log.Sugar().Infow("closing connection without a valid PROXY protocol header", "sender", c.Conn.RemoteAddr().String(),
+			"error", err.Error())
+		c.err = err
+		_ = c.Conn.Close()
+		return
+	}
+	c.remote = remote
+}
+
+// readProxyHeader consumes a v1 or v2 header from r. It returns the version, or none when r doesn't start with a
+// header, and the client address, nil when the header doesn't name one such as for health checks of the sender.
+func readProxyHeader(r *bufio.Reader) (string, net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		remote, err := readProxyV2(r)
+		return "v2", remote, err
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		remote, err := readProxyV1(r)
+		return "v1", remote, err
+	case err != nil && err != io.EOF:
+		return "", nil, err
+	}
+	return "none", nil, nil
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, fmt.Errorf("%w: v1 header exceeds %d bytes", errInvalidProxyHeader, proxyV1MaxLength)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", errInvalidProxyHeader, line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	// TCP6 may carry IPv4-mapped addresses such as ::ffff:192.0.2.1, the family follows from how the address is written
+	if ip == nil || err != nil || strings.Contains(fields[2], ":") != (fields[1] == "TCP6") {
+		return nil, fmt.Errorf("%w: %q", errInvalidProxyHeader, line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidProxyHeader, header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	switch command {
+	case 0x0:
+		// LOCAL connections are opened by the sender itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("%w: unknown command %d", errInvalidProxyHeader, command)
+	}
+
+	var ipLength int
+	switch family {
+	case 0x11, 0x12:
+		ipLength = net.IPv4len
+	case 0x21, 0x22:
+		ipLength = net.IPv6len
+	default:
+		// Unix sockets and unspecified families carry no usable client address
+		return nil, nil
+	}
+	if len(payload) < 2*ipLength+4 {
+		return nil, fmt.Errorf("%w: address block of %d bytes is too short", errInvalidProxyHeader, len(payload))
+	}
+	ip := net.IP(payload[:ipLength])
+	port := binary.BigEndian.Uint16(payload[2*ipLength:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func proxyV2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := append(append(net.ParseIP("203.0.113.7").To4(), net.ParseIP("10.0.0.1").To4()...), 0x30, 0x39, 0x1f, 0x93)
+	v6 := append(append(net.ParseIP("2001:db8::7"), net.ParseIP("fd00::1")...), 0x30, 0x39, 0x1f, 0x93)
+	for _, tc := range []struct {
+		name    string
+		input   string
+		version string
+		remote  string
+		invalid bool
+	}{
+		{name: "v1 tcp4", input: "PROXY TCP4 203.0.113.7 10.0.0.1 12345 8099\r\nGET /", version: "v1", remote: "203.0.113.7:12345"},
+		{name: "v1 tcp6", input: "PROXY TCP6 2001:db8::7 fd00::1 12345 8099\r\nGET /", version: "v1", remote: "[2001:db8::7]:12345"},
+		{name: "v1 tcp6 ipv4-mapped", input: "PROXY TCP6 ::ffff:203.0.113.7 ::ffff:10.0.0.1 12345 8099\r\nGET /", version: "v1", remote: "203.0.113.7:12345"},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\nGET /", version: "v1"},
+		{name: "v1 family mismatch", input: "PROXY TCP4 2001:db8::7 fd00::1 12345 8099\r\n", invalid: true},
+		{name: "v1 garbage", input: "PROXY TCP4 nope\r\n", invalid: true},
+		{name: "v1 unterminated", input: "PROXY " + strings.Repeat("x", 200), invalid: true},
+		{name: "v2 tcp4", input: string(proxyV2Header(1, 0x11, v4)) + "GET /", version: "v2", remote: "203.0.113.7:12345"},
+		{name: "v2 tcp6 with tlv", input: string(proxyV2Header(1, 0x21, append(v6, 0x04, 0, 1, 'x'))) + "GET /", version: "v2", remote: "[2001:db8::7]:12345"},
+		{name: "v2 tcp6 ipv4-mapped", input: string(proxyV2Header(1, 0x21, append(append(net.ParseIP("203.0.113.7"), net.ParseIP("10.0.0.1")...), 0x30, 0x39, 0x1f, 0x93))) + "GET /", version: "v2", remote: "203.0.113.7:12345"},
+		{name: "v2 local", input: string(proxyV2Header(0, 0x00, nil)) + "GET /", version: "v2"},
+		{name: "v2 short address", input: string(proxyV2Header(1, 0x11, v4[:6])), invalid: true},
+		{name: "no header", input: "GET / HTTP/1.1\r\n", version: "none"},
+		{name: "short connection", input: "GET", version: "none"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tc.input))
+			version, remote, err := readProxyHeader(r)
+			if tc.invalid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.version, version)
+			if tc.remote == "" {
+				assert.Nil(t, remote)
+			} else {
+				assert.Equal(t, tc.remote, remote.String())
+			}
+			// Whatever follows the header is left for the server
+			rest, _ := ioutil.ReadAll(r)
+			assert.True(t, strings.HasSuffix(tc.input, string(rest)))
+			if version != "none" {
+				assert.Equal(t, "GET /", string(rest))
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+
+	// serve returns a func sending a request with the given header, it returns the remote address seen by the
+	// handler or an empty string when the connection was closed
+	serve := func(required bool) func(header string) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		remotes := make(chan string, 1)
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			remotes <- r.RemoteAddr
+		})}
+		go func() {
+			_ = srv.Serve(&proxyProtocolListener{Listener: listener, log: log, trusted: []*net.IPNet{loopback},
+				required: required})
+		}()
+		t.Cleanup(func() { _ = srv.Close() })
+
+		return func(header string) string {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			assert.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte(header + "GET / HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n"))
+			assert.NoError(t, err)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				return ""
+			}
+			_ = resp.Body.Close()
+			return <-remotes
+		}
+	}
+
+	send := serve(false)
+	assert.Equal(t, "198.51.100.4:40000", send("PROXY TCP4 198.51.100.4 127.0.0.1 40000 8099\r\n"))
+	assert.True(t, strings.HasPrefix(send(""), "127.0.0.1:"))
+	assert.Equal(t, "", send("PROXY TCP4 broken\r\n"))
+
+	// A trusted sender that must send a header and didn't is not served with its own address
+	send = serve(true)
+	assert.Equal(t, "198.51.100.4:40000", send("PROXY TCP4 198.51.100.4 127.0.0.1 40000 8099\r\n"))
+	assert.Equal(t, "", send(""))
+
+	// Headers of senders that are not trusted are not interpreted
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+	untrusted := &proxyProtocolListener{log: log, trusted: []*net.IPNet{other}}
+	assert.False(t, untrusted.isTrusted(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}))
+}
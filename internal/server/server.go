@@ -1,19 +1,35 @@
 package server
 
 import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"net"
 	"net/http"
 	"sync"
 )
 
+// ProxyServer serves Handler on the http listener and, with a certificate, on the https listener
 type ProxyServer struct {
-	Handler          http.Handler
-	HttpsHandler     http.Handler
-	Log              *zap.Logger
-	Cert             string
-	Key              string
-	UpstreamInsecure bool
-	EnableProfiling  bool
+	Handler         http.Handler
+	AdminHandler    http.Handler
+	AdminAddr       string
+	Log             *zap.Logger
+	Cert            string
+	Key             string
+	EnableProfiling bool
+
+	// AdminCert and AdminKey serve the admin listener over https, without them the bearer token and webhook
+	// signatures cross the network in plain text
+	AdminCert string
+	AdminKey  string
+
+	// ProxyProtocolTrusted enables the PROXY protocol on the http and https listeners for connections from these
+	// subnets, the client address of their header becomes the remote address of the request
+	ProxyProtocolTrusted []*net.IPNet
+
+	// ProxyProtocolRequired closes connections from trusted senders that don't start with a PROXY protocol header
+	// rather than serving them with the address of the sender
+	ProxyProtocolRequired bool
 }
 
 func (p *ProxyServer) StartServer(wg *sync.WaitGroup) {
@@ -27,6 +43,10 @@ func (p *ProxyServer) StartServer(wg *sync.WaitGroup) {
 		wg.Add(1)
 		p.startPprof(wg)
 	}
+	if p.AdminHandler != nil {
+		wg.Add(1)
+		p.startAdmin(wg)
+	}
 	wg.Add(1)
 	p.startHealthCheck(wg)
 	wg.Wait()
@@ -35,22 +55,46 @@ func (p *ProxyServer) StartServer(wg *sync.WaitGroup) {
 func (p *ProxyServer) startHealthCheck(wg *sync.WaitGroup) {
 	p.Log.Info("Starting health check endpoint")
 	go func() {
-		if err := http.ListenAndServe(":8888", http.HandlerFunc(
-			func(w http.ResponseWriter, r *http.Request) {
-				_, _ = w.Write([]byte("ok"))
-			},
-		)); err != nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		})
+		mux.Handle("/metrics", promhttp.Handler())
+		if err := http.ListenAndServe(":8888", mux); err != nil {
 			p.Log.Error("error in healthcheck server")
 			wg.Done()
 		}
 	}()
 }
 
+func (p *ProxyServer) startAdmin(wg *sync.WaitGroup) {
+	p.Log.Info("Starting admin server...")
+	go func() {
+		var err error
+		if p.AdminCert != "" && p.AdminKey != "" {
+			p.Log.Sugar().Infof("Starting up admin on listen address %s with tls", p.AdminAddr)
+			err = http.ListenAndServeTLS(p.AdminAddr, p.AdminCert, p.AdminKey, p.AdminHandler)
+		} else {
+			p.Log.Sugar().Warnf("Starting up admin on listen address %s without tls, the admin token is sent in plain text", p.AdminAddr)
+			err = http.ListenAndServe(p.AdminAddr, p.AdminHandler)
+		}
+		if err != nil {
+			p.Log.Error("error in admin server")
+			wg.Done()
+		}
+	}()
+}
+
 func (p *ProxyServer) startHttp(wg *sync.WaitGroup) {
 	p.Log.Info("Starting http server...")
 	go func() {
 		p.Log.Info("Starting up http on listen address :8099")
-		if err := http.ListenAndServe(":8099", p.Handler); err != nil {
+		srv := &http.Server{Addr: ":8099", Handler: p.Handler}
+		listener, err := p.listen(srv.Addr)
+		if err == nil {
+			err = srv.Serve(listener)
+		}
+		if err != nil {
 			p.Log.Error("error in http server")
 			wg.Done()
 		}
@@ -61,13 +105,28 @@ func (p *ProxyServer) startHttps(wg *sync.WaitGroup) {
 	p.Log.Info("Starting https server...")
 	go func() {
 		p.Log.Info("Starting up https on listen address :8090")
-		if err := http.ListenAndServeTLS(":8090", p.Cert, p.Key, p.HttpsHandler); err != nil {
+		srv := &http.Server{Addr: ":8090", Handler: p.Handler}
+		listener, err := p.listen(srv.Addr)
+		if err == nil {
+			err = srv.ServeTLS(listener, p.Cert, p.Key)
+		}
+		if err != nil {
 			p.Log.Error("error in https serve")
 			wg.Done()
 		}
 	}()
 }
 
+// listen opens a proxy listener on addr, reading the PROXY protocol header of trusted senders when enabled
+func (p *ProxyServer) listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || len(p.ProxyProtocolTrusted) == 0 {
+		return listener, err
+	}
+	return &proxyProtocolListener{Listener: listener, log: p.Log, trusted: p.ProxyProtocolTrusted,
+		required: p.ProxyProtocolRequired}, nil
+}
+
 func (p *ProxyServer) startPprof(wg *sync.WaitGroup) {
 	go func() {
 		// avoid leaking pprof to the main application http servers
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/cfg"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/handler"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/mocks"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxyProtocolClientOutsideAllowedSubnet(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer upstream.Close()
+	path := filepath.Join(t.TempDir(), "routing.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+upstreams:
+  - name: default
+    endpoint: `+strings.TrimPrefix(upstream.URL, "http://")+`
+    scheme: http
+default: default
+`), 0600))
+
+	log, _ := zap.NewDevelopment()
+	ctrl := gomock.NewController(t)
+	mCache := mocks.NewMockAuthCache(ctrl)
+	mCache.EXPECT().GetRequestSigner("AKID").Return(v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", "")), nil).AnyTimes()
+	mCache.EXPECT().GetUser("AKID").Return("alice", nil).AnyTimes()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h, err := handler.NewAwsS3ReverseProxy(ctx, log, cfg.Options{
+		RoutingConfig:       path,
+		AllowedSourceSubnet: []string{"203.0.113.0/24"},
+		RetryAttempts:       1,
+		MirrorMaxInFlight:   1,
+		TrustedProxyHeader:  "x-forwarded-for",
+		RgwAdminEndpoints:   "http://rgw.example.com",
+		RgwAdminAccessKeys:  "admin",
+		RgwAdminSecretKeys:  "secret",
+	}, mCache)
+	assert.NoError(t, err)
+
+	// The load balancer connects from loopback and names the client in the PROXY header
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	p := &ProxyServer{Handler: h, Log: log, ProxyProtocolTrusted: []*net.IPNet{loopback}}
+	listener, err := p.listen("127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := &http.Server{Handler: p.Handler}
+	go func() { _ = srv.Serve(listener) }()
+	defer srv.Close()
+
+	send := func(header string) int {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte(header + "GET /bucket/key HTTP/1.1\r\nHost: proxy.example.com\r\n" +
+			"Authorization: AWS4-HMAC-SHA256 Credential=AKID/20220101/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=abc\r\n" +
+			"Connection: close\r\n\r\n"))
+		assert.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, send("PROXY TCP4 203.0.113.7 127.0.0.1 40000 8099\r\n"))
+	assert.Equal(t, http.StatusForbidden, send("PROXY TCP4 198.51.100.4 127.0.0.1 40000 8099\r\n"))
+	// Without a header the load balancer itself is the client, it is outside the allowed subnet too
+	assert.Equal(t, http.StatusForbidden, send(""))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
@@ -0,0 +1,56 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ClientConfig configures an http.Client for talking to a single kind of backend
+type ClientConfig struct {
+	TLS TLSConfig
+
+	// Timeout bounds a whole request including reading the body, zero means no timeout
+	Timeout time.Duration
+
+	// DialTimeout bounds establishing a connection
+	DialTimeout time.Duration
+
+	// ProxyURL sends requests through an http proxy, when empty the proxy environment variables are used
+	ProxyURL string
+}
+
+// NewHTTPClient builds an http.Client with its own transport from config
+func NewHTTPClient(config ClientConfig) (*http.Client, error) {
+	tlsConfig, err := config.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+	proxy := http.ProxyFromEnvironment
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	dialTimeout := config.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 30 * time.Second
+	}
+	return &http.Client{
+		Timeout: config.Timeout,
+		Transport: &http.Transport{
+			Proxy:                 proxy,
+			DialContext:           (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}, nil
+}
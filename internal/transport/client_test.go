@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientTrustsCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	client, err := NewHTTPClient(ClientConfig{})
+	assert.NoError(t, err)
+	_, err = client.Get(srv.URL)
+	assert.Error(t, err)
+
+	client, err = NewHTTPClient(ClientConfig{TLS: TLSConfig{CAFile: caFile}})
+	assert.NoError(t, err)
+	resp, err := client.Get(srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	client, _ = NewHTTPClient(ClientConfig{TLS: TLSConfig{CAFile: caFile}, Timeout: 10 * time.Millisecond})
+	_, err = client.Get(srv.URL)
+	assert.Error(t, err)
+}
+
+func TestClientInvalidConfig(t *testing.T) {
+	_, err := NewHTTPClient(ClientConfig{TLS: TLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}})
+	assert.Error(t, err)
+
+	_, err = NewHTTPClient(ClientConfig{TLS: TLSConfig{CertFile: "client.pem"}})
+	assert.ErrorIs(t, err, errIncompleteKeyPair)
+
+	_, err = NewHTTPClient(ClientConfig{ProxyURL: "://bad"})
+	assert.Error(t, err)
+}
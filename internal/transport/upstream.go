@@ -0,0 +1,146 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type tlsConfigContextKey struct{}
+
+// WithTLSConfig sets the tls settings the upstream transport uses for connections dialed on behalf of ctx
+func WithTLSConfig(ctx context.Context, config *tls.Config) context.Context {
+	return context.WithValue(ctx, tlsConfigContextKey{}, config)
+}
+
+func tlsConfigFromContext(ctx context.Context) *tls.Config {
+	config, _ := ctx.Value(tlsConfigContextKey{}).(*tls.Config)
+	return config
+}
+
+// UpstreamConfig tunes the connection pools of the upstreams, zero values use the defaults
+type UpstreamConfig struct {
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+
+	// MaxIdleConnsPerHost bounds the idle connections kept to each gateway address
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout closes connections idle for longer
+	IdleConnTimeout time.Duration
+
+	// DisableHTTP2 keeps upstream connections on HTTP/1.1 even when the upstream offers HTTP/2
+	DisableHTTP2 bool
+}
+
+// UpstreamTransport sends requests to the upstreams with the tls settings read from the request context, see
+// WithTLSConfig, so upstreams can differ in scheme, verification and client certificates. Connections are pooled per
+// tls settings, a connection dialed for one upstream is never reused by another upstream at the same address with
+// other settings. HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored.
+type UpstreamTransport struct {
+	config     UpstreamConfig
+	dialer     *net.Dialer
+	nextProtos []string
+
+	mu    sync.Mutex
+	pools map[*tls.Config]*upstreamPool
+	swept time.Time
+}
+
+// upstreamPool holds the connections dialed with one tls config
+type upstreamPool struct {
+	*http.Transport
+	lastUsed time.Time
+}
+
+// NewUpstreamTransport builds the transport shared by every upstream
+func NewUpstreamTransport(config UpstreamConfig) *UpstreamTransport {
+	if config.DialTimeout == 0 {
+		config.DialTimeout = 30 * time.Second
+	}
+	if config.TLSHandshakeTimeout == 0 {
+		config.TLSHandshakeTimeout = 10 * time.Second
+	}
+	if config.MaxIdleConnsPerHost == 0 {
+		config.MaxIdleConnsPerHost = 100
+	}
+	if config.IdleConnTimeout == 0 {
+		config.IdleConnTimeout = 90 * time.Second
+	}
+	nextProtos := []string{"h2", "http/1.1"}
+	if config.DisableHTTP2 {
+		nextProtos = []string{"http/1.1"}
+	}
+	return &UpstreamTransport{
+		config:     config,
+		dialer:     &net.Dialer{Timeout: config.DialTimeout, KeepAlive: 30 * time.Second},
+		nextProtos: nextProtos,
+		pools:      map[*tls.Config]*upstreamPool{},
+	}
+}
+
+func (t *UpstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.pool(tlsConfigFromContext(req.Context())).RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of every pool
+func (t *UpstreamTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pool := range t.pools {
+		pool.CloseIdleConnections()
+	}
+}
+
+// pool returns the connection pool of config. Routing reloads build new configs, pools unused for longer than the
+// idle timeout have no connections left and are dropped.
+func (t *UpstreamTransport) pool(config *tls.Config) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.swept) > t.config.IdleConnTimeout {
+		for c, pool := range t.pools {
+			if now.Sub(pool.lastUsed) > t.config.IdleConnTimeout {
+				pool.CloseIdleConnections()
+				delete(t.pools, c)
+			}
+		}
+		t.swept = now
+	}
+	pool, ok := t.pools[config]
+	if !ok {
+		pool = &upstreamPool{Transport: t.newPool(config)}
+		t.pools[config] = pool
+	}
+	pool.lastUsed = now
+	return pool.Transport
+}
+
+func (t *UpstreamTransport) newPool(config *tls.Config) *http.Transport {
+	if config == nil {
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = t.nextProtos
+	}
+	rt := &http.Transport{
+		// The tunnel of a proxy is wrapped in the tls settings of the upstream, its certificate is verified as usual
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           t.dialer.DialContext,
+		TLSClientConfig:       config,
+		TLSHandshakeTimeout:   t.config.TLSHandshakeTimeout,
+		ForceAttemptHTTP2:     !t.config.DisableHTTP2,
+		MaxIdleConnsPerHost:   t.config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       t.config.IdleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if t.config.DisableHTTP2 {
+		// A non-nil empty map is how net/http is told not to negotiate HTTP/2
+		rt.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return rt
+}
@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTransportPicksTLSPerRequest(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	rt := NewUpstreamTransport(UpstreamConfig{})
+
+	get := func(config *tls.Config) error {
+		// Start each request on a fresh connection, a nil config is reused
+		rt.CloseIdleConnections()
+		req, _ := http.NewRequestWithContext(WithTLSConfig(context.Background(), config), http.MethodGet, srv.URL, nil)
+		resp, err := rt.RoundTrip(req)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	assert.Error(t, get(nil))
+	assert.Error(t, get(&tls.Config{}))
+	// The test certificate is issued for example.com and 127.0.0.1
+	assert.NoError(t, get(&tls.Config{RootCAs: roots}))
+	assert.Error(t, get(&tls.Config{RootCAs: roots, ServerName: "s3.example.org"}))
+	assert.NoError(t, get(&tls.Config{InsecureSkipVerify: true, ServerName: "s3.example.org"}))
+}
+
+func TestUpstreamTransportPoolsPerTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	rt := NewUpstreamTransport(UpstreamConfig{IdleConnTimeout: 50 * time.Millisecond})
+
+	get := func(config *tls.Config) error {
+		req, _ := http.NewRequestWithContext(WithTLSConfig(context.Background(), config), http.MethodGet, srv.URL, nil)
+		resp, err := rt.RoundTrip(req)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	// A connection of an upstream skipping verification is not handed to one verifying at the same address
+	assert.NoError(t, get(&tls.Config{InsecureSkipVerify: true, ServerName: "s3.example.org"}))
+	assert.Error(t, get(&tls.Config{RootCAs: roots, ServerName: "s3.example.org"}))
+	assert.Len(t, rt.pools, 2)
+
+	// Pools of configs no longer in use are dropped
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, get(&tls.Config{RootCAs: roots}))
+	assert.Len(t, rt.pools, 1)
+}
+
+func TestUpstreamTransportTunnelsThroughProxy(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	tunnels := 0
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		tunnels++
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		client, _, _ := w.(http.Hijacker).Hijack()
+		go func() { _, _ = io.Copy(upstream, client); _ = upstream.Close() }()
+		_, _ = io.Copy(client, upstream)
+		_ = client.Close()
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	rt := NewUpstreamTransport(UpstreamConfig{})
+
+	get := func(config *tls.Config) error {
+		// Pools read the proxy from the environment, point this one at the test proxy
+		rt.pool(config).Proxy = http.ProxyURL(proxyURL)
+		req, _ := http.NewRequestWithContext(WithTLSConfig(context.Background(), config), http.MethodGet, srv.URL, nil)
+		resp, err := rt.RoundTrip(req)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	// The tls settings of the upstream apply inside the tunnel
+	assert.NoError(t, get(&tls.Config{RootCAs: roots}))
+	assert.Error(t, get(&tls.Config{}))
+	assert.Equal(t, 2, tunnels)
+}
@@ -0,0 +1,133 @@
+package upstream
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Strategy selects how requests are spread across the backends of a pool
+type Strategy string
+
+const (
+	// RoundRobin rotates through the healthy backends
+	RoundRobin Strategy = "round_robin"
+	// LeastOutstanding picks the healthy backend with the fewest requests in flight
+	LeastOutstanding Strategy = "least_outstanding"
+	// ConsistentHash maps a request key to a stable backend so rgw caches stay warm
+	ConsistentHash Strategy = "consistent_hash"
+)
+
+// ringReplicas is the number of points each backend has on the hash ring
+const ringReplicas = 100
+
+// ValidStrategy reports whether s names a known strategy, the empty string selects RoundRobin
+func ValidStrategy(s Strategy) bool {
+	switch s {
+	case "", RoundRobin, LeastOutstanding, ConsistentHash:
+		return true
+	}
+	return false
+}
+
+type balancer interface {
+	// pick returns an eligible backend or nil when there is none
+	pick(backends []*Backend, eligible func(*Backend) bool, key string) *Backend
+}
+
+func newBalancer(strategy Strategy, backends []*Backend) (balancer, error) {
+	switch strategy {
+	case "", RoundRobin:
+		return &roundRobin{}, nil
+	case LeastOutstanding:
+		return &leastOutstanding{}, nil
+	case ConsistentHash:
+		return newHashRing(backends), nil
+	}
+	return nil, fmt.Errorf("unknown balancing strategy %q", strategy)
+}
+
+type roundRobin struct {
+	next uint32
+}
+
+func (r *roundRobin) pick(backends []*Backend, eligible func(*Backend) bool, _ string) *Backend {
+	n := uint32(len(backends))
+	start := atomic.AddUint32(&r.next, 1)
+	for i := uint32(0); i < n; i++ {
+		if b := backends[(start+i)%n]; eligible(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+type leastOutstanding struct {
+	next uint32
+}
+
+func (l *leastOutstanding) pick(backends []*Backend, eligible func(*Backend) bool, _ string) *Backend {
+	n := uint32(len(backends))
+	// Rotate the starting point so ties don't always go to the first backend
+	start := atomic.AddUint32(&l.next, 1)
+	var best *Backend
+	for i := uint32(0); i < n; i++ {
+		b := backends[(start+i)%n]
+		if eligible(b) && (best == nil || b.InFlight() < best.InFlight()) {
+			best = b
+		}
+	}
+	return best
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+// hashRing walks clockwise from the hash of the key to the first eligible backend, so removing a backend only moves
+// the keys it owned
+type hashRing struct {
+	points   []ringPoint
+	fallback roundRobin
+}
+
+func newHashRing(backends []*Backend) *hashRing {
+	r := &hashRing{}
+	for _, b := range backends {
+		for i := 0; i < ringReplicas; i++ {
+			r.points = append(r.points, ringPoint{hash: HashKey(b.Address + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+func (r *hashRing) pick(backends []*Backend, eligible func(*Backend) bool, key string) *Backend {
+	if key == "" || len(r.points) == 0 {
+		return r.fallback.pick(backends, eligible, key)
+	}
+	h := HashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	for i := 0; i < len(r.points); i++ {
+		if b := r.points[(start+i)%len(r.points)].backend; eligible(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// HashKey is FNV-1a followed by the murmur3 finalizer, FNV alone leaves keys sharing a prefix close together on the ring
+func HashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,103 @@
+package upstream
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"strconv"
+	"testing"
+)
+
+func newTestPool(t *testing.T, name string, strategy Strategy, addresses ...string) *Pool {
+	log, _ := zap.NewDevelopment()
+	pool, err := NewPool(log, PoolConfig{Name: name, Scheme: "http", Host: "s3.example.com", Addresses: addresses, Strategy: strategy})
+	assert.NoError(t, err)
+	return pool
+}
+
+func TestRoundRobin(t *testing.T) {
+	pool := newTestPool(t, "rr", RoundRobin, "a:80", "b:80", "c:80")
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		b, err := pool.Next(nil, "")
+		assert.NoError(t, err)
+		seen[b.Address]++
+	}
+	assert.Equal(t, map[string]int{"a:80": 2, "b:80": 2, "c:80": 2}, seen)
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	pool := newTestPool(t, "lor", LeastOutstanding, "a:80", "b:80", "c:80")
+	a, b, c := pool.Backends()[0], pool.Backends()[1], pool.Backends()[2]
+
+	releaseA := pool.Acquire(a)
+	pool.Acquire(a)
+	releaseC := pool.Acquire(c)
+	for i := 0; i < 3; i++ {
+		next, err := pool.Next(nil, "")
+		assert.NoError(t, err)
+		assert.Equal(t, b, next)
+	}
+
+	pool.Acquire(b)
+	pool.Acquire(b)
+	releaseC()
+	releaseC()
+	assert.Equal(t, int64(0), c.InFlight())
+	next, err := pool.Next(nil, "")
+	assert.NoError(t, err)
+	assert.Equal(t, c, next)
+
+	releaseA()
+	next, err = pool.Next(map[*Backend]bool{c: true}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, a, next)
+}
+
+func TestConsistentHash(t *testing.T) {
+	pool := newTestPool(t, "hash", ConsistentHash, "a:80", "b:80", "c:80")
+
+	owners := make(map[string]*Backend)
+	used := make(map[*Backend]bool)
+	for i := 0; i < 100; i++ {
+		key := "bucket/object-" + strconv.Itoa(i)
+		b, err := pool.Next(nil, key)
+		assert.NoError(t, err)
+		owners[key] = b
+		used[b] = true
+
+		again, err := pool.Next(nil, key)
+		assert.NoError(t, err)
+		assert.Equal(t, b, again)
+	}
+	assert.Len(t, used, 3)
+
+	// Excluding a backend only moves the keys it owned
+	removed := pool.Backends()[1]
+	for key, owner := range owners {
+		b, err := pool.Next(map[*Backend]bool{removed: true}, key)
+		assert.NoError(t, err)
+		if owner == removed {
+			assert.NotEqual(t, removed, b)
+		} else {
+			assert.Equal(t, owner, b)
+		}
+	}
+}
+
+func TestConsistentHashWithoutKey(t *testing.T) {
+	pool := newTestPool(t, "hash-nokey", ConsistentHash, "a:80", "b:80")
+	seen := make(map[*Backend]bool)
+	for i := 0; i < 2; i++ {
+		b, err := pool.Next(nil, "")
+		assert.NoError(t, err)
+		seen[b] = true
+	}
+	assert.Len(t, seen, 2)
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	_, err := NewPool(log, PoolConfig{Name: "unknown", Addresses: []string{"a:80"}, Strategy: "random"})
+	assert.Error(t, err)
+	assert.False(t, ValidStrategy("random"))
+}
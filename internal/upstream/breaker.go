@@ -0,0 +1,234 @@
+package upstream
+
+import (
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// breakerBuckets is the number of buckets the window of a circuit breaker is split into
+const breakerBuckets = 10
+
+// BreakerState is the state of a circuit breaker
+type BreakerState string
+
+const (
+	// BreakerClosed lets every request through and counts their outcomes
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen rejects every request until OpenFor passed
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets HalfOpenRequests probe requests through, they close the breaker when all succeed
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+var breakerStates = []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen}
+
+// BreakerConfig controls when a circuit breaker stops sending requests to an upstream
+type BreakerConfig struct {
+	// Window is the time request outcomes are counted over
+	Window time.Duration `yaml:"window"`
+
+	// MinRequests must be counted in the window before the error rate can open the breaker
+	MinRequests int `yaml:"min_requests"`
+
+	// ErrorRate is the share of failed requests in the window that opens the breaker, between 0 and 1
+	ErrorRate float64 `yaml:"error_rate"`
+
+	// SlowThreshold counts requests that took longer to answer as failed, zero only counts errors
+	SlowThreshold time.Duration `yaml:"slow_threshold"`
+
+	// OpenFor is how long the breaker rejects requests before it lets probe requests through
+	OpenFor time.Duration `yaml:"open_for"`
+
+	// HalfOpenRequests probe requests must succeed to close the breaker again
+	HalfOpenRequests int `yaml:"half_open_requests"`
+}
+
+// BreakerStatus describes the current state of a circuit breaker
+type BreakerStatus struct {
+	Upstream string       `json:"upstream"`
+	State    BreakerState `json:"state"`
+	Since    time.Time    `json:"since"`
+
+	// Requests and Failures are counted in the current window
+	Requests int `json:"requests"`
+	Failures int `json:"failures"`
+}
+
+type breakerBucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// Breaker is the circuit breaker of an upstream
+type Breaker struct {
+	log    *zap.Logger
+	name   string
+	config BreakerConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	state   BreakerState
+	since   time.Time
+	buckets [breakerBuckets]breakerBucket
+
+	// probes were let through and successes answered since the breaker became half open
+	probes    int
+	successes int
+}
+
+// NewBreaker builds a closed circuit breaker for the upstream name
+func NewBreaker(log *zap.Logger, name string, config BreakerConfig) *Breaker {
+	b := &Breaker{log: log, name: name, config: config, now: time.Now}
+	b.setState(BreakerClosed, b.now())
+	return b
+}
+
+// Inherit returns previous when it guards the same upstream with the same settings as b and b otherwise. A reloaded
+// routing table keeps the breakers of the table it replaces this way, an open breaker stays open.
+func (b *Breaker) Inherit(previous *Breaker) *Breaker {
+	if previous == nil || previous.name != b.name || previous.config != b.config {
+		return b
+	}
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	// Building b reported it as closed
+	previous.reportState()
+	return previous
+}
+
+// Retire deletes the metric series of a breaker whose upstream a reloaded routing table dropped or no longer guards
+func (b *Breaker) Retire() {
+	for _, s := range breakerStates {
+		breakerState.DeleteLabelValues(b.name, string(s))
+		breakerTransitions.DeleteLabelValues(b.name, string(s))
+	}
+	breakerRejected.DeleteLabelValues(b.name)
+}
+
+// Allow reports whether a request may be sent to the upstream. Probes that never report are given up on after
+// OpenFor, so a half open breaker can't get stuck.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if b.state == BreakerOpen && now.Sub(b.since) >= b.config.OpenFor {
+		b.setState(BreakerHalfOpen, now)
+	}
+	if b.state == BreakerHalfOpen && b.probes >= b.config.HalfOpenRequests && now.Sub(b.since) >= b.config.OpenFor {
+		b.setState(BreakerHalfOpen, now)
+	}
+
+	switch {
+	case b.state == BreakerClosed:
+		return true
+	case b.state == BreakerHalfOpen && b.probes < b.config.HalfOpenRequests:
+		b.probes++
+		return true
+	}
+	breakerRejected.WithLabelValues(b.name).Inc()
+	return false
+}
+
+// Release gives back the probe slot of a request Allow let through that won't be recorded, such as one that failed
+// before it was sent or that the client gave up on
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen && b.probes > b.successes {
+		b.probes--
+	}
+}
+
+// Record counts the outcome of a request that was allowed, failed requests and requests slower than the slow
+// threshold count against the upstream
+func (b *Breaker) Record(failed bool, latency time.Duration) {
+	if b.config.SlowThreshold > 0 && latency > b.config.SlowThreshold {
+		failed = true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	switch b.state {
+	case BreakerClosed:
+		bucket := b.bucket(now)
+		bucket.requests++
+		if failed {
+			bucket.failures++
+		}
+		requests, failures := b.counts(now)
+		if requests >= b.config.MinRequests && float64(failures) >= b.config.ErrorRate*float64(requests) {
+			b.setState(BreakerOpen, now)
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.setState(BreakerOpen, now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenRequests {
+			b.setState(BreakerClosed, now)
+		}
+	}
+}
+
+// Status returns the current state of the breaker
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	requests, failures := b.counts(b.now())
+	return BreakerStatus{Upstream: b.name, State: b.state, Since: b.since, Requests: requests, Failures: failures}
+}
+
+// bucket returns the bucket counting outcomes at now, it must be called with b.mu held
+func (b *Breaker) bucket(now time.Time) *breakerBucket {
+	width := b.config.Window / breakerBuckets
+	if width <= 0 {
+		width = 1
+	}
+	start := now.Truncate(width)
+	bucket := &b.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+// counts sums the buckets inside the window, it must be called with b.mu held
+func (b *Breaker) counts(now time.Time) (requests, failures int) {
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < b.config.Window {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+// setState must be called with b.mu held
+func (b *Breaker) setState(state BreakerState, now time.Time) {
+	if b.state != state && b.state != "" {
+		b.log.Sugar().Warnw("circuit breaker changed state", "upstream", b.name, "from", b.state, "to", state)
+		breakerTransitions.WithLabelValues(b.name, string(state)).Inc()
+	}
+	b.state = state
+	b.since = now
+	b.probes = 0
+	b.successes = 0
+	if state == BreakerClosed {
+		b.buckets = [breakerBuckets]breakerBucket{}
+	}
+	b.reportState()
+}
+
+// reportState must be called with b.mu held
+func (b *Breaker) reportState() {
+	for _, s := range breakerStates {
+		value := 0.0
+		if s == b.state {
+			value = 1
+		}
+		breakerState.WithLabelValues(b.name, string(s)).Set(value)
+	}
+}
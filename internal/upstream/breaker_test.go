@@ -0,0 +1,112 @@
+package upstream
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	b := NewBreaker(log, "breaker-test", BreakerConfig{
+		Window:           10 * time.Second,
+		MinRequests:      4,
+		ErrorRate:        0.5,
+		SlowThreshold:    time.Second,
+		OpenFor:          30 * time.Second,
+		HalfOpenRequests: 2,
+	})
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time { return now }
+
+	// Too few requests to judge the upstream
+	assert.True(t, b.Allow())
+	b.Record(true, 0)
+	assert.True(t, b.Allow())
+	b.Record(false, 2*time.Second)
+	assert.True(t, b.Allow())
+	b.Record(false, 0)
+	assert.Equal(t, BreakerClosed, b.Status().State)
+
+	// Failures outside the window are forgotten
+	now = now.Add(11 * time.Second)
+	b.Record(true, 0)
+	status := b.Status()
+	assert.Equal(t, "breaker-test", status.Upstream)
+	assert.Equal(t, BreakerClosed, status.State)
+	assert.Equal(t, 1, status.Requests)
+	assert.Equal(t, 1, status.Failures)
+
+	b.Record(false, 0)
+	b.Record(false, 0)
+	b.Record(true, 0)
+	assert.Equal(t, BreakerOpen, b.Status().State)
+	assert.False(t, b.Allow())
+
+	// After OpenFor probes are let through, a failed one opens the breaker again
+	now = now.Add(30 * time.Second)
+	assert.True(t, b.Allow())
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+	assert.Equal(t, BreakerHalfOpen, b.Status().State)
+	b.Record(true, 0)
+	assert.Equal(t, BreakerOpen, b.Status().State)
+
+	// Probes that succeed close it
+	now = now.Add(30 * time.Second)
+	assert.True(t, b.Allow())
+	assert.True(t, b.Allow())
+	b.Record(false, 0)
+	b.Record(false, 0)
+	status = b.Status()
+	assert.Equal(t, BreakerClosed, status.State)
+	assert.Equal(t, now, status.Since)
+	assert.Zero(t, status.Requests)
+}
+
+func TestBreakerStuckProbes(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	b := NewBreaker(log, "breaker-stuck-test", BreakerConfig{Window: time.Second, MinRequests: 1, ErrorRate: 1, OpenFor: time.Second, HalfOpenRequests: 1})
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time { return now }
+
+	b.Record(true, 0)
+	now = now.Add(time.Second)
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+
+	// The probe never reported, another one is let through
+	now = now.Add(time.Second)
+	assert.True(t, b.Allow())
+}
+
+func TestBreakerReleasedProbes(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	config := BreakerConfig{Window: time.Second, MinRequests: 1, ErrorRate: 1, OpenFor: time.Second, HalfOpenRequests: 1}
+	b := NewBreaker(log, "breaker-release-test", config)
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time { return now }
+
+	b.Record(true, 0)
+	now = now.Add(time.Second)
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+
+	// A probe that is never sent hands its slot to the next request right away
+	b.Release()
+	assert.True(t, b.Allow())
+	b.Record(false, 0)
+	assert.Equal(t, BreakerClosed, b.Status().State)
+	b.Release()
+	assert.Equal(t, BreakerClosed, b.Status().State)
+
+	// A reloaded breaker with the same settings keeps the state of the one it replaces
+	b.Record(true, 0)
+	assert.Same(t, b, NewBreaker(log, "breaker-release-test", config).Inherit(b))
+	assert.Equal(t, BreakerOpen, b.Status().State)
+	config.OpenFor = time.Minute
+	changed := NewBreaker(log, "breaker-release-test", config)
+	assert.Same(t, changed, changed.Inherit(b))
+	assert.Same(t, changed, changed.Inherit(nil))
+}
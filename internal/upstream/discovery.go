@@ -0,0 +1,125 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DiscoveryType is the kind of DNS record backends are discovered from
+type DiscoveryType string
+
+const (
+	// DiscoveryA resolves the A and AAAA records of a host name
+	DiscoveryA DiscoveryType = "a"
+	// DiscoverySRV resolves SRV records, which name the port of every backend
+	DiscoverySRV DiscoveryType = "srv"
+)
+
+// discoveryTimeout bounds a single lookup
+const discoveryTimeout = 5 * time.Second
+
+var errNoRecords = errors.New("no records found")
+
+// DiscoveryConfig controls periodic DNS discovery of the backends of an upstream
+type DiscoveryConfig struct {
+	// Name is resolved to the backends, a host name for a records or the full SRV name such as
+	// _s3._tcp.rgw.example.com
+	Name string `yaml:"name"`
+
+	// Type is a or srv
+	Type DiscoveryType `yaml:"type"`
+
+	// Port the addresses of a records are dialed on, SRV records carry their own
+	Port int `yaml:"port"`
+
+	// Interval is how often Name is resolved again
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Resolver looks up backends, net.Resolver implements it
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// RunDiscovery resolves the backends of the pool once and then every discovery interval until ctx is done. It returns
+// after the first lookup, immediately when the pool has no discovery config. A failed lookup or an empty answer
+// keeps the current backends.
+func (p *Pool) RunDiscovery(ctx context.Context) {
+	if p.discovery == nil {
+		return
+	}
+	p.discover(ctx)
+	go func() {
+		t := time.NewTicker(p.discovery.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				p.discover(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (p *Pool) discover(ctx context.Context) {
+	addresses, err := p.resolve(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil && len(addresses) == 0 {
+		err = errNoRecords
+	}
+	if err != nil {
+		discoveryLookups.WithLabelValues(p.name, "error").Inc()
+		p.log.Sugar().Warnw("unable to discover upstream backends, keeping the current ones", "upstream", p.name,
+			"name", p.discovery.Name, "error", err.Error())
+		return
+	}
+	discoveryLookups.WithLabelValues(p.name, "ok").Inc()
+	p.SetAddresses(addresses)
+}
+
+// resolve returns the sorted backend addresses the discovery name currently resolves to. Only SRV records of the
+// lowest priority are used, their weights are left to the balancing strategy.
+func (p *Pool) resolve(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+	var addresses []string
+	if p.discovery.Type == DiscoverySRV {
+		_, records, err := p.resolver.LookupSRV(ctx, "", "", p.discovery.Name)
+		if err != nil {
+			return nil, err
+		}
+		lowest := ^uint16(0)
+		for _, r := range records {
+			if r.Priority < lowest {
+				lowest = r.Priority
+			}
+		}
+		for _, r := range records {
+			if r.Priority != lowest {
+				continue
+			}
+			addresses = append(addresses, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+		}
+	} else {
+		ips, err := p.resolver.LookupIPAddr(ctx, p.discovery.Name)
+		if err != nil {
+			return nil, err
+		}
+		port := strconv.Itoa(p.discovery.Port)
+		for _, ip := range ips {
+			addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
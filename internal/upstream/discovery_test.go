@@ -0,0 +1,147 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers lookups from records that tests change between lookups
+type fakeResolver struct {
+	mu      sync.Mutex
+	ips     []net.IPAddr
+	srv     []*net.SRV
+	err     error
+	lookups int
+}
+
+func (r *fakeResolver) LookupIPAddr(_ context.Context, _ string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return r.ips, r.err
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, _, _, _ string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return "", r.srv, r.err
+}
+
+func (r *fakeResolver) set(ips []net.IPAddr, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ips, r.err = ips, err
+}
+
+func addresses(pool *Pool) []string {
+	var result []string
+	for _, b := range pool.Backends() {
+		result = append(result, b.Address)
+	}
+	return result
+}
+
+func TestPoolDiscovery(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	resolver := &fakeResolver{ips: []net.IPAddr{{IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("10.0.0.1")}}}
+	pool, err := NewPool(log, PoolConfig{Name: "discovered", Scheme: "http", Host: "s3.example.com",
+		Discovery: &DiscoveryConfig{Name: "rgw.example.com", Type: DiscoveryA, Port: 7480, Interval: 10 * time.Millisecond},
+		Resolver:  resolver})
+	assert.NoError(t, err)
+	assert.Empty(t, pool.Backends())
+	_, err = pool.Next(nil, "")
+	assert.ErrorIs(t, err, ErrNoHealthyBackend)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool.RunDiscovery(ctx)
+	assert.Equal(t, []string{"10.0.0.1:7480", "10.0.0.2:7480"}, addresses(pool))
+
+	// A request in flight to a removed backend finishes on it
+	kept, removed := pool.Backends()[0], pool.Backends()[1]
+	release := pool.Acquire(removed)
+	resolver.set([]net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("fd00::3")}}, nil)
+	assert.Eventually(t, func() bool {
+		return len(pool.Backends()) == 2 && pool.Backends()[1].Address == "[fd00::3]:7480"
+	}, time.Second, 5*time.Millisecond)
+	assert.Same(t, kept, pool.Backends()[0])
+	assert.Equal(t, int64(1), removed.InFlight())
+	release()
+	assert.Equal(t, int64(0), removed.InFlight())
+	for i := 0; i < 4; i++ {
+		next, err := pool.Next(nil, "")
+		assert.NoError(t, err)
+		assert.NotSame(t, removed, next)
+	}
+
+	// Failed lookups and empty answers keep the current backends
+	resolver.set(nil, errors.New("SERVFAIL"))
+	time.Sleep(30 * time.Millisecond)
+	resolver.set(nil, nil)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, []string{"10.0.0.1:7480", "[fd00::3]:7480"}, addresses(pool))
+}
+
+func TestPoolDiscoverySRV(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	resolver := &fakeResolver{srv: []*net.SRV{
+		{Target: "rgw-2.example.com.", Port: 7481, Priority: 10},
+		{Target: "rgw-1.example.com.", Port: 7480, Priority: 10},
+		{Target: "rgw-backup.example.com.", Port: 7480, Priority: 20},
+	}}
+	pool, err := NewPool(log, PoolConfig{Name: "srv", Scheme: "http", Host: "s3.example.com", Strategy: ConsistentHash,
+		Discovery: &DiscoveryConfig{Name: "_s3._tcp.example.com", Type: DiscoverySRV, Interval: time.Minute},
+		Resolver:  resolver})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool.RunDiscovery(ctx)
+	assert.Equal(t, []string{"rgw-1.example.com:7480", "rgw-2.example.com:7481"}, addresses(pool))
+	first, err := pool.Next(nil, "bucket/key")
+	assert.NoError(t, err)
+	next, _ := pool.Next(nil, "bucket/key")
+	assert.Same(t, first, next)
+}
+
+func TestPoolSetAddresses(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	pool, err := NewPool(log, PoolConfig{Name: "static", Scheme: "http", Host: "s3.example.com", Addresses: []string{"a:80", "b:80"}})
+	assert.NoError(t, err)
+	assert.False(t, pool.SetAddresses([]string{"a:80", "b:80", "a:80"}))
+	assert.True(t, pool.SetAddresses([]string{"b:80"}))
+	assert.Equal(t, []string{"b:80"}, addresses(pool))
+}
+
+func TestPoolRemovedBackendMetrics(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	pool, err := NewPool(log, PoolConfig{Name: "removed-metrics", Scheme: "http", Host: "s3.example.com",
+		Addresses: []string{"a:80", "b:80"}, Passive: PassiveConfig{MaxFails: 1, FailTimeout: time.Minute}})
+	assert.NoError(t, err)
+	pool.Publish()
+	a := pool.Backends()[0]
+	release := pool.Acquire(a)
+
+	assert.True(t, pool.SetAddresses([]string{"b:80"}))
+	healthy := testutil.CollectAndCount(backendHealthy)
+	inFlight := testutil.CollectAndCount(backendInFlight)
+	failures := testutil.CollectAndCount(backendFailures)
+
+	// Requests still in flight to the removed backend finish without bringing its series back
+	pool.ReportFailure(a)
+	release()
+	pool.Acquire(a)()
+	assert.Equal(t, healthy, testutil.CollectAndCount(backendHealthy))
+	assert.Equal(t, inFlight, testutil.CollectAndCount(backendInFlight))
+	assert.Equal(t, failures, testutil.CollectAndCount(backendFailures))
+	assert.True(t, a.Healthy())
+	assert.Zero(t, a.InFlight())
+}
@@ -0,0 +1,136 @@
+package upstream
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// hedgeWindow is the number of recent latencies the hedging delay is derived from
+	hedgeWindow = 1000
+	// hedgeMinSamples latencies must be observed before the percentile replaces MaxDelay
+	hedgeMinSamples = 100
+	// hedgeRefresh is the number of observations after which the delay is computed again
+	hedgeRefresh = 50
+)
+
+// HedgeConfig controls hedging of GET and HEAD requests, hedging is disabled when Percentile is zero
+type HedgeConfig struct {
+	// Percentile of recent response latencies a request may take before a second request is sent to another
+	// backend, such as 95
+	Percentile float64 `yaml:"percentile"`
+
+	// MinDelay and MaxDelay bound the hedging delay, MaxDelay is used until enough latencies were observed
+	MinDelay time.Duration `yaml:"min_delay"`
+	MaxDelay time.Duration `yaml:"max_delay"`
+}
+
+// Hedger derives the hedging delay of an upstream from the time its backends took to send response headers.
+// Attempts cancelled before their headers arrived, such as the losers of hedged requests, are kept as censored
+// samples: they only tell the latency exceeded the time they ran. Leaving them out would drop the slowest requests
+// from the window and let the delay shrink with every hedge.
+type Hedger struct {
+	config HedgeConfig
+
+	mu       sync.Mutex
+	samples  []hedgeSample
+	next     int
+	observed int
+
+	// delay is the current delay in nanoseconds
+	delay int64
+}
+
+type hedgeSample struct {
+	latency time.Duration
+
+	// censored samples are lower bounds of the latency
+	censored bool
+}
+
+// NewHedger builds a Hedger that waits MaxDelay until it observed enough latencies
+func NewHedger(config HedgeConfig) *Hedger {
+	return &Hedger{
+		config:  config,
+		samples: make([]hedgeSample, 0, hedgeWindow),
+		delay:   int64(config.MaxDelay),
+	}
+}
+
+// Inherit returns previous when it has the same settings as h and h otherwise, a reloaded routing table keeps the
+// latencies observed so far this way
+func (h *Hedger) Inherit(previous *Hedger) *Hedger {
+	if previous == nil || previous.config != h.config {
+		return h
+	}
+	return previous
+}
+
+// Delay returns how long a request may wait for response headers before it is hedged
+func (h *Hedger) Delay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.delay))
+}
+
+// Observe records the time a backend took to send response headers
+func (h *Hedger) Observe(latency time.Duration) {
+	h.observe(hedgeSample{latency: latency})
+}
+
+// ObserveCensored records an attempt cancelled after elapsed without response headers
+func (h *Hedger) ObserveCensored(elapsed time.Duration) {
+	h.observe(hedgeSample{latency: elapsed, censored: true})
+}
+
+func (h *Hedger) observe(sample hedgeSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < hedgeWindow {
+		h.samples = append(h.samples, sample)
+	} else {
+		h.samples[h.next] = sample
+		h.next = (h.next + 1) % hedgeWindow
+	}
+	h.observed++
+	if len(h.samples) < hedgeMinSamples || h.observed%hedgeRefresh != 0 {
+		return
+	}
+
+	delay := h.percentile()
+	if delay < h.config.MinDelay {
+		delay = h.config.MinDelay
+	}
+	if delay > h.config.MaxDelay {
+		delay = h.config.MaxDelay
+	}
+	atomic.StoreInt64(&h.delay, int64(delay))
+}
+
+// percentile estimates the configured percentile of the latency with the Kaplan-Meier estimator, which accounts for
+// censored samples. It returns MaxDelay when too many samples are censored for the percentile to be reached.
+func (h *Hedger) percentile() time.Duration {
+	sorted := make([]hedgeSample, len(h.samples))
+	copy(sorted, h.samples)
+	// On ties the observed latency goes first, the censored attempt was still at risk at that time
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].latency != sorted[j].latency {
+			return sorted[i].latency < sorted[j].latency
+		}
+		return !sorted[i].censored && sorted[j].censored
+	})
+	target := h.config.Percentile / 100
+	survival := 1.0
+	for i, sample := range sorted {
+		if sample.censored {
+			continue
+		}
+		atRisk := float64(len(sorted) - i)
+		survival *= (atRisk - 1) / atRisk
+		// The tolerance keeps rounding from skipping the sample that reaches the percentile exactly
+		if 1-survival >= target-1e-9 {
+			return sample.latency
+		}
+	}
+	return h.config.MaxDelay
+}
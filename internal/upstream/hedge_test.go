@@ -0,0 +1,75 @@
+package upstream
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestHedgerDelay(t *testing.T) {
+	h := NewHedger(HedgeConfig{Percentile: 90, MinDelay: 5 * time.Millisecond, MaxDelay: time.Second})
+
+	// MaxDelay is used until enough latencies were observed
+	for i := 0; i < hedgeMinSamples-1; i++ {
+		h.Observe(time.Millisecond)
+	}
+	assert.Equal(t, time.Second, h.Delay())
+
+	h = NewHedger(HedgeConfig{Percentile: 90, MinDelay: 5 * time.Millisecond, MaxDelay: time.Second})
+	for i := 0; i < hedgeWindow; i++ {
+		h.Observe(time.Duration(i%100+1) * time.Millisecond)
+	}
+	assert.Equal(t, 90*time.Millisecond, h.Delay())
+
+	// The delay is bounded by MinDelay and MaxDelay
+	for i := 0; i < hedgeWindow; i++ {
+		h.Observe(time.Microsecond)
+	}
+	assert.Equal(t, 5*time.Millisecond, h.Delay())
+	for i := 0; i < hedgeWindow; i++ {
+		h.Observe(time.Minute)
+	}
+	assert.Equal(t, time.Second, h.Delay())
+}
+
+func TestHedgerDelayUnderSustainedHedging(t *testing.T) {
+	h := NewHedger(HedgeConfig{Percentile: 90, MinDelay: time.Millisecond, MaxDelay: time.Second})
+	random := rand.New(rand.NewSource(1))
+	// 80% of the requests take up to 10ms and the rest between 100ms and 500ms, the p90 is 300ms
+	latency := func() time.Duration {
+		if random.Intn(100) < 80 {
+			return time.Duration(random.Intn(10)+1) * time.Millisecond
+		}
+		return time.Duration(random.Intn(400)+100) * time.Millisecond
+	}
+
+	// Requests slower than the delay are hedged, whichever attempt answers first cancels the other one
+	requests, hedged := 20*hedgeWindow, 0
+	for i := 0; i < requests; i++ {
+		primary, delay := latency(), h.Delay()
+		if primary <= delay {
+			h.Observe(primary)
+			continue
+		}
+		hedged++
+		hedge := latency()
+		if primary <= delay+hedge {
+			h.Observe(primary)
+			h.ObserveCensored(primary - delay)
+		} else {
+			h.Observe(hedge)
+			h.ObserveCensored(delay + hedge)
+		}
+	}
+	// Without the cancelled attempts only the fast winners are seen and the delay shrinks until every slow request
+	// is hedged
+	assert.Greater(t, int64(h.Delay()), int64(200*time.Millisecond))
+	assert.Less(t, float64(hedged)/float64(requests), 0.12)
+
+	// A window of attempts all cancelled early doesn't reach the percentile
+	for i := 0; i < 2*hedgeWindow; i++ {
+		h.ObserveCensored(time.Millisecond)
+	}
+	assert.Equal(t, time.Second, h.Delay())
+}
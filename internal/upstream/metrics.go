@@ -0,0 +1,39 @@
+package upstream
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	backendHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s3proxy_upstream_backend_healthy",
+		Help: "Whether an upstream backend currently receives traffic.",
+	}, []string{"upstream", "backend"})
+	backendFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_upstream_backend_failures_total",
+		Help: "Failed requests and health checks per upstream backend.",
+	}, []string{"upstream", "backend", "kind"})
+	backendInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s3proxy_upstream_backend_in_flight_requests",
+		Help: "Requests currently sent to an upstream backend and not yet finished.",
+	}, []string{"upstream", "backend"})
+	breakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s3proxy_upstream_circuit_state",
+		Help: "Whether the circuit breaker of an upstream is in a state, 1 for the current state and 0 otherwise.",
+	}, []string{"upstream", "state"})
+	breakerTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_upstream_circuit_transitions_total",
+		Help: "Changes of the circuit breaker of an upstream by the state it changed to.",
+	}, []string{"upstream", "state"})
+	breakerRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_upstream_circuit_rejected_total",
+		Help: "Requests the circuit breaker of an upstream did not let through.",
+	}, []string{"upstream"})
+	discoveryLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3proxy_upstream_discovery_lookups_total",
+		Help: "DNS lookups of upstream backends by result.",
+	}, []string{"upstream", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(backendHealthy, backendFailures, backendInFlight, breakerState, breakerTransitions, breakerRejected,
+		discoveryLookups)
+}
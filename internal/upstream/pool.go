@@ -0,0 +1,483 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNoHealthyBackend = errors.New("no healthy backend available")
+
+// HealthCheckConfig controls active probing of backends, probing is disabled when Interval is zero
+type HealthCheckConfig struct {
+	// Path is requested on every backend, any response below 500 counts as healthy
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+
+	// HealthyThreshold consecutive successful probes reinstate a backend
+	HealthyThreshold int `yaml:"healthy_threshold"`
+
+	// UnhealthyThreshold consecutive failed probes remove a backend
+	UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+}
+
+// PassiveConfig controls removal of backends based on failed requests
+type PassiveConfig struct {
+	// MaxFails consecutive failed requests remove a backend, zero disables passive detection
+	MaxFails int
+
+	// FailTimeout is how long a passively removed backend stays out when active probing is disabled
+	FailTimeout time.Duration
+}
+
+// Backend is a single gateway address of an upstream
+type Backend struct {
+	Address string
+
+	healthy  int32
+	inFlight int64
+
+	mu           sync.Mutex
+	fails        int
+	probeFails   int
+	probeSuccess int
+	downUntil    time.Time
+
+	// removed is set once the backend left the pool, requests still in flight to it no longer touch its metrics
+	removed bool
+
+	// exported is set while the metric series of the backend exist, from the time its pool is published until it is
+	// removed
+	exported bool
+}
+
+// Healthy reports whether the backend currently receives traffic
+func (b *Backend) Healthy() bool {
+	return atomic.LoadInt32(&b.healthy) == 1
+}
+
+// InFlight returns the number of requests currently sent to the backend
+func (b *Backend) InFlight() int64 {
+	return atomic.LoadInt64(&b.inFlight)
+}
+
+// PoolConfig describes the backends of one upstream
+type PoolConfig struct {
+	// Name of the upstream, used in logs and metrics
+	Name string
+
+	// Scheme and Host are used for health checks, Host is sent as the Host header
+	Scheme string
+	Host   string
+
+	Addresses   []string
+	HealthCheck HealthCheckConfig
+	Passive     PassiveConfig
+	Strategy    Strategy
+
+	// Discovery resolves the addresses from DNS instead, nil keeps Addresses
+	Discovery *DiscoveryConfig
+
+	// Resolver answers the discovery lookups, nil uses the system resolver
+	Resolver Resolver
+}
+
+// Pool is the set of backends of one upstream
+type Pool struct {
+	log       *zap.Logger
+	name      string
+	host      string
+	scheme    string
+	health    HealthCheckConfig
+	passive   PassiveConfig
+	strategy  Strategy
+	discovery *DiscoveryConfig
+	resolver  Resolver
+
+	// members holds the current *poolMembers, discovery swaps it while requests pick backends
+	members atomic.Value
+
+	// mu serializes membership changes
+	mu sync.Mutex
+
+	// published is set once the routing table of the pool serves requests, its backends export metrics from then on
+	published bool
+
+	// retired is set once a reloaded pool took over the backends, the membership no longer changes
+	retired bool
+}
+
+// poolMembers are the backends of a pool at one point in time with the balancer built for them
+type poolMembers struct {
+	backends []*Backend
+	balancer balancer
+}
+
+// NewPool builds a pool with every backend initially healthy. The backends export no metrics until the pool is
+// published, so a pool that is built and thrown away doesn't touch the series of the one serving requests.
+func NewPool(log *zap.Logger, config PoolConfig) (*Pool, error) {
+	p := &Pool{
+		log:       log,
+		name:      config.Name,
+		host:      config.Host,
+		scheme:    config.Scheme,
+		health:    config.HealthCheck,
+		passive:   config.Passive,
+		strategy:  config.Strategy,
+		discovery: config.Discovery,
+		resolver:  config.Resolver,
+	}
+	if p.resolver == nil {
+		p.resolver = net.DefaultResolver
+	}
+	if !ValidStrategy(p.strategy) {
+		return nil, fmt.Errorf("unknown balancing strategy %q", p.strategy)
+	}
+	p.members.Store(&poolMembers{balancer: &roundRobin{}})
+	p.SetAddresses(config.Addresses)
+	return p, nil
+}
+
+// Name returns the name of the upstream the pool belongs to
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Backends returns every backend in the pool
+func (p *Pool) Backends() []*Backend {
+	return p.loadMembers().backends
+}
+
+func (p *Pool) loadMembers() *poolMembers {
+	return p.members.Load().(*poolMembers)
+}
+
+// SetAddresses replaces the backends of the pool. Backends that stay keep their health and requests in flight,
+// added ones start healthy. Requests already sent to a removed backend finish on it. It reports whether the set of
+// backends changed.
+func (p *Pool) SetAddresses(addresses []string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.retired {
+		return false
+	}
+	current := p.loadMembers()
+	existing := make(map[string]*Backend, len(current.backends))
+	for _, b := range current.backends {
+		existing[b.Address] = b
+	}
+
+	var backends []*Backend
+	seen := make(map[string]bool, len(addresses))
+	var added []string
+	for _, address := range addresses {
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		b := existing[address]
+		if b == nil {
+			b = &Backend{Address: address, healthy: 1}
+			if p.published {
+				p.export(b)
+			}
+			added = append(added, address)
+		}
+		backends = append(backends, b)
+	}
+	var removed []string
+	for _, b := range current.backends {
+		if !seen[b.Address] {
+			p.remove(b)
+			removed = append(removed, b.Address)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return false
+	}
+
+	// The strategy was validated when the pool was built
+	balancer, _ := newBalancer(p.strategy, backends)
+	p.members.Store(&poolMembers{backends: backends, balancer: balancer})
+	if p.discovery != nil {
+		p.log.Sugar().Infow("upstream backends changed", "upstream", p.name, "added", added, "removed", removed)
+	}
+	return true
+}
+
+// Publish exports the metrics of every backend of the pool, it is called once the routing table of the pool serves
+// requests
+func (p *Pool) Publish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = true
+	for _, b := range p.loadMembers().backends {
+		p.export(b)
+	}
+}
+
+// Inherit hands the backends of previous, the pool of the same upstream in the routing table p replaces, to p with
+// their health and requests in flight. A discovered pool takes all of them until its next lookup, otherwise the
+// backends at the addresses p was built with are taken. The backends of previous that p doesn't keep are removed
+// and previous no longer changes. It must be called before p is published.
+func (p *Pool) Inherit(previous *Pool) {
+	if previous == nil || previous == p {
+		return
+	}
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	previous.retired = true
+	old := previous.loadMembers().backends
+
+	kept := make(map[*Backend]bool, len(old))
+	if previous.name == p.name {
+		p.mu.Lock()
+		byAddress := make(map[string]*Backend, len(old))
+		for _, b := range old {
+			byAddress[b.Address] = b
+		}
+		var backends []*Backend
+		if p.discovery != nil {
+			backends = old
+		} else {
+			for _, b := range p.loadMembers().backends {
+				if o := byAddress[b.Address]; o != nil {
+					b = o
+				}
+				backends = append(backends, b)
+			}
+		}
+		for _, b := range backends {
+			kept[b] = true
+		}
+		balancer, _ := newBalancer(p.strategy, backends)
+		p.members.Store(&poolMembers{backends: backends, balancer: balancer})
+		p.mu.Unlock()
+	}
+	for _, b := range old {
+		if !kept[b] {
+			previous.remove(b)
+		}
+	}
+}
+
+// Retire removes every backend of a pool whose upstream a reloaded routing table dropped, requests in flight
+// finish without touching their metrics
+func (p *Pool) Retire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retired = true
+	for _, b := range p.loadMembers().backends {
+		p.remove(b)
+	}
+}
+
+// export creates the metric series of b unless it has them already or left the pool
+func (p *Pool) export(b *Backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exported || b.removed {
+		return
+	}
+	b.exported = true
+	healthy := 0.0
+	if b.Healthy() {
+		healthy = 1
+	}
+	backendHealthy.WithLabelValues(p.name, b.Address).Set(healthy)
+	backendInFlight.WithLabelValues(p.name, b.Address).Set(float64(b.InFlight()))
+}
+
+// remove marks b as no longer in the pool and deletes its metric series
+func (p *Pool) remove(b *Backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removed = true
+	if !b.exported {
+		return
+	}
+	b.exported = false
+	backendHealthy.DeleteLabelValues(p.name, b.Address)
+	backendInFlight.DeleteLabelValues(p.name, b.Address)
+	backendFailures.DeleteLabelValues(p.name, b.Address, "request")
+	backendFailures.DeleteLabelValues(p.name, b.Address, "probe")
+}
+
+// Next returns a healthy backend chosen by the pool strategy, skipping any in exclude. Key is the hash key used by
+// ConsistentHash and ignored by the other strategies.
+func (p *Pool) Next(exclude map[*Backend]bool, key string) (*Backend, error) {
+	p.reinstateExpired()
+	members := p.loadMembers()
+	b := members.balancer.pick(members.backends, func(b *Backend) bool {
+		return b.Healthy() && !exclude[b]
+	}, key)
+	if b == nil {
+		return nil, ErrNoHealthyBackend
+	}
+	return b, nil
+}
+
+// Acquire marks a request as in flight to b, the returned func must be called once it finished
+func (p *Pool) Acquire(b *Backend) (release func()) {
+	p.countInFlight(b, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.countInFlight(b, -1)
+		})
+	}
+}
+
+// countInFlight adds delta to the requests in flight to b. The gauge is only touched while b is exported, under the
+// same lock that exports it from the count or deletes it, so it neither drifts nor comes back after removal.
+func (p *Pool) countInFlight(b *Backend, delta int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	atomic.AddInt64(&b.inFlight, delta)
+	if b.exported {
+		backendInFlight.WithLabelValues(p.name, b.Address).Add(float64(delta))
+	}
+}
+
+// ReportSuccess records a request that reached the backend
+func (p *Pool) ReportSuccess(b *Backend) {
+	b.mu.Lock()
+	b.fails = 0
+	b.mu.Unlock()
+}
+
+// ReportFailure records a request that could not be completed by the backend
+func (p *Pool) ReportFailure(b *Backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.removed {
+		return
+	}
+	if b.exported {
+		backendFailures.WithLabelValues(p.name, b.Address, "request").Inc()
+	}
+	if p.passive.MaxFails <= 0 {
+		return
+	}
+	b.fails++
+	if b.fails >= p.passive.MaxFails && b.Healthy() {
+		b.downUntil = time.Now().Add(p.passive.FailTimeout)
+		b.probeSuccess = 0
+		p.setHealthy(b, false, "consecutive request failures")
+	}
+}
+
+// reinstateExpired returns passively removed backends to the pool once their fail timeout passed,
+// with active probing enabled the probes decide instead
+func (p *Pool) reinstateExpired() {
+	if p.health.Interval > 0 || p.passive.MaxFails <= 0 {
+		return
+	}
+	now := time.Now()
+	for _, b := range p.Backends() {
+		if b.Healthy() {
+			continue
+		}
+		b.mu.Lock()
+		if !b.Healthy() && now.After(b.downUntil) {
+			b.fails = 0
+			p.setHealthy(b, true, "fail timeout expired")
+		}
+		b.mu.Unlock()
+	}
+}
+
+// setHealthy must be called with b.mu held, removed backends are left alone
+func (p *Pool) setHealthy(b *Backend, healthy bool, reason string) {
+	if b.removed {
+		return
+	}
+	if healthy {
+		atomic.StoreInt32(&b.healthy, 1)
+		if b.exported {
+			backendHealthy.WithLabelValues(p.name, b.Address).Set(1)
+		}
+		p.log.Sugar().Infow("backend reinstated", "upstream", p.name, "backend", b.Address, "reason", reason)
+		return
+	}
+	atomic.StoreInt32(&b.healthy, 0)
+	if b.exported {
+		backendHealthy.WithLabelValues(p.name, b.Address).Set(0)
+	}
+	p.log.Sugar().Warnw("backend removed", "upstream", p.name, "backend", b.Address, "reason", reason)
+}
+
+// RunHealthChecks probes every backend until ctx is done, it returns immediately when probing is disabled
+func (p *Pool) RunHealthChecks(ctx context.Context, transport http.RoundTripper) {
+	if p.health.Interval <= 0 {
+		return
+	}
+	client := &http.Client{Transport: transport, Timeout: p.health.Timeout}
+	go func() {
+		t := time.NewTicker(p.health.Interval)
+		defer t.Stop()
+		for {
+			for _, b := range p.Backends() {
+				p.probe(ctx, client, b)
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (p *Pool) probe(ctx context.Context, client *http.Client, b *Backend) {
+	ok := false
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.scheme+"://"+b.Address+p.health.Path, nil)
+	if err == nil {
+		req.Host = p.host
+		var resp *http.Response
+		if resp, err = client.Do(req); err == nil {
+			_ = resp.Body.Close()
+			ok = resp.StatusCode < http.StatusInternalServerError
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.removed {
+		return
+	}
+	if ok {
+		b.probeFails = 0
+		b.probeSuccess++
+		if !b.Healthy() && b.probeSuccess >= max(p.health.HealthyThreshold, 1) {
+			b.fails = 0
+			p.setHealthy(b, true, "health check passed")
+		}
+		return
+	}
+	if b.exported {
+		backendFailures.WithLabelValues(p.name, b.Address, "probe").Inc()
+	}
+	b.probeSuccess = 0
+	b.probeFails++
+	if b.Healthy() && b.probeFails >= max(p.health.UnhealthyThreshold, 1) {
+		p.setHealthy(b, false, "health check failed")
+	}
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,89 @@
+package upstream
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolPassiveRemoval(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	pool, err := NewPool(log, PoolConfig{Name: "passive", Scheme: "http", Host: "s3.example.com",
+		Addresses: []string{"a:80", "b:80"}, Passive: PassiveConfig{MaxFails: 2, FailTimeout: 50 * time.Millisecond}})
+	assert.NoError(t, err)
+	a, b := pool.Backends()[0], pool.Backends()[1]
+
+	pool.ReportFailure(a)
+	assert.True(t, a.Healthy())
+	pool.ReportFailure(a)
+	assert.False(t, a.Healthy())
+
+	// Only the sibling receives traffic until the fail timeout expires
+	for i := 0; i < 4; i++ {
+		next, err := pool.Next(nil, "")
+		assert.NoError(t, err)
+		assert.Equal(t, b, next)
+	}
+	_, err = pool.Next(map[*Backend]bool{b: true}, "")
+	assert.ErrorIs(t, err, ErrNoHealthyBackend)
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = pool.Next(map[*Backend]bool{b: true}, "")
+	assert.NoError(t, err)
+	assert.True(t, a.Healthy())
+}
+
+func TestPoolSuccessResetsFailures(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	pool, err := NewPool(log, PoolConfig{Name: "reset", Scheme: "http", Host: "s3.example.com",
+		Addresses: []string{"a:80"}, Passive: PassiveConfig{MaxFails: 2, FailTimeout: time.Minute}})
+	assert.NoError(t, err)
+	a := pool.Backends()[0]
+
+	pool.ReportFailure(a)
+	pool.ReportSuccess(a)
+	pool.ReportFailure(a)
+	assert.True(t, a.Healthy())
+}
+
+func TestPoolActiveHealthChecks(t *testing.T) {
+	log, _ := zap.NewDevelopment()
+	var failing int32 = 1
+	var host atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.Store(r.Host)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+
+	pool, err := NewPool(log, PoolConfig{
+		Name:      "active",
+		Scheme:    "http",
+		Host:      "s3.example.com",
+		Addresses: []string{strings.TrimPrefix(srv.URL, "http://"), strings.TrimPrefix(healthy.URL, "http://")},
+		HealthCheck: HealthCheckConfig{Path: "/", Interval: 10 * time.Millisecond, Timeout: 10 * time.Millisecond,
+			HealthyThreshold: 2, UnhealthyThreshold: 2},
+	})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool.RunHealthChecks(ctx, http.DefaultTransport)
+
+	backend := pool.Backends()[0]
+	assert.Eventually(t, func() bool { return !backend.Healthy() }, time.Second, 5*time.Millisecond)
+	assert.True(t, pool.Backends()[1].Healthy())
+	assert.Equal(t, "s3.example.com", host.Load())
+
+	atomic.StoreInt32(&failing, 0)
+	assert.Eventually(t, backend.Healthy, time.Second, 5*time.Millisecond)
+}
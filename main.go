@@ -3,15 +3,21 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/admin"
 	"github.com/coreweave/aws-s3-reverse-proxy/internal/cache"
 	"github.com/coreweave/aws-s3-reverse-proxy/internal/cfg"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/credentials"
 	"github.com/coreweave/aws-s3-reverse-proxy/internal/handler"
 	"github.com/coreweave/aws-s3-reverse-proxy/internal/server"
+	"github.com/coreweave/aws-s3-reverse-proxy/internal/transport"
 	"go.uber.org/zap"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -33,45 +39,142 @@ func main() {
 		os.Exit(2)
 	}
 
-	adminClient := handler.NewRgwAdminClient(opts.RgwAdminAccessKeys, opts.RgwAdminSecretKeys, opts.RgwAdminEndpoints)
-	authCache := cache.NewAuthCache(adminClient, logger)
+	adminClient, err := buildAdminClient(logger, opts)
+	if err != nil {
+		logger.Sugar().Fatalf("unable to build credential sources: %s", err.Error())
+	}
+	if opts.SyncCacheMinutes <= 0 {
+		logger.Sugar().Fatalf("cache sync interval must be positive, got %d minutes", opts.SyncCacheMinutes)
+	}
+	if opts.ExpireCacheMinutes > 0 && opts.ExpireCacheMinutes <= opts.SyncCacheMinutes {
+		logger.Sugar().Warnf("cache expiry of %d minutes is not longer than the %d minute sync interval, keys may expire between syncs",
+			opts.ExpireCacheMinutes, opts.SyncCacheMinutes)
+	}
+	authCache, err := cache.NewAuthCache(adminClient, logger, cache.Config{
+		Expire:  time.Duration(opts.ExpireCacheMinutes) * time.Minute,
+		Evict:   time.Duration(opts.EvictCacheMinutes) * time.Minute,
+		MaxKeys: opts.CacheMaxKeys,
+	})
+	if err != nil {
+		logger.Sugar().Fatalf("unable to build auth cache: %s", err.Error())
+	}
 	//Load initial key state
 	if err = authCache.Load(); err != nil {
 		logger.Sugar().Errorf("unable to load initial rgw user keys due to: %s", err.Error())
 		os.Exit(3)
 	}
 
-	// Runs async cach syncing every 5 minutes for new users and deleted users
-	authCache.RunSync(5*time.Minute, ctx)
+	// Runs async cache syncing for new users, deleted users expire once they miss syncs past the expiry
+	authCache.RunSync(time.Duration(opts.SyncCacheMinutes)*time.Minute, ctx)
 
-	proxyHandler, err := handler.NewAwsS3ReverseProxy(ctx, logger, opts, authCache, false)
+	proxyHandler, err := handler.NewAwsS3ReverseProxy(ctx, logger, opts, authCache)
 	if err != nil {
 		logger.Sugar().Fatalf("unable to build proxy handler: %s", err.Error())
 	}
 
-	httpsProxyHandler, err := handler.NewAwsS3ReverseProxy(ctx, logger, opts, authCache, true)
-	if err != nil {
-		logger.Sugar().Fatalf("unable to build proxy handler: %s", err.Error())
+	if opts.RoutingConfig != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		proxyHandler.WatchRoutingConfig(ctx, opts.RoutingConfigPollInterval, reload)
 	}
 
 	for _, subnet := range proxyHandler.AllowedSourceSubnet {
 		logger.Sugar().Debugf("Allowing connections from %v.", subnet)
 	}
+	if len(proxyHandler.AllowedSourceSubnet) == 0 {
+		logger.Warn("No allowed source subnet configured, allowing connections from every source.")
+	}
 
 	var wrappedHandler http.Handler = proxyHandler
-	var wrappedHttpsHandler http.Handler = httpsProxyHandler
+
+	var adminHandler http.Handler
+	if opts.AdminToken != "" {
+		adminApi, err := admin.NewHandler(logger, authCache, opts.AdminToken, opts.AdminWebhookSecret)
+		if err != nil {
+			logger.Sugar().Fatalf("unable to build admin handler: %s", err.Error())
+		}
+		adminApi.HandleCircuits(proxyHandler.CircuitStatus)
+		adminHandler = adminApi
+	}
+
+	var proxyProtocolTrusted []*net.IPNet
+	for _, sender := range opts.ProxyProtocolTrustedSenders {
+		_, subnet, err := net.ParseCIDR(sender)
+		if err != nil {
+			logger.Sugar().Fatalf("invalid proxy protocol trusted sender %q: %s", sender, err.Error())
+		}
+		proxyProtocolTrusted = append(proxyProtocolTrusted, subnet)
+	}
 
 	// Server
 	srv := server.ProxyServer{
-		Handler:          wrappedHandler,
-		HttpsHandler:     wrappedHttpsHandler,
-		Log:              logger,
-		Cert:             opts.CertFile,
-		Key:              opts.KeyFile,
-		UpstreamInsecure: opts.UpstreamInsecure,
+		Handler:      wrappedHandler,
+		AdminHandler: adminHandler,
+		AdminAddr:    opts.AdminListenAddr,
+		AdminCert:    opts.AdminCertFile,
+		AdminKey:     opts.AdminKeyFile,
+		Log:          logger,
+		Cert:         opts.CertFile,
+		Key:          opts.KeyFile,
+
+		ProxyProtocolTrusted:  proxyProtocolTrusted,
+		ProxyProtocolRequired: opts.ProxyProtocolRequired,
 	}
 
 	wg := &sync.WaitGroup{}
 	srv.StartServer(wg)
 
 }
+
+// buildAdminClient combines every configured credential source, rgw is always configured
+func buildAdminClient(logger *zap.Logger, opts cfg.Options) (*credentials.CompositeAdminClient, error) {
+	rgwHttpClient, err := transport.NewHTTPClient(transport.ClientConfig{
+		TLS: transport.TLSConfig{
+			CAFile:             opts.RgwAdminCAFile,
+			CertFile:           opts.RgwAdminCertFile,
+			KeyFile:            opts.RgwAdminKeyFile,
+			InsecureSkipVerify: opts.RgwAdminInsecure,
+		},
+		Timeout:  opts.RgwAdminTimeout,
+		ProxyURL: opts.RgwAdminProxy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid rgw admin http client settings: %w", err)
+	}
+	rgw, err := handler.NewRgwAdminClient(opts.RgwAdminAccessKeys, opts.RgwAdminSecretKeys, opts.RgwAdminEndpoints, opts.RgwAdminClusters, rgwHttpClient)
+	if err != nil {
+		return nil, err
+	}
+	sources := []credentials.Source{{Name: handler.RgwCredentialSource, Client: rgw}}
+	if len(opts.AwsCredentials) > 0 {
+		static, err := credentials.NewStaticAdminClient(opts.AwsCredentials)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, credentials.Source{Name: credentials.StaticCredentialSource, Client: static})
+	}
+	if opts.VaultAddr != "" {
+		vault, err := credentials.NewVaultAdminClient(opts.VaultAddr, opts.VaultToken, opts.VaultPath, 30*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, credentials.Source{Name: credentials.VaultCredentialSource, Client: vault})
+	}
+
+	// The default precedence lists every known source, skip the ones that were not configured
+	configured := make(map[string]bool, len(sources))
+	for _, s := range sources {
+		configured[s.Name] = true
+	}
+	var precedence []string
+	for _, name := range opts.CredentialOrder {
+		switch name {
+		case handler.RgwCredentialSource, credentials.StaticCredentialSource, credentials.VaultCredentialSource:
+			if !configured[name] {
+				continue
+			}
+		}
+		precedence = append(precedence, name)
+	}
+	return credentials.NewCompositeAdminClient(logger, precedence, sources...)
+}